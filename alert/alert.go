@@ -0,0 +1,298 @@
+// Package alert evaluates alerting rules over the metrics of a time series
+// database, and notifies webhook receivers, in the Alertmanager format, when
+// alerts fire and resolve.
+//
+// Each series returned by the expression of a rule is an alert. An alert is
+// pending until the expression has returned it for the duration of the rule,
+// it then fires. Receivers are notified once when the alerts of a rule fire or
+// resolve, and again every repeat interval while they're firing.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/arl/golab-2019/tsdb"
+)
+
+// A Rule describes an alert.
+type Rule struct {
+	Name string // alertname label
+
+	// Expr is the query evaluated, e.g.
+	//	histogram_quantile(0.99, sum by (le) (rate(latency_bucket[5m]))) > 0.1
+	Expr string
+
+	// For is how long the expression must return an alert before it fires.
+	For time.Duration
+
+	Labels map[string]string // added to the alerts
+
+	// Annotations are added to the alerts, they're templates where $value is
+	// the value of the alert and $labels its labels, e.g.
+	//	p99 latency of {{ $labels.route }} is {{ $value }}s
+	Annotations map[string]string
+}
+
+// A Querier evaluates queries, at a given time in milliseconds.
+type Querier interface {
+	Query(q string, t int64) (*tsdb.Result, error)
+}
+
+// State is the state of an alert.
+type State int
+
+// Alert states.
+const (
+	StatePending State = iota
+	StateFiring
+)
+
+func (s State) String() string {
+	if s == StateFiring {
+		return "firing"
+	}
+	return "pending"
+}
+
+// An Alert is an active alert.
+type Alert struct {
+	Labels      map[string]string
+	Annotations map[string]string
+	State       State
+	Value       float64   // at the last evaluation
+	ActiveAt    time.Time // when it became pending
+	FiredAt     time.Time // when it fired, zero if it's pending
+	ResolvedAt  time.Time // when it resolved, zero if it's active
+
+	fingerprint string
+}
+
+// Options configures a Manager.
+type Options struct {
+	// Receivers are the URLs of the webhook receivers.
+	Receivers []string
+
+	// RepeatInterval is the interval between notifications of alerts that
+	// are still firing, defaults to 4 hours.
+	RepeatInterval time.Duration
+
+	// ExternalURL is the URL of the server evaluating the rules, sent in
+	// the notifications.
+	ExternalURL string
+
+	// Client sends the notifications, defaults to http.DefaultClient.
+	Client *http.Client
+
+	// OnSend, if not nil, is called after each notification to a receiver.
+	OnSend func(receiver string, err error)
+}
+
+// ruleState is the state of a rule, protected by Manager.mu.
+type ruleState struct {
+	rule        Rule
+	annotations map[string]*template.Template
+
+	active   map[string]*Alert // by fingerprint
+	resolved []*Alert          // not notified yet
+	changed  bool              // alerts fired or resolved since the last notification
+	sentAt   time.Time
+}
+
+// A Manager evaluates rules and sends the notifications.
+type Manager struct {
+	q    Querier
+	opts Options
+
+	mu    sync.Mutex
+	rules []*ruleState
+}
+
+// NewManager creates a manager evaluating rules with q. It returns an error if
+// a rule is invalid.
+func NewManager(q Querier, rules []Rule, opts Options) (*Manager, error) {
+	if opts.RepeatInterval <= 0 {
+		opts.RepeatInterval = 4 * time.Hour
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	m := &Manager{q: q, opts: opts}
+	for _, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("alert: rule without name")
+		}
+		if _, err := tsdb.ParseExpr(r.Expr); err != nil {
+			return nil, fmt.Errorf("alert: rule %s: %v", r.Name, err)
+		}
+		rs := &ruleState{
+			rule:        r,
+			annotations: make(map[string]*template.Template),
+			active:      make(map[string]*Alert),
+		}
+		for k, text := range r.Annotations {
+			tmpl, err := template.New(k).Parse("{{$labels := .Labels}}{{$value := .Value}}" + text)
+			if err != nil {
+				return nil, fmt.Errorf("alert: rule %s: annotation %s: %v", r.Name, k, err)
+			}
+			rs.annotations[k] = tmpl
+		}
+		m.rules = append(m.rules, rs)
+	}
+	return m, nil
+}
+
+// Run evaluates the rules every interval until ctx is done. Errors are
+// reported to errf, if not nil.
+func (m *Manager) Run(ctx context.Context, interval time.Duration, errf func(error)) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-tick.C:
+			if err := m.Eval(ctx, t); err != nil && errf != nil {
+				errf(err)
+			}
+		}
+	}
+}
+
+// Eval evaluates the rules at time t, and sends the notifications. Rules
+// which couldn't be evaluated keep their alerts as they are.
+func (m *Manager) Eval(ctx context.Context, t time.Time) error {
+	m.mu.Lock()
+	var errs []string
+	for _, rs := range m.rules {
+		if err := m.evalRule(rs, t); err != nil {
+			errs = append(errs, fmt.Sprintf("rule %s: %v", rs.rule.Name, err))
+		}
+	}
+	msgs := m.messages(t)
+	m.mu.Unlock()
+
+	for _, msg := range msgs {
+		if err := m.send(ctx, msg); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("alert: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// evalRule updates the alerts of a rule, m.mu must be held.
+func (m *Manager) evalRule(rs *ruleState, t time.Time) error {
+	res, err := m.q.Query(rs.rule.Expr, t.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, s := range res.Series {
+		labels := make(map[string]string, len(s.Labels)+len(rs.rule.Labels)+1)
+		for _, l := range s.Labels {
+			if l.Name != tsdb.MetricName {
+				labels[l.Name] = l.Value
+			}
+		}
+		for k, v := range rs.rule.Labels {
+			labels[k] = v
+		}
+		labels["alertname"] = rs.rule.Name
+		fp := fingerprint(labels)
+		seen[fp] = true
+
+		a, ok := rs.active[fp]
+		if !ok {
+			a = &Alert{Labels: labels, State: StatePending, ActiveAt: t, fingerprint: fp}
+			rs.active[fp] = a
+		}
+		a.Value = s.Samples[len(s.Samples)-1].V
+		a.Annotations = rs.expand(a)
+		if a.State == StatePending && t.Sub(a.ActiveAt) >= rs.rule.For {
+			a.State, a.FiredAt = StateFiring, t
+			rs.changed = true
+		}
+	}
+
+	for fp, a := range rs.active {
+		if seen[fp] {
+			continue
+		}
+		delete(rs.active, fp)
+		if a.State == StateFiring {
+			a.ResolvedAt = t
+			rs.resolved = append(rs.resolved, a)
+			rs.changed = true
+		}
+	}
+	return nil
+}
+
+// expand returns the annotations of a.
+func (rs *ruleState) expand(a *Alert) map[string]string {
+	data := struct {
+		Labels map[string]string
+		Value  string
+	}{a.Labels, strconv.FormatFloat(a.Value, 'g', 4, 64)}
+
+	res := make(map[string]string, len(rs.annotations))
+	for k, tmpl := range rs.annotations {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			res[k] = rs.rule.Annotations[k]
+			continue
+		}
+		res[k] = b.String()
+	}
+	return res
+}
+
+// Alerts returns the active alerts, sorted by name and labels.
+func (m *Manager) Alerts() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var alerts []Alert
+	for _, rs := range m.rules {
+		for _, a := range rs.active {
+			alerts = append(alerts, *a)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		ai, aj := alerts[i], alerts[j]
+		if ai.Labels["alertname"] != aj.Labels["alertname"] {
+			return ai.Labels["alertname"] < aj.Labels["alertname"]
+		}
+		return ai.fingerprint < aj.fingerprint
+	})
+	return alerts
+}
+
+// fingerprint identifies a set of labels.
+func fingerprint(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for n := range labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	h := fnv.New64a()
+	for _, n := range names {
+		h.Write([]byte(n))
+		h.Write([]byte{0xff})
+		h.Write([]byte(labels[n]))
+		h.Write([]byte{0xff})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
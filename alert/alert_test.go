@@ -0,0 +1,208 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arl/golab-2019/tsdb"
+)
+
+// querier returns the series of its map, for all queries.
+type querier struct {
+	mu     sync.Mutex
+	series map[string]float64 // by route
+}
+
+func (q *querier) set(series map[string]float64) {
+	q.mu.Lock()
+	q.series = series
+	q.mu.Unlock()
+}
+
+func (q *querier) Query(_ string, t int64) (*tsdb.Result, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res := &tsdb.Result{}
+	for route, v := range q.series {
+		res.Series = append(res.Series, tsdb.Series{
+			Labels:  tsdb.Labels{{Name: tsdb.MetricName, Value: "latency"}, {Name: "route", Value: route}},
+			Samples: []tsdb.Sample{{T: t, V: v}},
+		})
+	}
+	return res, nil
+}
+
+// receiver is a webhook receiver recording the messages it receives.
+type receiver struct {
+	*httptest.Server
+	mu     sync.Mutex
+	msgs   []webhookMessage
+	status int
+}
+
+func newReceiver() *receiver {
+	r := &receiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var msg webhookMessage
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.status == http.StatusOK {
+			r.msgs = append(r.msgs, msg)
+		}
+		w.WriteHeader(r.status)
+	}))
+	return r
+}
+
+// received returns the messages received since the last call.
+func (r *receiver) received() []webhookMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := r.msgs
+	r.msgs = nil
+	return msgs
+}
+
+func TestManager(t *testing.T) {
+	recv := newReceiver()
+	defer recv.Close()
+
+	q := &querier{}
+	m, err := NewManager(q, []Rule{{
+		Name:        "HighLatency",
+		Expr:        "latency > 0.1",
+		For:         time.Minute,
+		Labels:      map[string]string{"severity": "page"},
+		Annotations: map[string]string{"summary": "p99 latency of {{ $labels.route }} is {{ $value }}s"},
+	}}, Options{
+		Receivers:      []string{recv.URL},
+		RepeatInterval: time.Hour,
+		ExternalURL:    "http://cache:8080",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2019, 10, 21, 12, 0, 0, 0, time.UTC)
+	eval := func(d time.Duration) []webhookMessage {
+		t.Helper()
+		if err := m.Eval(context.Background(), t0.Add(d)); err != nil {
+			t.Fatal(err)
+		}
+		return recv.received()
+	}
+
+	q.set(map[string]float64{"/get": 0.25})
+	if msgs := eval(0); len(msgs) != 0 {
+		t.Fatalf("pending alert notified: %+v", msgs)
+	}
+	if alerts := m.Alerts(); len(alerts) != 1 || alerts[0].State != StatePending {
+		t.Fatalf("alerts = %+v, want 1 pending alert", alerts)
+	}
+
+	msgs := eval(time.Minute)
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages once firing, want 1", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.Status != "firing" || len(msg.Alerts) != 1 {
+		t.Fatalf("message = %+v, want 1 firing alert", msg)
+	}
+	a := msg.Alerts[0]
+	wantLabels := map[string]string{"alertname": "HighLatency", "route": "/get", "severity": "page"}
+	if len(a.Labels) != len(wantLabels) || a.Labels["route"] != "/get" || a.Labels["severity"] != "page" || a.Labels["alertname"] != "HighLatency" {
+		t.Errorf("labels = %v, want %v", a.Labels, wantLabels)
+	}
+	if got := a.Annotations["summary"]; got != "p99 latency of /get is 0.25s" {
+		t.Errorf("summary = %q", got)
+	}
+	if !a.StartsAt.Equal(t0.Add(time.Minute)) || !a.EndsAt.IsZero() {
+		t.Errorf("startsAt = %v, endsAt = %v", a.StartsAt, a.EndsAt)
+	}
+	if msg.CommonLabels["severity"] != "page" || msg.GroupLabels["alertname"] != "HighLatency" {
+		t.Errorf("common labels = %v, group labels = %v", msg.CommonLabels, msg.GroupLabels)
+	}
+
+	// Deduplicated until the repeat interval.
+	if msgs := eval(2 * time.Minute); len(msgs) != 0 {
+		t.Errorf("firing alert notified again before the repeat interval: %+v", msgs)
+	}
+	if msgs := eval(time.Hour + time.Minute); len(msgs) != 1 || msgs[0].Status != "firing" {
+		t.Errorf("firing alert not notified again after the repeat interval: %+v", msgs)
+	}
+
+	// A second alert of the same rule is notified with the first one.
+	q.set(map[string]float64{"/get": 0.25, "/add": 0.5})
+	eval(time.Hour + 2*time.Minute)
+	if msgs := eval(time.Hour + 3*time.Minute); len(msgs) != 1 || len(msgs[0].Alerts) != 2 {
+		t.Errorf("got %+v, want both alerts notified", msgs)
+	}
+
+	// Resolved, the receiver is down.
+	q.set(nil)
+	recv.mu.Lock()
+	recv.status = http.StatusServiceUnavailable
+	recv.mu.Unlock()
+	if err := m.Eval(context.Background(), t0.Add(2*time.Hour)); err == nil {
+		t.Errorf("Eval should fail when the receiver is down")
+	}
+
+	recv.mu.Lock()
+	recv.status = http.StatusOK
+	recv.mu.Unlock()
+	msgs = eval(2*time.Hour + time.Minute)
+	if len(msgs) != 1 || msgs[0].Status != "resolved" || len(msgs[0].Alerts) != 2 {
+		t.Fatalf("got %+v, want the resolved alerts notified once the receiver is up", msgs)
+	}
+	for _, a := range msgs[0].Alerts {
+		if a.Status != "resolved" || !a.EndsAt.Equal(t0.Add(2*time.Hour)) {
+			t.Errorf("alert %v: status %s, endsAt %v", a.Labels, a.Status, a.EndsAt)
+		}
+	}
+	if msgs := eval(3 * time.Hour); len(msgs) != 0 {
+		t.Errorf("resolved alerts notified again: %+v", msgs)
+	}
+	if alerts := m.Alerts(); len(alerts) != 0 {
+		t.Errorf("alerts = %+v, want none", alerts)
+	}
+}
+
+func TestPendingAlertNotNotified(t *testing.T) {
+	recv := newReceiver()
+	defer recv.Close()
+
+	q := &querier{}
+	m, err := NewManager(q, []Rule{{Name: "HighLatency", Expr: "latency > 0.1", For: 5 * time.Minute}}, Options{Receivers: []string{recv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now()
+	q.set(map[string]float64{"/get": 1})
+	m.Eval(context.Background(), t0)
+	q.set(nil)
+	m.Eval(context.Background(), t0.Add(time.Minute))
+	if msgs := recv.received(); len(msgs) != 0 {
+		t.Errorf("alert resolved before firing notified: %+v", msgs)
+	}
+}
+
+func TestNewManagerInvalidRule(t *testing.T) {
+	for _, r := range []Rule{
+		{Expr: "up"},
+		{Name: "Bad", Expr: "up >"},
+		{Name: "Bad", Expr: "up", Annotations: map[string]string{"summary": "{{ $value"}},
+	} {
+		if _, err := NewManager(&querier{}, []Rule{r}, Options{}); err == nil {
+			t.Errorf("NewManager(%+v) should fail", r)
+		}
+	}
+}
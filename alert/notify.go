@@ -0,0 +1,173 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookMessage is the payload Alertmanager sends to webhook receivers.
+type webhookMessage struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	TruncatedAlerts   int               `json:"truncatedAlerts"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []webhookAlert    `json:"alerts"`
+}
+
+type webhookAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// A message is a notification of the alerts of a rule.
+type message struct {
+	rs       *ruleState
+	t        time.Time
+	resolved int // number of resolved alerts notified
+	body     []byte
+}
+
+// messages returns the notifications to send at time t, m.mu must be held.
+// The alerts of a rule are notified together, if some fired or resolved
+// since the last notification, or if some are still firing after the repeat
+// interval.
+func (m *Manager) messages(t time.Time) []*message {
+	var msgs []*message
+	for _, rs := range m.rules {
+		var alerts []webhookAlert
+		for _, a := range rs.active {
+			if a.State == StateFiring {
+				alerts = append(alerts, m.webhookAlert(rs, a))
+			}
+		}
+		firing := len(alerts) > 0
+		if !rs.changed && !(firing && t.Sub(rs.sentAt) >= m.opts.RepeatInterval) {
+			continue
+		}
+		if len(m.opts.Receivers) == 0 {
+			rs.changed, rs.resolved, rs.sentAt = false, nil, t
+			continue
+		}
+		for _, a := range rs.resolved {
+			alerts = append(alerts, m.webhookAlert(rs, a))
+		}
+
+		wm := webhookMessage{
+			Version:           "4",
+			GroupKey:          fmt.Sprintf("{}:{alertname=%q}", rs.rule.Name),
+			Status:            "resolved",
+			Receiver:          "webhook",
+			GroupLabels:       map[string]string{"alertname": rs.rule.Name},
+			CommonLabels:      common(alerts, func(a webhookAlert) map[string]string { return a.Labels }),
+			CommonAnnotations: common(alerts, func(a webhookAlert) map[string]string { return a.Annotations }),
+			ExternalURL:       m.opts.ExternalURL,
+			Alerts:            alerts,
+		}
+		if firing {
+			wm.Status = "firing"
+		}
+		body, _ := json.Marshal(wm)
+		msgs = append(msgs, &message{rs: rs, t: t, resolved: len(rs.resolved), body: body})
+	}
+	return msgs
+}
+
+func (m *Manager) webhookAlert(rs *ruleState, a *Alert) webhookAlert {
+	wa := webhookAlert{
+		Status:      "firing",
+		Labels:      a.Labels,
+		Annotations: a.Annotations,
+		StartsAt:    a.FiredAt,
+		EndsAt:      a.ResolvedAt,
+		Fingerprint: a.fingerprint,
+	}
+	if !a.ResolvedAt.IsZero() {
+		wa.Status = "resolved"
+	}
+	if m.opts.ExternalURL != "" {
+		wa.GeneratorURL = m.opts.ExternalURL + "/api/v1/query?query=" + url.QueryEscape(rs.rule.Expr)
+	}
+	return wa
+}
+
+// common returns the key/value pairs of the maps returned by get that are
+// common to all alerts.
+func common(alerts []webhookAlert, get func(webhookAlert) map[string]string) map[string]string {
+	res := make(map[string]string)
+	if len(alerts) == 0 {
+		return res
+	}
+	for k, v := range get(alerts[0]) {
+		res[k] = v
+	}
+	for _, a := range alerts[1:] {
+		m := get(a)
+		for k, v := range res {
+			if m[k] != v {
+				delete(res, k)
+			}
+		}
+	}
+	return res
+}
+
+// send sends msg to all receivers. If all of them accepted it, the state of
+// its rule is updated, otherwise the notification is sent again, to all
+// receivers, after the next evaluation.
+func (m *Manager) send(ctx context.Context, msg *message) error {
+	var failed error
+	for _, recv := range m.opts.Receivers {
+		err := m.post(ctx, recv, msg.body)
+		if m.opts.OnSend != nil {
+			m.opts.OnSend(recv, err)
+		}
+		if err != nil {
+			failed = err
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg.rs.changed = false
+	msg.rs.sentAt = msg.t
+	msg.rs.resolved = msg.rs.resolved[msg.resolved:]
+	return nil
+}
+
+func (m *Manager) post(ctx context.Context, recv string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, recv, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.opts.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("receiver %s: %s", recv, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arl/golab-2019/alert"
+)
+
+// alertRules returns the alerting rules enabled in cfg.
+func alertRules(cfg *config) []alert.Rule {
+	var rules []alert.Rule
+	if cfg.AlertHitRatioMin > 0 {
+		rules = append(rules, alert.Rule{
+			Name: "CacheHitRatioLow",
+			Expr: fmt.Sprintf("sum(rate(cache_hits_total[5m])) / "+
+				"(sum(rate(cache_hits_total[5m])) + sum(rate(cache_misses_total[5m]))) < %g", cfg.AlertHitRatioMin),
+			For:    cfg.AlertHitRatioFor,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("Cache hit ratio is {{ $value }}, below %g", cfg.AlertHitRatioMin),
+			},
+		})
+	}
+	if cfg.AlertLatencyMax > 0 {
+		rules = append(rules, alert.Rule{
+			Name: "CacheLatencyHigh",
+			Expr: fmt.Sprintf("histogram_quantile(0.99, sum by (route, le) "+
+				"(rate(http_request_duration_seconds_bucket{route=~\"/get|/add\"}[5m]))) > %g", cfg.AlertLatencyMax.Seconds()),
+			For:    cfg.AlertLatencyFor,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("p99 latency of {{ $labels.route }} is {{ $value }}s, above %v", cfg.AlertLatencyMax),
+			},
+		})
+	}
+	if cfg.AlertEvictionMax > 0 {
+		rules = append(rules, alert.Rule{
+			Name:   "CacheEvictionRateHigh",
+			Expr:   fmt.Sprintf("sum(rate(cache_evictions_total[5m])) > %g", cfg.AlertEvictionMax),
+			For:    cfg.AlertEvictionFor,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("{{ $value }} evictions per second, above %g, the cache may be too small", cfg.AlertEvictionMax),
+			},
+		})
+	}
+	return rules
+}
+
+// newAlerting creates the alert manager evaluating the rules of cfg with q.
+func newAlerting(cfg *config, q alert.Querier) (*alert.Manager, error) {
+	return alert.NewManager(q, alertRules(cfg), alert.Options{
+		Receivers:      cfg.AlertReceivers,
+		RepeatInterval: cfg.AlertRepeatInterval,
+		Client:         &http.Client{Timeout: 10 * time.Second},
+		// Failures are logged with the evaluation errors.
+		OnSend: func(receiver string, err error) {
+			result := "success"
+			if err != nil {
+				result = "failure"
+			}
+			alertNotifications.WithLabelValues(result).Inc()
+		},
+	})
+}
+
+// handleAlerts serves the active alerts, as the Prometheus /api/v1/alerts
+// endpoint.
+func (s *server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	type jsonAlert struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		State       string            `json:"state"`
+		ActiveAt    time.Time         `json:"activeAt"`
+		Value       string            `json:"value"`
+	}
+	alerts := []jsonAlert{}
+	for _, a := range s.alerts.Alerts() {
+		alerts = append(alerts, jsonAlert{
+			Labels:      a.Labels,
+			Annotations: a.Annotations,
+			State:       a.State.String(),
+			ActiveAt:    a.ActiveAt,
+			Value:       strconv.FormatFloat(a.Value, 'e', -1, 64),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"alerts": alerts},
+	})
+}
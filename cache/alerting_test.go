@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAlerting(t *testing.T) {
+	notified := make(chan map[string]interface{}, 10)
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		notified <- msg
+	}))
+	defer recv.Close()
+
+	cfg := defaultConfig()
+	cfg.CacheSize = 1
+	cfg.TSDBInterval = 10 * time.Second
+	cfg.AlertReceivers = []string{recv.URL}
+	cfg.AlertHitRatioMin = 0.5
+	cfg.AlertLatencyMax = 10 * time.Millisecond
+	cfg.AlertEvictionMax = 1
+	cfg.AlertEvictionFor = 0
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(cfg)
+	s.tsdb = newTSDB(cfg, s.reg)
+	var err error
+	if s.alerts, err = newAlerting(cfg, s.tsdb); err != nil {
+		t.Fatal(err)
+	}
+	s.setupRoutes()
+
+	// 100 evictions in 10s.
+	t0 := time.Now()
+	s.tsdb.Scrape(s.reg, t0.Add(-10*time.Second))
+	for i := 0; i <= 100; i++ {
+		s.cache.Add(strconv.Itoa(i), i)
+	}
+	s.tsdb.Scrape(s.reg, t0)
+	if err := s.alerts.Eval(context.Background(), t0); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-notified:
+		labels := msg["commonLabels"].(map[string]interface{})
+		if msg["status"] != "firing" || labels["alertname"] != "CacheEvictionRateHigh" {
+			t.Errorf("notification = %v, want CacheEvictionRateHigh firing", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/alerts", nil)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	var resp struct {
+		Data struct {
+			Alerts []struct {
+				Labels map[string]string
+				State  string
+			}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if alerts := resp.Data.Alerts; len(alerts) != 1 || alerts[0].State != "firing" || alerts[0].Labels["alertname"] != "CacheEvictionRateHigh" {
+		t.Errorf("/api/v1/alerts = %+v", alerts)
+	}
+}
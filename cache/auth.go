@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A scope is a set of permissions.
+type scope uint
+
+const (
+	scopeRead  scope = 1 << iota // read cached values
+	scopeWrite                   // add values to the cache
+	scopeAdmin                   // everything, including debug endpoints
+)
+
+var scopeNames = []struct {
+	s    scope
+	name string
+}{
+	{scopeRead, "read"},
+	{scopeWrite, "write"},
+	{scopeAdmin, "admin"},
+}
+
+// allows reports whether sc grants the permissions of required.
+func (sc scope) allows(required scope) bool {
+	return sc&scopeAdmin != 0 || sc&required == required
+}
+
+// parseScope parses a list of scope names separated by '+'.
+func parseScope(s string) (scope, error) {
+	var sc scope
+	for _, name := range strings.Split(s, "+") {
+		found := false
+		for _, sn := range scopeNames {
+			if sn.name == name {
+				sc |= sn.s
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown scope %q", name)
+		}
+	}
+	return sc, nil
+}
+
+func (sc scope) String() string {
+	var names []string
+	for _, sn := range scopeNames {
+		if sc&sn.s != 0 {
+			names = append(names, sn.name)
+		}
+	}
+	return strings.Join(names, "+")
+}
+
+// A credential is a named secret granting scopes.
+type credential struct {
+	name   string
+	secret string
+	scope  scope
+}
+
+// parseCredentials parses a list of comma-separated credentials, each written
+// as 'name=secret:scope'. The returned map is indexed by name.
+func parseCredentials(v string) (map[string]credential, error) {
+	creds := make(map[string]credential)
+	for _, s := range splitList(v) {
+		i, j := strings.Index(s, "="), strings.LastIndex(s, ":")
+		if i <= 0 || j < i+2 {
+			return nil, fmt.Errorf("invalid credential, want 'name=secret:scope'")
+		}
+		sc, err := parseScope(s[j+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s[:i], err)
+		}
+		creds[s[:i]] = credential{name: s[:i], secret: s[i+1 : j], scope: sc}
+	}
+	return creds, nil
+}
+
+func formatCredentials(creds map[string]credential) string {
+	l := make([]string, 0, len(creds))
+	for _, c := range creds {
+		l = append(l, c.name+"="+c.secret+":"+c.scope.String())
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+// An authError is an authentication or authorization failure.
+type authError struct {
+	reason string // short reason, used as metric label
+	status int    // HTTP status code
+}
+
+func (e *authError) Error() string { return strings.Replace(e.reason, "_", " ", -1) }
+
+var (
+	errMissingCredentials = &authError{"missing_credentials", http.StatusUnauthorized}
+	errUnknownScheme      = &authError{"unknown_scheme", http.StatusUnauthorized}
+	errInvalidToken       = &authError{"invalid_token", http.StatusUnauthorized}
+	errInvalidSignature   = &authError{"invalid_signature", http.StatusUnauthorized}
+	errExpiredSignature   = &authError{"expired_signature", http.StatusUnauthorized}
+	errInsufficientScope  = &authError{"insufficient_scope", http.StatusForbidden}
+)
+
+// An authenticator authenticates requests using one authorization scheme.
+type authenticator interface {
+	// authenticate returns the credential matching the request, given the
+	// value of its Authorization header, stripped from the scheme.
+	authenticate(r *http.Request, param string) (credential, *authError)
+}
+
+// tokenAuth authenticates requests bearing a static token:
+//
+//	Authorization: Bearer <token>
+type tokenAuth map[string]credential // by name
+
+func (ta tokenAuth) authenticate(r *http.Request, token string) (credential, *authError) {
+	// Compare with all tokens, in constant time, not to leak them.
+	var (
+		found credential
+		ok    bool
+	)
+	for _, c := range ta {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.secret)) == 1 {
+			found, ok = c, true
+		}
+	}
+	if !ok {
+		return credential{}, errInvalidToken
+	}
+	return found, nil
+}
+
+// maxClockSkew is the maximum age of an HMAC signed request.
+const maxClockSkew = 5 * time.Minute
+
+// hmacAuth authenticates requests signed with a shared secret:
+//
+//	Authorization: HMAC <name>:<unix timestamp>:<hex signature>
+//
+// where the signature is the HMAC-SHA256 of the method, request URI and
+// timestamp, separated by new lines. See signRequest.
+type hmacAuth struct {
+	creds map[string]credential // by name
+	now   func() time.Time
+}
+
+func (ha *hmacAuth) authenticate(r *http.Request, param string) (credential, *authError) {
+	parts := strings.Split(param, ":")
+	if len(parts) != 3 {
+		return credential{}, errInvalidSignature
+	}
+	c, ok := ha.creds[parts[0]]
+	if !ok {
+		return credential{}, errInvalidSignature
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return credential{}, errInvalidSignature
+	}
+	if d := ha.now().Sub(time.Unix(ts, 0)); d > maxClockSkew || d < -maxClockSkew {
+		return credential{}, errExpiredSignature
+	}
+	sig, err := hex.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, signature(c.secret, r.Method, r.URL.RequestURI(), parts[1])) {
+		return credential{}, errInvalidSignature
+	}
+	return c, nil
+}
+
+func signature(secret, method, uri, ts string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + ts))
+	return mac.Sum(nil)
+}
+
+// signRequest signs r with the HMAC credential name and secret, at time t.
+func signRequest(r *http.Request, name, secret string, t time.Time) {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	sig := signature(secret, r.Method, r.URL.RequestURI(), ts)
+	r.Header.Set("Authorization", "HMAC "+name+":"+ts+":"+hex.EncodeToString(sig))
+}
+
+// auth authenticates and authorizes requests, with one authenticator per
+// authorization scheme.
+//
+// Authentication is disabled when no authenticator is configured.
+type auth struct {
+	mu           sync.Mutex
+	schemes      map[string]authenticator
+	metricsToken string
+}
+
+func newAuth(cfg *config) *auth {
+	a := &auth{}
+	a.configure(cfg)
+	return a
+}
+
+// configure replaces the authenticators with the ones of cfg.
+func (a *auth) configure(cfg *config) {
+	schemes := make(map[string]authenticator)
+	if len(cfg.AuthTokens) != 0 {
+		schemes["bearer"] = tokenAuth(cfg.AuthTokens)
+	}
+	if len(cfg.AuthHMACKeys) != 0 {
+		schemes["hmac"] = &hmacAuth{creds: cfg.AuthHMACKeys, now: time.Now}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.schemes = schemes
+	a.metricsToken = cfg.MetricsToken
+}
+
+// authenticate returns the credential of the client sending r. If auth is
+// disabled, it returns a credential with all permissions.
+func (a *auth) authenticate(r *http.Request) (credential, *authError) {
+	a.mu.Lock()
+	schemes := a.schemes
+	a.mu.Unlock()
+
+	if len(schemes) == 0 {
+		return credential{name: "anonymous", scope: scopeAdmin}, nil
+	}
+
+	hdr := r.Header.Get("Authorization")
+	if hdr == "" {
+		return credential{}, errMissingCredentials
+	}
+	i := strings.Index(hdr, " ")
+	if i == -1 {
+		return credential{}, errUnknownScheme
+	}
+	authn, ok := schemes[strings.ToLower(hdr[:i])]
+	if !ok {
+		return credential{}, errUnknownScheme
+	}
+	return authn.authenticate(r, strings.TrimSpace(hdr[i+1:]))
+}
+
+// require wraps h so that it's only served to clients authenticated with a
+// credential granting the required scope.
+func (a *auth) require(required scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := a.authenticate(r)
+		if err == nil && !c.scope.allows(required) {
+			err = errInsufficientScope
+		}
+		if err != nil {
+			a.fail(w, err)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// metrics wraps the metrics handler h so that, if a metrics token is
+// configured, it's only served to clients bearing it.
+func (a *auth) metrics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		token := a.metricsToken
+		a.mu.Unlock()
+
+		if token != "" {
+			hdr := r.Header.Get("Authorization")
+			if hdr == "" {
+				a.fail(w, errMissingCredentials)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(hdr), []byte("Bearer "+token)) != 1 {
+				a.fail(w, errInvalidToken)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *auth) fail(w http.ResponseWriter, err *authError) {
+	authFailures.With(err.reason).Inc()
+	if err.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cache"`)
+	}
+	http.Error(w, err.Error(), err.status)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseCredentials(t *testing.T) {
+	creds, err := parseCredentials("loader=t0k:en:read+write,ops=adm1n:admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]credential{
+		"loader": {name: "loader", secret: "t0k:en", scope: scopeRead | scopeWrite},
+		"ops":    {name: "ops", secret: "adm1n", scope: scopeAdmin},
+	}
+	for name, c := range want {
+		if creds[name] != c {
+			t.Errorf("credential %q = %+v, want %+v", name, creds[name], c)
+		}
+	}
+	if s := formatCredentials(creds); s != "loader=t0k:en:read+write,ops=adm1n:admin" {
+		t.Errorf("formatCredentials() = %q", s)
+	}
+
+	for _, tt := range []string{"loader", "=tok:read", "loader=tok", "loader=:read", "loader=tok:root"} {
+		if _, err := parseCredentials(tt); err == nil {
+			t.Errorf("parseCredentials(%q) should fail", tt)
+		}
+	}
+}
+
+func TestAuthRequire(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AuthTokens, _ = parseCredentials("reader=r:read,writer=w:read+write,admin=a:admin")
+	cfg.AuthHMACKeys, _ = parseCredentials("svc=s3cr3t:write")
+	a := newAuth(cfg)
+
+	h := a.require(scopeWrite, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	now := time.Now()
+	tests := []struct {
+		name string
+		auth func(r *http.Request)
+		want int
+	}{
+		{"missing", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"unknown scheme", func(r *http.Request) { r.Header.Set("Authorization", "Basic dXNlcg==") }, http.StatusUnauthorized},
+		{"invalid token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"insufficient scope", func(r *http.Request) { r.Header.Set("Authorization", "Bearer r") }, http.StatusForbidden},
+		{"write scope", func(r *http.Request) { r.Header.Set("Authorization", "Bearer w") }, http.StatusOK},
+		{"admin scope", func(r *http.Request) { r.Header.Set("Authorization", "bearer a") }, http.StatusOK},
+		{"hmac", func(r *http.Request) { signRequest(r, "svc", "s3cr3t", now) }, http.StatusOK},
+		{"hmac bad secret", func(r *http.Request) { signRequest(r, "svc", "guess", now) }, http.StatusUnauthorized},
+		{"hmac expired", func(r *http.Request) { signRequest(r, "svc", "s3cr3t", now.Add(-time.Hour)) }, http.StatusUnauthorized},
+		{"hmac tampered", func(r *http.Request) {
+			signRequest(r, "svc", "s3cr3t", now)
+			r.URL.RawQuery = "k=other"
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/add?k=a&v=b", nil)
+		tt.auth(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	a := newAuth(defaultConfig())
+	h := a.require(scopeAdmin, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestAuthMetrics(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MetricsToken = "scrape"
+	a := newAuth(cfg)
+	h := a.metrics(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for hdr, want := range map[string]int{
+		"":               http.StatusUnauthorized,
+		"Bearer wrong":   http.StatusUnauthorized,
+		"Bearer scrape":  http.StatusOK,
+		"Bearer scrape ": http.StatusUnauthorized,
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if hdr != "" {
+			r.Header.Set("Authorization", hdr)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("Authorization %q: status = %d, want %d", hdr, w.Code, want)
+		}
+	}
+}
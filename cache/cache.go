@@ -2,6 +2,8 @@ package main
 
 import (
 	"container/list"
+	"encoding/json"
+	"io"
 	"sync"
 )
 
@@ -61,13 +63,34 @@ func (c *LRUCache) Add(k string, v interface{}) {
 
 	if c.l.Len() > c.maxcap {
 		// We got too big, remove the least recently used element (back of the list)
-		elem := c.l.Back()
-		c.l.Remove(elem)
-		// Removes it from the hashmap as well
-		delete(c.m, elem.Value.(*lruNode).key)
+		c.removeOldest()
 	}
 }
 
+// Resize changes the maximum capacity of the cache, evicting the least
+// recently used elements if it now holds more than maxcap elements.
+func (c *LRUCache) Resize(maxcap int) {
+	if maxcap < 0 {
+		panic("LRUCache maximum capacity must be positive!")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxcap = maxcap
+	for c.l.Len() > c.maxcap {
+		c.removeOldest()
+	}
+}
+
+// removeOldest removes the least recently used element, c.mu must be held.
+func (c *LRUCache) removeOldest() {
+	elem := c.l.Back()
+	c.l.Remove(elem)
+	// Removes it from the hashmap as well
+	delete(c.m, elem.Value.(*lruNode).key)
+	cacheEvictions.Inc()
+}
+
 // Get retrieves the value corresponding to key.
 func (c *LRUCache) Get(k string) (value interface{}, ok bool) {
 	c.mu.Lock()
@@ -82,3 +105,39 @@ func (c *LRUCache) Get(k string) (value interface{}, ok bool) {
 	c.l.MoveToFront(elem)
 	return elem.Value.(*lruNode).value, true
 }
+
+// snapshotEntry is the serialized form of a cache element.
+type snapshotEntry struct {
+	Key   string      `json:"k"`
+	Value interface{} `json:"v"`
+}
+
+// Save writes the content of the cache to w, one JSON object per element,
+// from the least to the most recently used.
+func (c *LRUCache) Save(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	for elem := c.l.Back(); elem != nil; elem = elem.Prev() {
+		n := elem.Value.(*lruNode)
+		if err := enc.Encode(snapshotEntry{Key: n.key, Value: n.value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load adds to the cache the elements read from r, previously written by Save.
+func (c *LRUCache) Load(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		c.Add(e.Key, e.Value)
+	}
+}
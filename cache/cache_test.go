@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 )
@@ -84,3 +85,54 @@ func BenchmarkLRUCacheMiss_100(b *testing.B)    { benchmarkLRUCacheMiss(b, 100)
 func BenchmarkLRUCacheMiss_1000(b *testing.B)   { benchmarkLRUCacheMiss(b, 1000) }
 func BenchmarkLRUCacheMiss_10000(b *testing.B)  { benchmarkLRUCacheMiss(b, 10000) }
 func BenchmarkLRUCacheMiss_100000(b *testing.B) { benchmarkLRUCacheMiss(b, 100000) }
+
+func TestLRUCacheResize(t *testing.T) {
+	c := NewLRUCache(3)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3)
+	c.Get("a")
+
+	c.Resize(2)
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf(`c["b"] should have been evicted`)
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf(`c["a"] should still be cached`)
+	}
+
+	c.Resize(3)
+	c.Add("d", 4)
+	if c.l.Len() != 3 {
+		t.Fatalf("len = %d, want 3", c.l.Len())
+	}
+}
+
+func TestLRUCacheSaveLoad(t *testing.T) {
+	c := NewLRUCache(3)
+	c.Add("a", "1")
+	c.Add("b", "2")
+	c.Add("c", "3")
+	c.Get("a")
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	c2 := NewLRUCache(3)
+	if err := c2.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recency must have been preserved: "b" is the least recently used.
+	c2.Resize(2)
+	if _, ok := c2.Get("b"); ok {
+		t.Fatalf(`c["b"] should have been evicted`)
+	}
+	for k, want := range map[string]string{"a": "1", "c": "3"} {
+		if v, ok := c2.Get(k); !ok || v != want {
+			t.Fatalf(`c[%q] = (%v %t), want (%v, %v)`, k, v, ok, want, true)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Package client builds the requests of the cache server HTTP API, for the
+// programs exercising it.
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// baseURL returns the URL of the server at addr, which is either a host:port,
+// reached over HTTP, or an URL.
+func baseURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+	return "http://" + addr
+}
+
+// AddRequest returns a request adding the key k with value v to the cache
+// server at addr. It fails only if addr is invalid.
+func AddRequest(addr, k, v string) (*http.Request, error) {
+	return http.NewRequest("GET", baseURL(addr)+"/add?"+url.Values{"k": {k}, "v": {v}}.Encode(), nil)
+}
+
+// GetRequest returns a request getting the value of the key k from the cache
+// server at addr. It fails only if addr is invalid.
+func GetRequest(addr, k string) (*http.Request, error) {
+	return http.NewRequest("GET", baseURL(addr)+"/get?"+url.Values{"k": {k}}.Encode(), nil)
+}
+
+// Authorize sets the bearer token of r, if token isn't empty.
+func Authorize(r *http.Request, token string) {
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
@@ -0,0 +1,822 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arl/golab-2019/instrument"
+)
+
+// config holds the cache server settings.
+//
+// Settings are read, by increasing order of precedence, from the default
+// configuration, the configuration file, the environment and the command line
+// flags explicitly set.
+type config struct {
+	Addr            string        // server listen address
+	ReadTimeout     time.Duration // maximum duration for reading a request
+	WriteTimeout    time.Duration // maximum duration before timing out writes of a response
+	IdleTimeout     time.Duration // maximum time to wait for the next request on keep-alive connections
+	MaxHeaderBytes  int           // maximum size of request headers
+	ShutdownTimeout time.Duration // maximum time to wait for in-flight requests on shutdown
+
+	CacheSize int    // LRU cache size
+	Snapshot  string // file where the cache is saved on shutdown and loaded on start
+
+	DurationBuckets []float64      // buckets of the requests duration histogram, in seconds
+	GoRuntime       []string       // groups of Go runtime metrics exported: gc, sched and memory
+	MetricsBackend  string         // backend of the cache and request metrics: prometheus, statsd, dogstatsd or influx
+	StatsDAddr      string         // address of the StatsD daemon, with the statsd and dogstatsd backends
+	InfluxURL       string         // InfluxDB write URL, with the influx backend
+	InfluxToken     string         // InfluxDB 2 API token, if any
+	InfluxInterval  time.Duration  // interval between writes to InfluxDB
+	MaxSeries       int            // maximum number of series of the cache metrics with labels, 0 for no limit
+	SeriesLimits    map[string]int // maximum number of series, by metric, overriding MaxSeries
+
+	HealthTimeout  time.Duration // maximum duration of a health check
+	HealthInterval time.Duration // interval between background runs of the health checks
+	Peers          []string      // addresses of the cluster peers
+	Origin         string        // address of the origin server
+
+	RouteLimits     map[string]limit  // rate limit per client and route
+	NamespaceLimits map[string]limit  // rate limit per client and cache key namespace
+	ClientClasses   map[string]string // client class per API key
+
+	AuthTokens   map[string]credential // bearer tokens, by name
+	AuthHMACKeys map[string]credential // HMAC signing keys, by name
+	MetricsToken string                // bearer token required to scrape /metrics
+
+	TLSCert     string // server certificate file, enables TLS
+	TLSKey      string // server private key file
+	TLSClientCA string // CA certificates file verifying clients and peers, enables mutual TLS
+
+	LogLevel         slog.Level // minimum level of logged lines
+	AccessSampleRate float64    // fraction of successful requests in the access log
+
+	TracingExporter   string  // where spans are exported: none, file or otlp
+	TracingFile       string  // file spans are appended to, with the file exporter
+	TracingEndpoint   string  // OTLP/HTTP traces endpoint, with the otlp exporter
+	TracingSampleRate float64 // fraction of new traces that are sampled
+
+	FlightRecorder          bool          // keep the recent execution trace in memory
+	FlightRecorderWindow    time.Duration // minimum age of the kept execution trace
+	FlightRecorderMaxBytes  int           // maximum size of the kept execution trace
+	FlightRecorderThreshold time.Duration // p99 latency above which the trace is dumped
+	FlightRecorderDir       string        // directory of the dumped traces
+
+	ProfilingInterval    time.Duration // interval between profiles captures, 0 disables profiling
+	ProfilingDir         string        // directory where profiles are stored
+	ProfilingMaxBytes    int           // maximum total size of the stored profiles
+	ProfilingCPUDuration time.Duration // duration of CPU profiles
+	MutexProfileFraction int           // on average 1/n mutex contention events are reported, 0 disables
+
+	TSDBInterval  time.Duration // interval between scrapes of the embedded TSDB, 0 disables it
+	TSDBRetention time.Duration // how long the embedded TSDB keeps samples
+
+	AlertReceivers      []string      // URLs of the Alertmanager compatible webhook receivers
+	AlertInterval       time.Duration // interval between evaluations of the alerting rules
+	AlertRepeatInterval time.Duration // interval between notifications of firing alerts
+	AlertHitRatioMin    float64       // hit ratio below which an alert fires, 0 disables
+	AlertHitRatioFor    time.Duration // how long the hit ratio must be low before firing
+	AlertLatencyMax     time.Duration // p99 latency of /get and /add above which an alert fires, 0 disables
+	AlertLatencyFor     time.Duration // how long the latency must be high before firing
+	AlertEvictionMax    float64       // evictions per second above which an alert fires, 0 disables
+	AlertEvictionFor    time.Duration // how long the eviction rate must be high before firing
+
+	Objectives []objective   // service level objectives of the routes
+	SLOWindow  time.Duration // window over which the objectives are measured
+}
+
+func defaultConfig() *config {
+	return &config{
+		Addr:             ":8080",
+		ReadTimeout:      5 * time.Second,
+		WriteTimeout:     10 * time.Second,
+		IdleTimeout:      2 * time.Minute,
+		MaxHeaderBytes:   1 << 16,
+		ShutdownTimeout:  15 * time.Second,
+		CacheSize:        256,
+		DurationBuckets:  prometheus.ExponentialBuckets(0.0001, 2, 16),
+		GoRuntime:        []string{"gc", "sched", "memory"},
+		MetricsBackend:   "prometheus",
+		StatsDAddr:       "localhost:8125",
+		InfluxURL:        "http://localhost:8086/write?db=cache",
+		InfluxInterval:   10 * time.Second,
+		MaxSeries:        1000,
+		HealthTimeout:    time.Second,
+		HealthInterval:   10 * time.Second,
+		LogLevel:         slog.LevelInfo,
+		AccessSampleRate: 1,
+
+		TracingExporter:   "none",
+		TracingEndpoint:   "http://localhost:4318/v1/traces",
+		TracingSampleRate: 1,
+
+		FlightRecorderWindow:    10 * time.Second,
+		FlightRecorderMaxBytes:  16 << 20,
+		FlightRecorderThreshold: 500 * time.Millisecond,
+		FlightRecorderDir:       os.TempDir(),
+
+		ProfilingDir:         "profiles",
+		ProfilingMaxBytes:    256 << 20,
+		ProfilingCPUDuration: 10 * time.Second,
+		MutexProfileFraction: 5,
+
+		TSDBRetention: time.Hour,
+
+		AlertInterval:       15 * time.Second,
+		AlertRepeatInterval: 4 * time.Hour,
+		AlertHitRatioFor:    5 * time.Minute,
+		AlertLatencyFor:     5 * time.Minute,
+		AlertEvictionFor:    5 * time.Minute,
+
+		Objectives: []objective{
+			{name: "get_availability", route: "/get", kind: "availability", target: 99.9},
+			{name: "get_latency", route: "/get", kind: "latency", target: 99.9, threshold: 5 * time.Millisecond},
+			{name: "add_availability", route: "/add", kind: "availability", target: 99.9},
+			{name: "add_latency", route: "/add", kind: "latency", target: 99.9, threshold: 5 * time.Millisecond},
+		},
+		SLOWindow: 30 * 24 * time.Hour,
+	}
+}
+
+// An option describes a single configuration setting.
+type option struct {
+	key  string // key in the configuration file, 'section.name'
+	live bool   // whether the setting can be applied without restarting
+	set  func(c *config, v string) error
+	get  func(c *config) string
+}
+
+// env returns the name of the environment variable overriding the option.
+//
+// For example the environment variable for 'cache.size' is CACHE_CACHE_SIZE.
+func (o *option) env() string {
+	return "CACHE_" + strings.ToUpper(strings.Replace(o.key, ".", "_", -1))
+}
+
+var options = []option{
+	{
+		key: "server.addr",
+		set: func(c *config, v string) error { c.Addr = v; return nil },
+		get: func(c *config) string { return c.Addr },
+	},
+	durationOption("server.read_timeout", false, func(c *config) *time.Duration { return &c.ReadTimeout }),
+	durationOption("server.write_timeout", false, func(c *config) *time.Duration { return &c.WriteTimeout }),
+	durationOption("server.idle_timeout", false, func(c *config) *time.Duration { return &c.IdleTimeout }),
+	intOption("server.max_header_bytes", false, func(c *config) *int { return &c.MaxHeaderBytes }),
+	durationOption("server.shutdown_timeout", true, func(c *config) *time.Duration { return &c.ShutdownTimeout }),
+	intOption("cache.size", true, func(c *config) *int { return &c.CacheSize }),
+	{
+		key: "cache.snapshot",
+		set: func(c *config, v string) error { c.Snapshot = v; return nil },
+		get: func(c *config) string { return c.Snapshot },
+	},
+	{
+		key: "metrics.duration_buckets",
+		set: func(c *config, v string) (err error) { c.DurationBuckets, err = parseFloats(v); return },
+		get: func(c *config) string { return formatFloats(c.DurationBuckets) },
+	},
+	{
+		key: "metrics.go_runtime",
+		set: func(c *config, v string) error { c.GoRuntime = splitList(v); return nil },
+		get: func(c *config) string { return strings.Join(c.GoRuntime, ",") },
+	},
+	{
+		key: "metrics.backend",
+		set: func(c *config, v string) error { c.MetricsBackend = v; return nil },
+		get: func(c *config) string { return c.MetricsBackend },
+	},
+	{
+		key: "metrics.statsd_addr",
+		set: func(c *config, v string) error { c.StatsDAddr = v; return nil },
+		get: func(c *config) string { return c.StatsDAddr },
+	},
+	{
+		key: "metrics.influx_url",
+		set: func(c *config, v string) error { c.InfluxURL = v; return nil },
+		get: func(c *config) string { return c.InfluxURL },
+	},
+	{
+		key: "metrics.influx_token",
+		set: func(c *config, v string) error { c.InfluxToken = v; return nil },
+		get: func(c *config) string { return c.InfluxToken },
+	},
+	durationOption("metrics.influx_interval", false, func(c *config) *time.Duration { return &c.InfluxInterval }),
+	intOption("metrics.max_series", false, func(c *config) *int { return &c.MaxSeries }),
+	{
+		key: "metrics.series_limits",
+		set: func(c *config, v string) (err error) { c.SeriesLimits, err = parseSeriesLimits(v); return },
+		get: func(c *config) string { return formatSeriesLimits(c.SeriesLimits) },
+	},
+	durationOption("health.timeout", false, func(c *config) *time.Duration { return &c.HealthTimeout }),
+	durationOption("health.interval", false, func(c *config) *time.Duration { return &c.HealthInterval }),
+	{
+		key: "health.peers",
+		set: func(c *config, v string) error { c.Peers = splitList(v); return nil },
+		get: func(c *config) string { return strings.Join(c.Peers, ",") },
+	},
+	{
+		key: "health.origin",
+		set: func(c *config, v string) error { c.Origin = v; return nil },
+		get: func(c *config) string { return c.Origin },
+	},
+	{
+		key:  "ratelimit.routes",
+		live: true,
+		set:  func(c *config, v string) (err error) { c.RouteLimits, err = parseLimits(v); return },
+		get:  func(c *config) string { return formatLimits(c.RouteLimits) },
+	},
+	{
+		key:  "ratelimit.namespaces",
+		live: true,
+		set:  func(c *config, v string) (err error) { c.NamespaceLimits, err = parseLimits(v); return },
+		get:  func(c *config) string { return formatLimits(c.NamespaceLimits) },
+	},
+	{
+		key:  "ratelimit.clients",
+		live: true,
+		set:  func(c *config, v string) (err error) { c.ClientClasses, err = parseMap(v); return },
+		get:  func(c *config) string { return formatMap(c.ClientClasses) },
+	},
+	{
+		key:  "auth.tokens",
+		live: true,
+		set:  func(c *config, v string) (err error) { c.AuthTokens, err = parseCredentials(v); return },
+		get:  func(c *config) string { return formatCredentials(c.AuthTokens) },
+	},
+	{
+		key:  "auth.hmac_keys",
+		live: true,
+		set:  func(c *config, v string) (err error) { c.AuthHMACKeys, err = parseCredentials(v); return },
+		get:  func(c *config) string { return formatCredentials(c.AuthHMACKeys) },
+	},
+	{
+		key:  "auth.metrics_token",
+		live: true,
+		set:  func(c *config, v string) error { c.MetricsToken = v; return nil },
+		get:  func(c *config) string { return c.MetricsToken },
+	},
+	// Certificates are reloaded when their files change, not their paths.
+	{
+		key: "tls.cert",
+		set: func(c *config, v string) error { c.TLSCert = v; return nil },
+		get: func(c *config) string { return c.TLSCert },
+	},
+	{
+		key: "tls.key",
+		set: func(c *config, v string) error { c.TLSKey = v; return nil },
+		get: func(c *config) string { return c.TLSKey },
+	},
+	{
+		key: "tls.client_ca",
+		set: func(c *config, v string) error { c.TLSClientCA = v; return nil },
+		get: func(c *config) string { return c.TLSClientCA },
+	},
+	{
+		key:  "log.level",
+		live: true,
+		set:  func(c *config, v string) (err error) { c.LogLevel, err = parseLevel(v); return },
+		get:  func(c *config) string { return c.LogLevel.String() },
+	},
+	{
+		key:  "log.access_sample_rate",
+		live: true,
+		set:  func(c *config, v string) (err error) { c.AccessSampleRate, err = strconv.ParseFloat(v, 64); return },
+		get:  func(c *config) string { return strconv.FormatFloat(c.AccessSampleRate, 'g', -1, 64) },
+	},
+	{
+		key: "tracing.exporter",
+		set: func(c *config, v string) error { c.TracingExporter = v; return nil },
+		get: func(c *config) string { return c.TracingExporter },
+	},
+	{
+		key: "tracing.file",
+		set: func(c *config, v string) error { c.TracingFile = v; return nil },
+		get: func(c *config) string { return c.TracingFile },
+	},
+	{
+		key: "tracing.otlp_endpoint",
+		set: func(c *config, v string) error { c.TracingEndpoint = v; return nil },
+		get: func(c *config) string { return c.TracingEndpoint },
+	},
+	{
+		key: "tracing.sample_rate",
+		set: func(c *config, v string) (err error) { c.TracingSampleRate, err = strconv.ParseFloat(v, 64); return },
+		get: func(c *config) string { return strconv.FormatFloat(c.TracingSampleRate, 'g', -1, 64) },
+	},
+	{
+		key: "debug.flight_recorder",
+		set: func(c *config, v string) (err error) { c.FlightRecorder, err = strconv.ParseBool(v); return },
+		get: func(c *config) string { return strconv.FormatBool(c.FlightRecorder) },
+	},
+	durationOption("debug.flight_recorder_window", false, func(c *config) *time.Duration { return &c.FlightRecorderWindow }),
+	intOption("debug.flight_recorder_max_bytes", false, func(c *config) *int { return &c.FlightRecorderMaxBytes }),
+	durationOption("debug.latency_threshold", false, func(c *config) *time.Duration { return &c.FlightRecorderThreshold }),
+	{
+		key: "debug.dump_dir",
+		set: func(c *config, v string) error { c.FlightRecorderDir = v; return nil },
+		get: func(c *config) string { return c.FlightRecorderDir },
+	},
+	durationOption("profiling.interval", false, func(c *config) *time.Duration { return &c.ProfilingInterval }),
+	{
+		key: "profiling.dir",
+		set: func(c *config, v string) error { c.ProfilingDir = v; return nil },
+		get: func(c *config) string { return c.ProfilingDir },
+	},
+	intOption("profiling.max_bytes", false, func(c *config) *int { return &c.ProfilingMaxBytes }),
+	durationOption("profiling.cpu_duration", false, func(c *config) *time.Duration { return &c.ProfilingCPUDuration }),
+	intOption("profiling.mutex_fraction", true, func(c *config) *int { return &c.MutexProfileFraction }),
+	durationOption("tsdb.scrape_interval", false, func(c *config) *time.Duration { return &c.TSDBInterval }),
+	durationOption("tsdb.retention", false, func(c *config) *time.Duration { return &c.TSDBRetention }),
+	{
+		key: "alerting.receivers",
+		set: func(c *config, v string) error { c.AlertReceivers = splitList(v); return nil },
+		get: func(c *config) string { return strings.Join(c.AlertReceivers, ",") },
+	},
+	durationOption("alerting.interval", false, func(c *config) *time.Duration { return &c.AlertInterval }),
+	durationOption("alerting.repeat_interval", false, func(c *config) *time.Duration { return &c.AlertRepeatInterval }),
+	floatOption("alerting.hit_ratio_min", false, func(c *config) *float64 { return &c.AlertHitRatioMin }),
+	durationOption("alerting.hit_ratio_for", false, func(c *config) *time.Duration { return &c.AlertHitRatioFor }),
+	durationOption("alerting.latency_p99_max", false, func(c *config) *time.Duration { return &c.AlertLatencyMax }),
+	durationOption("alerting.latency_for", false, func(c *config) *time.Duration { return &c.AlertLatencyFor }),
+	floatOption("alerting.eviction_rate_max", false, func(c *config) *float64 { return &c.AlertEvictionMax }),
+	durationOption("alerting.eviction_rate_for", false, func(c *config) *time.Duration { return &c.AlertEvictionFor }),
+	{
+		key: "slo.objectives",
+		set: func(c *config, v string) (err error) { c.Objectives, err = parseObjectives(v); return },
+		get: func(c *config) string { return formatObjectives(c.Objectives) },
+	},
+	durationOption("slo.window", false, func(c *config) *time.Duration { return &c.SLOWindow }),
+}
+
+func intOption(key string, live bool, field func(*config) *int) option {
+	return option{
+		key:  key,
+		live: live,
+		set:  func(c *config, v string) (err error) { *field(c), err = strconv.Atoi(v); return },
+		get:  func(c *config) string { return strconv.Itoa(*field(c)) },
+	}
+}
+
+func floatOption(key string, live bool, field func(*config) *float64) option {
+	return option{
+		key:  key,
+		live: live,
+		set:  func(c *config, v string) (err error) { *field(c), err = strconv.ParseFloat(v, 64); return },
+		get:  func(c *config) string { return strconv.FormatFloat(*field(c), 'g', -1, 64) },
+	}
+}
+
+func durationOption(key string, live bool, field func(*config) *time.Duration) option {
+	return option{
+		key:  key,
+		live: live,
+		set:  func(c *config, v string) (err error) { *field(c), err = time.ParseDuration(v); return },
+		get:  func(c *config) string { return field(c).String() },
+	}
+}
+
+func lookupOption(key string) *option {
+	for i := range options {
+		if options[i].key == key {
+			return &options[i]
+		}
+	}
+	return nil
+}
+
+// parseFloats parses a list of comma-separated floats.
+func parseFloats(v string) ([]float64, error) {
+	var fs []float64
+	for _, s := range splitList(v) {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+func formatFloats(fs []float64) string {
+	ss := make([]string, len(fs))
+	for i, f := range fs {
+		ss[i] = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strings.Join(ss, ",")
+}
+
+// splitList splits a list of comma-separated values, as returned by
+// parseConfig for arrays, ignoring empty elements.
+func splitList(v string) []string {
+	var l []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+// parseMap parses a list of comma-separated 'key=value'.
+func parseMap(v string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, s := range splitList(v) {
+		i := strings.Index(s, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid %q, want 'key=value'", s)
+		}
+		m[s[:i]] = s[i+1:]
+	}
+	return m, nil
+}
+
+// formatMap formats m as a list of 'key=value', sorted by key.
+func formatMap(m map[string]string) string {
+	l := make([]string, 0, len(m))
+	for k, v := range m {
+		l = append(l, k+"="+v)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+// parseSeriesLimits parses a list of comma-separated 'metric=max'.
+func parseSeriesLimits(v string) (map[string]int, error) {
+	m, err := parseMap(v)
+	if err != nil {
+		return nil, err
+	}
+	limits := make(map[string]int, len(m))
+	for name, max := range m {
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid series limit %q of %s", max, name)
+		}
+		limits[name] = n
+	}
+	return limits, nil
+}
+
+func formatSeriesLimits(limits map[string]int) string {
+	m := make(map[string]string, len(limits))
+	for name, n := range limits {
+		m[name] = strconv.Itoa(n)
+	}
+	return formatMap(m)
+}
+
+// validate checks that the configuration is usable.
+func (c *config) validate() error {
+	if c.Addr == "" {
+		return fmt.Errorf("server.addr: empty listen address")
+	}
+	for _, d := range []struct {
+		key string
+		val time.Duration
+	}{
+		{"server.read_timeout", c.ReadTimeout},
+		{"server.write_timeout", c.WriteTimeout},
+		{"server.idle_timeout", c.IdleTimeout},
+		{"server.shutdown_timeout", c.ShutdownTimeout},
+		{"health.timeout", c.HealthTimeout},
+	} {
+		if d.val < 0 {
+			return fmt.Errorf("%s: must not be negative, got %v", d.key, d.val)
+		}
+	}
+	if c.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("server.max_header_bytes: must be positive, got %d", c.MaxHeaderBytes)
+	}
+	if c.CacheSize <= 0 {
+		return fmt.Errorf("cache.size: must be positive, got %d", c.CacheSize)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls: cert and key must be both set")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		return fmt.Errorf("tls.client_ca: requires tls.cert and tls.key")
+	}
+	if c.AccessSampleRate < 0 || c.AccessSampleRate > 1 {
+		return fmt.Errorf("log.access_sample_rate: must be between 0 and 1, got %v", c.AccessSampleRate)
+	}
+	switch c.TracingExporter {
+	case "none", "otlp":
+	case "file":
+		if c.TracingFile == "" {
+			return fmt.Errorf("tracing.file: required with the file exporter")
+		}
+	default:
+		return fmt.Errorf("tracing.exporter: must be none, file or otlp, got %q", c.TracingExporter)
+	}
+	if c.TracingSampleRate < 0 || c.TracingSampleRate > 1 {
+		return fmt.Errorf("tracing.sample_rate: must be between 0 and 1, got %v", c.TracingSampleRate)
+	}
+	if c.FlightRecorder && (c.FlightRecorderWindow <= 0 || c.FlightRecorderMaxBytes <= 0 || c.FlightRecorderThreshold <= 0) {
+		return fmt.Errorf("debug: flight recorder window, max bytes and latency threshold must be positive")
+	}
+	if c.ProfilingInterval < 0 {
+		return fmt.Errorf("profiling.interval: must not be negative, got %v", c.ProfilingInterval)
+	}
+	if c.ProfilingInterval > 0 {
+		if c.ProfilingCPUDuration <= 0 || c.ProfilingCPUDuration >= c.ProfilingInterval {
+			return fmt.Errorf("profiling.cpu_duration: must be positive and shorter than profiling.interval")
+		}
+		if c.ProfilingMaxBytes <= 0 {
+			return fmt.Errorf("profiling.max_bytes: must be positive, got %d", c.ProfilingMaxBytes)
+		}
+	}
+	if c.MutexProfileFraction < 0 {
+		return fmt.Errorf("profiling.mutex_fraction: must not be negative, got %d", c.MutexProfileFraction)
+	}
+	if c.TSDBInterval < 0 {
+		return fmt.Errorf("tsdb.scrape_interval: must not be negative, got %v", c.TSDBInterval)
+	}
+	if c.TSDBInterval > 0 && c.TSDBRetention <= c.TSDBInterval {
+		return fmt.Errorf("tsdb.retention: must be longer than tsdb.scrape_interval")
+	}
+	if c.AlertHitRatioMin < 0 || c.AlertHitRatioMin > 1 {
+		return fmt.Errorf("alerting.hit_ratio_min: must be between 0 and 1, got %v", c.AlertHitRatioMin)
+	}
+	if c.AlertLatencyMax < 0 || c.AlertEvictionMax < 0 {
+		return fmt.Errorf("alerting: thresholds must not be negative")
+	}
+	if c.alerting() {
+		if c.TSDBInterval == 0 {
+			return fmt.Errorf("alerting: rules require the embedded TSDB, set tsdb.scrape_interval")
+		}
+		if (c.AlertHitRatioMin > 0 || c.AlertEvictionMax > 0) && c.MetricsBackend != "prometheus" {
+			return fmt.Errorf("alerting: hit ratio and eviction rate rules require the prometheus metrics backend")
+		}
+		if c.AlertInterval <= 0 || c.AlertRepeatInterval <= 0 {
+			return fmt.Errorf("alerting: interval and repeat_interval must be positive")
+		}
+	}
+	if c.SLOWindow < time.Hour {
+		return fmt.Errorf("slo.window: must be at least 1h, got %v", c.SLOWindow)
+	}
+	names := make(map[string]bool)
+	for _, o := range c.Objectives {
+		if names[o.name] {
+			return fmt.Errorf("slo.objectives: duplicate objective %q", o.name)
+		}
+		names[o.name] = true
+	}
+	for _, g := range c.GoRuntime {
+		if g != "gc" && g != "sched" && g != "memory" {
+			return fmt.Errorf("metrics.go_runtime: unknown group %q, want gc, sched or memory", g)
+		}
+	}
+	if c.MaxSeries < 0 {
+		return fmt.Errorf("metrics.max_series: must not be negative, got %d", c.MaxSeries)
+	}
+	switch c.MetricsBackend {
+	case "prometheus":
+	case "statsd", "dogstatsd":
+		if c.StatsDAddr == "" {
+			return fmt.Errorf("metrics.statsd_addr: required with the %s backend", c.MetricsBackend)
+		}
+	case "influx":
+		if c.InfluxURL == "" {
+			return fmt.Errorf("metrics.influx_url: required with the influx backend")
+		}
+		if c.InfluxInterval <= 0 {
+			return fmt.Errorf("metrics.influx_interval: must be positive, got %v", c.InfluxInterval)
+		}
+	default:
+		return fmt.Errorf("metrics.backend: must be prometheus, statsd, dogstatsd or influx, got %q", c.MetricsBackend)
+	}
+	if c.HealthInterval <= 0 {
+		return fmt.Errorf("health.interval: must be positive, got %v", c.HealthInterval)
+	}
+	for i := 1; i < len(c.DurationBuckets); i++ {
+		if c.DurationBuckets[i] <= c.DurationBuckets[i-1] {
+			return fmt.Errorf("metrics.duration_buckets: must be in increasing order")
+		}
+	}
+	return nil
+}
+
+// durationBuckets returns the buckets of the requests duration histogram,
+// including the thresholds of the latency objectives so that their SLIs are
+// exact.
+func (c *config) durationBuckets() []float64 {
+	buckets := append([]float64(nil), c.DurationBuckets...)
+	for _, o := range c.Objectives {
+		if o.kind != "latency" {
+			continue
+		}
+		b := o.threshold.Seconds()
+		i := sort.SearchFloat64s(buckets, b)
+		if i == len(buckets) || buckets[i] != b {
+			buckets = append(buckets[:i], append([]float64{b}, buckets[i:]...)...)
+		}
+	}
+	return buckets
+}
+
+// alerting reports whether an alerting rule is enabled.
+func (c *config) alerting() bool {
+	return c.AlertHitRatioMin > 0 || c.AlertLatencyMax > 0 || c.AlertEvictionMax > 0
+}
+
+// runtimeMetrics returns the Go runtime metrics to export.
+func (c *config) runtimeMetrics() instrument.RuntimeOpts {
+	var opts instrument.RuntimeOpts
+	for _, g := range c.GoRuntime {
+		switch g {
+		case "gc":
+			opts.GC = true
+		case "sched":
+			opts.Sched = true
+		case "memory":
+			opts.Memory = true
+		}
+	}
+	return opts
+}
+
+// loadConfig builds the configuration from the file at path, if not empty,
+// then applies environment variables overrides and finally flags, a map of
+// option keys to values.
+func loadConfig(path string, flags map[string]string) (*config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		kv, err := parseConfig(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := cfg.apply(kv); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	env := make(map[string]string)
+	for _, o := range options {
+		if v, ok := os.LookupEnv(o.env()); ok {
+			env[o.key] = v
+		}
+	}
+	if err := cfg.apply(env); err != nil {
+		return nil, fmt.Errorf("environment: %v", err)
+	}
+	if err := cfg.apply(flags); err != nil {
+		return nil, fmt.Errorf("flags: %v", err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// apply sets the options from a map of keys to values.
+func (c *config) apply(kv map[string]string) error {
+	for k, v := range kv {
+		o := lookupOption(k)
+		if o == nil {
+			return fmt.Errorf("unknown option %q", k)
+		}
+		if err := o.set(c, v); err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// merge returns the configuration to apply at runtime when reloading from c
+// to next. Settings that can't be changed live are kept to their current
+// value, their keys are returned in restart.
+func (c *config) merge(next *config) (merged *config, restart []string) {
+	m := *next
+	for _, o := range options {
+		if o.live || o.get(c) == o.get(next) {
+			continue
+		}
+		o.set(&m, o.get(c))
+		restart = append(restart, o.key)
+	}
+	return &m, restart
+}
+
+// parseConfig parses a configuration file, written in a subset of TOML.
+//
+// Supported are [tables], 'key = value' pairs, # comments, and basic strings,
+// integers, floats, booleans and arrays of those as values. Each key is
+// returned prefixed by its table name. Array elements are joined by a comma,
+// so they can't contain one.
+func parseConfig(r io.Reader) (map[string]string, error) {
+	kv := make(map[string]string)
+	table := ""
+
+	scan := bufio.NewScanner(r)
+	for lineno := 1; scan.Scan(); lineno++ {
+		line := strings.TrimSpace(stripComment(scan.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return nil, fmt.Errorf("%d: malformed table header %q", lineno, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("%d: expected 'key = value', got %q", lineno, line)
+		}
+		key := strings.TrimSpace(line[:i])
+		if key == "" {
+			return nil, fmt.Errorf("%d: missing key", lineno)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, dup := kv[key]; dup {
+			return nil, fmt.Errorf("%d: duplicate key %q", lineno, key)
+		}
+
+		val, err := parseValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s: %v", lineno, key, err)
+		}
+		kv[key] = val
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+func parseValue(s string) (string, error) {
+	switch {
+	case s == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return "", fmt.Errorf("unterminated array")
+		}
+		var elems []string
+		for _, e := range strings.Split(s[1:len(s)-1], ",") {
+			e = strings.TrimSpace(e)
+			if e == "" {
+				continue // allow trailing comma
+			}
+			v, err := parseValue(e)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, v)
+		}
+		return strings.Join(elems, ","), nil
+	case s == "true" || s == "false":
+		return s, nil
+	}
+	if _, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64); err != nil {
+		return "", fmt.Errorf("invalid value %q", s)
+	}
+	return strings.Replace(s, "_", "", -1), nil
+}
+
+// stripComment removes the trailing comment of a line, if any, taking care
+// of # characters inside strings.
+func stripComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inString {
+				i++
+			}
+		case '"':
+			inString = !inString
+		case '#':
+			if !inString {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	const in = `
+# comment
+top = 1
+
+[server]
+addr = ":9090" # trailing comment
+name = "a # b"
+
+[cache]
+size = 1_024
+ratio = 0.5
+enabled = true
+peers = ["a:1", "b:2",]
+`
+	got, err := parseConfig(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"top":           "1",
+		"server.addr":   ":9090",
+		"server.name":   "a # b",
+		"cache.size":    "1024",
+		"cache.ratio":   "0.5",
+		"cache.enabled": "true",
+		"cache.peers":   "a:1,b:2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseConfig() = %v, want %v", got, want)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []string{
+		"[server",
+		"addr",
+		" = 1",
+		"addr = ",
+		"addr = :8080",
+		"a = 1\na = 2",
+		`addr = "unterminated`,
+		"peers = [1, 2",
+	}
+	for _, tt := range tests {
+		if _, err := parseConfig(strings.NewReader(tt)); err == nil {
+			t.Errorf("parseConfig(%q) should fail", tt)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cache.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "[server]\naddr = \":1\"\n[cache]\nsize = 10\n")
+
+	cfg, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":1" || cfg.CacheSize != 10 {
+		t.Errorf("file: got %+v", cfg)
+	}
+
+	os.Setenv("CACHE_CACHE_SIZE", "20")
+	defer os.Unsetenv("CACHE_CACHE_SIZE")
+
+	cfg, err = loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CacheSize != 20 {
+		t.Errorf("env: got cache size %d, want 20", cfg.CacheSize)
+	}
+
+	cfg, err = loadConfig(path, map[string]string{"cache.size": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CacheSize != 30 {
+		t.Errorf("flags: got cache size %d, want 30", cfg.CacheSize)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []string{
+		"[cache]\nsize = 0\n",
+		"[cache]\nsize = \"big\"\n",
+		"[cache]\nunknown = 1\n",
+		"[metrics]\ngo_runtime = [\"gc\", \"heap\"]\n",
+		"[tracing]\nexporter = \"jaeger\"\n",
+		"[tracing]\nexporter = \"file\"\n",
+		"[metrics]\nbackend = \"graphite\"\n",
+		"[metrics]\nbackend = \"statsd\"\nstatsd_addr = \"\"\n",
+		"[alerting]\nhit_ratio_min = 0.8\n",
+		"[alerting]\nhit_ratio_min = 2\n[tsdb]\nscrape_interval = \"5s\"\n",
+		"[slo]\nobjectives = [\"a=/get:availability:99\", \"a=/add:availability:99\"]\n",
+		"[slo]\nwindow = \"5m\"\n",
+		"[metrics]\nmax_series = -1\n",
+		"[metrics]\nseries_limits = [\"auth_failures_total=many\"]\n",
+	}
+	for _, tt := range tests {
+		if _, err := loadConfig(writeConfig(t, tt), nil); err == nil {
+			t.Errorf("loadConfig(%q) should fail", tt)
+		}
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CacheSize = 4
+	s := newTestServer(cfg)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		s.cache.Add(k, k)
+	}
+
+	next := &config{Addr: ":1234", CacheSize: 2}
+	if err := s.reload(func() (*config, error) { return next, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.cfg.Addr != cfg.Addr {
+		t.Errorf("addr = %q, should not change without restart", s.cfg.Addr)
+	}
+	if s.cfg.CacheSize != 2 {
+		t.Errorf("cache size = %d, want 2", s.cfg.CacheSize)
+	}
+	if _, ok := s.cache.Get("b"); ok {
+		t.Errorf(`"b" should have been evicted after resize`)
+	}
+	if _, ok := s.cache.Get("d"); !ok {
+		t.Errorf(`"d" should still be cached after resize`)
+	}
+}
@@ -0,0 +1,624 @@
+package main
+
+//go:generate go run . -generate .
+//go:generate go run . -slo-rules prometheus/slo.rules.yml
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/arl/golab-2019/instrument"
+	"github.com/arl/golab-2019/metrics"
+)
+
+// A metricDesc describes a registered metric.
+type metricDesc struct {
+	name   string
+	help   string
+	typ    dto.MetricType
+	labels []string // variable labels
+}
+
+// describer is a prometheus.Registerer recording the description of the
+// metrics of the collectors registered with it.
+type describer struct {
+	metrics map[string]metricDesc
+}
+
+func (d *describer) Register(c prometheus.Collector) error {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		m, err := parseDesc(desc)
+		if err != nil {
+			return err
+		}
+		if _, dup := d.metrics[m.name]; dup {
+			return fmt.Errorf("duplicate metric %s", m.name)
+		}
+		m.typ = collectorType(c)
+		d.metrics[m.name] = m
+	}
+
+	// The type of the metrics of custom collectors is only known once
+	// collected, vectors only collect their existing children though.
+	ms := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ms)
+		close(ms)
+	}()
+	for metric := range ms {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			return err
+		}
+		name, _, err := descName(metric.Desc())
+		if err != nil {
+			return err
+		}
+		m := d.metrics[name]
+		switch {
+		case pb.Counter != nil:
+			m.typ = dto.MetricType_COUNTER
+		case pb.Gauge != nil:
+			m.typ = dto.MetricType_GAUGE
+		case pb.Histogram != nil:
+			m.typ = dto.MetricType_HISTOGRAM
+		case pb.Summary != nil:
+			m.typ = dto.MetricType_SUMMARY
+		}
+		d.metrics[name] = m
+	}
+	return nil
+}
+
+func (d *describer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := d.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (d *describer) Unregister(prometheus.Collector) bool { return false }
+
+// collectorType returns the type of the metrics of the standard and guarded
+// collectors, UNTYPED for the others.
+func collectorType(c prometheus.Collector) dto.MetricType {
+	switch c.(type) {
+	case *metrics.GuardedCounterVec:
+		return dto.MetricType_COUNTER
+	case *metrics.GuardedGaugeVec:
+		return dto.MetricType_GAUGE
+	case *metrics.GuardedHistogramVec:
+		return dto.MetricType_HISTOGRAM
+	case *prometheus.CounterVec:
+		return dto.MetricType_COUNTER
+	case *prometheus.GaugeVec, prometheus.Gauge: // a Gauge is also a Counter
+		return dto.MetricType_GAUGE
+	case prometheus.Counter:
+		return dto.MetricType_COUNTER
+	case *prometheus.HistogramVec, prometheus.Histogram:
+		return dto.MetricType_HISTOGRAM
+	case *prometheus.SummaryVec, prometheus.Summary:
+		return dto.MetricType_SUMMARY
+	}
+	return dto.MetricType_UNTYPED
+}
+
+// parseDesc extracts the name, help and variable labels of a metric from the
+// string representation of its descriptor, which doesn't export them.
+func parseDesc(desc *prometheus.Desc) (metricDesc, error) {
+	name, rest, err := descName(desc)
+	if err != nil {
+		return metricDesc{}, err
+	}
+	const helpPrefix = ", help: "
+	if !strings.HasPrefix(rest, helpPrefix) {
+		return metricDesc{}, fmt.Errorf("malformed descriptor %s", desc)
+	}
+	quoted, err := strconv.QuotedPrefix(rest[len(helpPrefix):])
+	if err != nil {
+		return metricDesc{}, fmt.Errorf("malformed descriptor %s", desc)
+	}
+	help, _ := strconv.Unquote(quoted)
+
+	const labelsPrefix = "variableLabels: ["
+	i := strings.LastIndex(rest, labelsPrefix)
+	if i == -1 || !strings.HasSuffix(rest, "]}") {
+		return metricDesc{}, fmt.Errorf("malformed descriptor %s", desc)
+	}
+	labels := strings.Fields(rest[i+len(labelsPrefix) : len(rest)-2])
+	return metricDesc{name: name, help: help, labels: labels}, nil
+}
+
+// descName returns the metric name of desc, and the rest of its string
+// representation.
+func descName(desc *prometheus.Desc) (name, rest string, err error) {
+	const prefix = "Desc{fqName: "
+	s := desc.String()
+	if !strings.HasPrefix(s, prefix) {
+		return "", "", fmt.Errorf("malformed descriptor %s", s)
+	}
+	quoted, err := strconv.QuotedPrefix(s[len(prefix):])
+	if err != nil {
+		return "", "", fmt.Errorf("malformed descriptor %s", s)
+	}
+	name, _ = strconv.Unquote(quoted)
+	return name, s[len(prefix)+len(quoted):], nil
+}
+
+// describeMetrics returns the description of the metrics of a server
+// configured with cfg, registered as by newServer.
+func describeMetrics(cfg *config) (map[string]metricDesc, error) {
+	d := &describer{metrics: make(map[string]metricDesc)}
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		registerMetrics(d, cfg)
+		instrument.New(d, instrument.Opts{DurationBuckets: cfg.durationBuckets()})
+		p := metrics.NewPrometheus(d)
+		p.Guard = metrics.NewCardinalityGuard(d, cfg.MaxSeries, cfg.SeriesLimits)
+		initMetrics(p)
+	}()
+	return d.metrics, err
+}
+
+// A panelSpec describes a dashboard panel showing one or more metrics.
+type panelSpec struct {
+	title   string
+	unit    string   // Grafana unit, derived from the metric names if empty
+	metrics []string // names, or name prefixes followed by '*'
+}
+
+// A rowSpec describes a dashboard row.
+type rowSpec struct {
+	title  string
+	rules  bool // record the rates and quantiles of its metrics
+	panels []panelSpec
+}
+
+// dashboardRows are the rows of the generated dashboard. Panels are built
+// from the type and labels of the metrics.
+var dashboardRows = []rowSpec{
+	{
+		title: "Cache",
+		rules: true,
+		panels: []panelSpec{
+			{title: "Hits and misses", metrics: []string{"cache_hits_total", "cache_misses_total"}},
+			{title: "Evictions", metrics: []string{"cache_evictions_total"}},
+		},
+	},
+	{
+		title: "Requests",
+		rules: true,
+		panels: []panelSpec{
+			{title: "Requests", unit: "reqps", metrics: []string{"http_requests_total"}},
+			{title: "Latency", metrics: []string{"http_request_duration_seconds"}},
+			{title: "In flight", metrics: []string{"http_requests_in_flight"}},
+			{title: "Rate limited", unit: "reqps", metrics: []string{"ratelimit_requests_total"}},
+			{title: "Request size", metrics: []string{"http_request_size_bytes"}},
+			{title: "Response size", metrics: []string{"http_response_size_bytes"}},
+			{title: "Authentication failures", unit: "reqps", metrics: []string{"auth_failures_total"}},
+		},
+	},
+	{
+		title: "Service level objectives",
+		panels: []panelSpec{
+			{title: "Error budget remaining", unit: "percentunit", metrics: []string{"slo_error_budget_remaining"}},
+			{title: "Burn rate", metrics: []string{"slo_burn_rate"}},
+		},
+	},
+	{
+		title: "Server",
+		panels: []panelSpec{
+			{title: "Health checks", metrics: []string{"health_check_status"}},
+			{title: "Log lines", metrics: []string{"log_lines_total"}},
+			{title: "Configuration reload failures", metrics: []string{"config_reload_failures_total"}},
+			{title: "Alert notifications", metrics: []string{"alert_notifications_total"}},
+			{title: "Series dropped", metrics: []string{"metric_series_dropped_total"}},
+		},
+	},
+	{
+		title: "Runtime",
+		panels: []panelSpec{
+			{title: "Build", metrics: []string{"build_info"}},
+			{title: "GC pauses", metrics: []string{"go_gc_pauses_seconds"}},
+			{title: "Scheduler latency", metrics: []string{"go_sched_latencies_seconds"}},
+			{title: "Goroutines", metrics: []string{"go_sched_goroutines"}},
+			{title: "Memory classes", unit: "bytes", metrics: []string{"go_memory_classes_*"}},
+			{title: "CPU", unit: "percentunit", metrics: []string{"process_cpu_seconds_total"}},
+			{title: "Resident memory", metrics: []string{"process_resident_memory_bytes"}},
+		},
+	},
+}
+
+// rateRange is the range of the rates and quantiles computed by the
+// dashboard panels.
+const rateRange = "1m"
+
+// Grafana dashboard model, limited to what's generated.
+type (
+	dashboard struct {
+		UID           string      `json:"uid"`
+		Title         string      `json:"title"`
+		Tags          []string    `json:"tags"`
+		Timezone      string      `json:"timezone"`
+		SchemaVersion int         `json:"schemaVersion"`
+		Version       int         `json:"version"`
+		Refresh       string      `json:"refresh"`
+		Time          timeRange   `json:"time"`
+		Annotations   annotations `json:"annotations"`
+		Panels        []panel     `json:"panels"`
+	}
+	timeRange struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	annotations struct {
+		List []annotation `json:"list"`
+	}
+	annotation struct {
+		Name            string `json:"name"`
+		Datasource      string `json:"datasource"`
+		Enable          bool   `json:"enable"`
+		IconColor       string `json:"iconColor"`
+		Expr            string `json:"expr"`
+		Step            string `json:"step"`
+		TitleFormat     string `json:"titleFormat"`
+		TagKeys         string `json:"tagKeys"`
+		TextFormat      string `json:"textFormat"`
+		UseValueForTime bool   `json:"useValueForTime"`
+	}
+	panel struct {
+		ID          int          `json:"id"`
+		Type        string       `json:"type"`
+		Title       string       `json:"title"`
+		Description string       `json:"description,omitempty"`
+		Datasource  string       `json:"datasource,omitempty"`
+		Collapsed   *bool        `json:"collapsed,omitempty"`
+		GridPos     gridPos      `json:"gridPos"`
+		FieldConfig *fieldConfig `json:"fieldConfig,omitempty"`
+		Targets     []target     `json:"targets,omitempty"`
+	}
+	gridPos struct {
+		H int `json:"h"`
+		W int `json:"w"`
+		X int `json:"x"`
+		Y int `json:"y"`
+	}
+	fieldConfig struct {
+		Defaults  fieldDefaults `json:"defaults"`
+		Overrides []struct{}    `json:"overrides"`
+	}
+	fieldDefaults struct {
+		Unit string `json:"unit"`
+	}
+	target struct {
+		RefID        string `json:"refId"`
+		Expr         string `json:"expr"`
+		LegendFormat string `json:"legendFormat"`
+	}
+)
+
+// buildDashboard builds the dashboard of the rows, from the description of
+// the metrics.
+func buildDashboard(descs map[string]metricDesc, rows []rowSpec) (*dashboard, error) {
+	db := &dashboard{
+		UID:           "cache",
+		Title:         "Cache",
+		Tags:          []string{"cache"},
+		Timezone:      "browser",
+		SchemaVersion: 36,
+		Version:       1,
+		Refresh:       "10s",
+		Time:          timeRange{From: "now-1h", To: "now"},
+		Annotations: annotations{List: []annotation{{
+			Name:        "Deploys",
+			Datasource:  "prom",
+			Enable:      true,
+			IconColor:   "rgba(255, 96, 96, 1)",
+			Expr:        "build_info and on () (changes(process_start_time_seconds[1m]) > 0)",
+			Step:        "30s",
+			TitleFormat: "Deploy",
+			TagKeys:     "version,revision",
+			TextFormat:  "{{version}} ({{revision}})",
+		}}},
+	}
+
+	const w, h = 12, 8
+	y := 0
+	for _, row := range rows {
+		collapsed := false
+		db.Panels = append(db.Panels, panel{
+			ID:        len(db.Panels) + 1,
+			Type:      "row",
+			Title:     row.title,
+			Collapsed: &collapsed,
+			GridPos:   gridPos{H: 1, W: 24, Y: y},
+		})
+		y++
+		for i, spec := range row.panels {
+			ms, err := lookupMetrics(descs, spec.metrics)
+			if err != nil {
+				return nil, fmt.Errorf("panel %q: %v", spec.title, err)
+			}
+			p := panel{
+				ID:         len(db.Panels) + 1,
+				Type:       "timeseries",
+				Title:      spec.title,
+				Datasource: "prom",
+				GridPos:    gridPos{H: h, W: w, X: (i % 2) * w, Y: y + (i/2)*h},
+			}
+			unit := spec.unit
+			if len(ms) == 1 {
+				p.Description = ms[0].help
+			}
+			for _, m := range ms {
+				for _, t := range metricTargets(m, len(ms) > 1) {
+					t.RefID = string(rune('A' + len(p.Targets)))
+					p.Targets = append(p.Targets, t)
+				}
+				if unit == "" {
+					unit = metricUnit(m)
+				}
+			}
+			if strings.HasSuffix(spec.metrics[0], "*") {
+				// A single target selecting all the metrics.
+				prefix := strings.TrimSuffix(spec.metrics[0], "*")
+				p.Targets = []target{{
+					RefID:        "A",
+					Expr:         fmt.Sprintf("{__name__=~%q}", prefix+".+"),
+					LegendFormat: "{{__name__}}",
+				}}
+			}
+			p.FieldConfig = &fieldConfig{Defaults: fieldDefaults{Unit: unit}, Overrides: []struct{}{}}
+			db.Panels = append(db.Panels, p)
+		}
+		y += (len(row.panels) + 1) / 2 * h
+	}
+	return db, nil
+}
+
+// lookupMetrics returns the descriptions of the named metrics, in order. A
+// name ending with '*' matches all the metrics with that prefix, sorted by
+// name, of which there must be at least one.
+func lookupMetrics(descs map[string]metricDesc, names []string) ([]metricDesc, error) {
+	var ms []metricDesc
+	for _, name := range names {
+		if prefix := strings.TrimSuffix(name, "*"); prefix != name {
+			var matched []string
+			for n := range descs {
+				if strings.HasPrefix(n, prefix) {
+					matched = append(matched, n)
+				}
+			}
+			if len(matched) == 0 {
+				return nil, fmt.Errorf("no metric matches %s", name)
+			}
+			sort.Strings(matched)
+			for _, n := range matched {
+				ms = append(ms, descs[n])
+			}
+			continue
+		}
+		m, ok := descs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric %s", name)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// metricTargets returns the queries showing m, depending on its type: the
+// rate of counters, the p50 and p99 of histograms and the value of the
+// others. Series are distinguished by the metric labels, and by its name if
+// named is set.
+func metricTargets(m metricDesc, named bool) []target {
+	var legend []string
+	if named {
+		legend = append(legend, strings.TrimSuffix(m.name, "_total"))
+	}
+	for _, l := range m.labels {
+		legend = append(legend, "{{"+l+"}}")
+	}
+	by := ""
+	if len(m.labels) > 0 {
+		by = " by (" + strings.Join(m.labels, ", ") + ") "
+	}
+
+	switch m.typ {
+	case dto.MetricType_COUNTER:
+		return []target{{
+			Expr:         fmt.Sprintf("sum%s(rate(%s[%s]))", by, m.name, rateRange),
+			LegendFormat: strings.Join(legend, " "),
+		}}
+	case dto.MetricType_HISTOGRAM:
+		by := " by (" + strings.Join(append([]string{"le"}, m.labels...), ", ") + ") "
+		var ts []target
+		for _, q := range []float64{0.5, 0.99} {
+			ts = append(ts, target{
+				Expr:         fmt.Sprintf("histogram_quantile(%g, sum%s(rate(%s_bucket[%s])))", q, by, m.name, rateRange),
+				LegendFormat: strings.Join(append([]string{quantileName(q)}, legend...), " "),
+			})
+		}
+		return ts
+	}
+	return []target{{Expr: m.name, LegendFormat: strings.Join(legend, " ")}}
+}
+
+// quantileName returns the short name of quantile q, e.g. p99 for 0.99.
+func quantileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'g', -1, 64)
+}
+
+// metricUnit returns the Grafana unit of the values shown for m, derived
+// from its name.
+func metricUnit(m metricDesc) string {
+	name := m.name
+	if m.typ == dto.MetricType_COUNTER {
+		name = strings.TrimSuffix(name, "_total")
+		switch {
+		case strings.HasSuffix(name, "_bytes"):
+			return "Bps"
+		case strings.HasSuffix(name, "_seconds"):
+			return "percentunit"
+		}
+		return "ops"
+	}
+	switch {
+	case strings.HasSuffix(name, "_timestamp_seconds"):
+		return "dateTimeAsIso"
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case strings.HasSuffix(name, "_bytes"):
+		return "bytes"
+	case strings.HasSuffix(name, "_ratio"):
+		return "percentunit"
+	}
+	return "none"
+}
+
+// writeDashboard writes the dashboard as indented JSON.
+func writeDashboard(w io.Writer, db *dashboard) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(db)
+}
+
+// writeDashboardProvider writes the Grafana provisioning configuration
+// loading the dashboards of dir.
+func writeDashboardProvider(w io.Writer, dir string) error {
+	_, err := fmt.Fprintf(w, `# Generated by 'cache -generate', DO NOT EDIT.
+apiVersion: 1
+
+providers:
+- name: cache
+  orgId: 1
+  folder: ''
+  type: file
+  disableDeletion: false
+  options:
+    path: %s
+`, dir)
+	return err
+}
+
+// rulesRange is the range of the rates and quantiles recorded by the
+// Prometheus rules.
+const rulesRange = "5m"
+
+// writeRules writes the Prometheus recording rules of the rows with rules
+// set: the rate of their counters and the quantiles of their histograms,
+// aggregated by job and the metric labels.
+func writeRules(w io.Writer, descs map[string]metricDesc, rows []rowSpec) error {
+	bw := bufio.NewWriter(w)
+	p := func(format string, args ...interface{}) { fmt.Fprintf(bw, format+"\n", args...) }
+
+	p("# Generated by 'cache -generate', DO NOT EDIT.")
+	p("groups:")
+	for _, row := range rows {
+		if !row.rules {
+			continue
+		}
+		p("- name: %s", strings.ToLower(strings.Replace(row.title, " ", "_", -1)))
+		p("  rules:")
+		for _, spec := range row.panels {
+			ms, err := lookupMetrics(descs, spec.metrics)
+			if err != nil {
+				return fmt.Errorf("panel %q: %v", spec.title, err)
+			}
+			for _, m := range ms {
+				labels := append([]string{"job"}, m.labels...)
+				level := strings.Join(labels, "_")
+				switch m.typ {
+				case dto.MetricType_COUNTER:
+					p("  - record: %s:%s:rate%s", level, strings.TrimSuffix(m.name, "_total"), rulesRange)
+					p("    expr: sum by (%s) (rate(%s[%s]))", strings.Join(labels, ", "), m.name, rulesRange)
+				case dto.MetricType_HISTOGRAM:
+					by := strings.Join(append([]string{"le"}, labels...), ", ")
+					for _, q := range []float64{0.5, 0.9, 0.99} {
+						p("  - record: %s:%s:%s_rate%s", level, m.name, quantileName(q), rulesRange)
+						p("    expr: histogram_quantile(%g, sum by (%s) (rate(%s_bucket[%s])))", q, by, m.name, rulesRange)
+					}
+				}
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Files generated by the -generate flag, relative to its directory.
+var (
+	dashboardFile = filepath.Join("grafana", "provisioning", "dashboards", "cache.json")
+	providerFile  = filepath.Join("grafana", "provisioning", "dashboards", "dashboards.yml")
+	rulesFile     = filepath.Join("prometheus", "cache.rules.yml")
+)
+
+// generateFiles returns the content of the generated files, by path relative
+// to the generation directory, for a server configured with cfg.
+func generateFiles(cfg *config) (map[string][]byte, error) {
+	descs, err := describeMetrics(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db, err := buildDashboard(descs, dashboardRows)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	var buf bytes.Buffer
+	if err := writeDashboard(&buf, db); err != nil {
+		return nil, err
+	}
+	files[dashboardFile] = append([]byte(nil), buf.Bytes()...)
+
+	buf.Reset()
+	if err := writeDashboardProvider(&buf, "/etc/grafana/provisioning/dashboards"); err != nil {
+		return nil, err
+	}
+	files[providerFile] = append([]byte(nil), buf.Bytes()...)
+
+	buf.Reset()
+	if err := writeRules(&buf, descs, dashboardRows); err != nil {
+		return nil, err
+	}
+	files[rulesFile] = append([]byte(nil), buf.Bytes()...)
+	return files, nil
+}
+
+// generate writes the Grafana dashboard and its provisioning configuration,
+// and the Prometheus rules, in dir.
+func generate(dir string, cfg *config) error {
+	files, err := generateFiles(cfg)
+	if err != nil {
+		return err
+	}
+	for path, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseDesc(t *testing.T) {
+	desc := prometheus.NewDesc("requests_total", `Requests, by "route"`, []string{"route", "code"}, prometheus.Labels{"app": "cache"})
+	m, err := parseDesc(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := metricDesc{name: "requests_total", help: `Requests, by "route"`, labels: []string{"route", "code"}}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("parseDesc = %+v, want %+v", m, want)
+	}
+}
+
+func TestDescribeMetrics(t *testing.T) {
+	descs, err := describeMetrics(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		typ    dto.MetricType
+		labels []string
+	}{
+		{"cache_hits_total", dto.MetricType_COUNTER, []string{}},
+		{"http_request_duration_seconds", dto.MetricType_HISTOGRAM, []string{"route", "method", "code"}},
+		{"http_requests_in_flight", dto.MetricType_GAUGE, []string{"route"}},
+		{"go_gc_pauses_seconds", dto.MetricType_HISTOGRAM, []string{}},
+		{"go_goroutines", dto.MetricType_GAUGE, []string{}},
+		// Guarded by the cardinality guard.
+		{"ratelimit_requests_total", dto.MetricType_COUNTER, []string{"route", "class", "result"}},
+		{"auth_failures_total", dto.MetricType_COUNTER, []string{"reason"}},
+	}
+	for _, tt := range tests {
+		m, ok := descs[tt.name]
+		if !ok {
+			t.Errorf("%s not described", tt.name)
+			continue
+		}
+		if m.typ != tt.typ || !reflect.DeepEqual(m.labels, tt.labels) {
+			t.Errorf("%s: type %v, labels %v, want %v, %v", tt.name, m.typ, m.labels, tt.typ, tt.labels)
+		}
+	}
+}
+
+func TestGuardedCounterTargets(t *testing.T) {
+	descs, err := describeMetrics(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := metricTargets(descs["ratelimit_requests_total"], false)
+	want := "sum by (route, class, result) (rate(ratelimit_requests_total[1m]))"
+	if len(targets) != 1 || targets[0].Expr != want {
+		t.Errorf("ratelimit_requests_total targets = %+v, want %q", targets, want)
+	}
+}
+
+// TestGeneratedFiles checks the generated files are up to date.
+func TestGeneratedFiles(t *testing.T) {
+	files, err := generateFiles(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range files {
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is outdated, run go generate", filepath.ToSlash(path))
+		}
+	}
+}
+
+func TestBuildDashboardUnknownMetric(t *testing.T) {
+	descs, err := describeMetrics(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []rowSpec{{title: "Cache", panels: []panelSpec{{title: "Hits", metrics: []string{"cache_hit_total"}}}}}
+	if _, err := buildDashboard(descs, rows); err == nil || !strings.Contains(err.Error(), "cache_hit_total") {
+		t.Errorf("buildDashboard err = %v, want unknown metric", err)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captured wraps h, serving runtime captures (profiles or execution traces),
+// so that successful captures are counted, with their size, by kind.
+func captured(kind func(*http.Request) string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status != http.StatusOK {
+			return
+		}
+		k := kind(r)
+		debugCaptures.WithLabelValues(k).Inc()
+		debugCaptureSize.WithLabelValues(k).Observe(float64(rec.bytes))
+	})
+}
+
+// pprofKind returns the name of the profile requested under /debug/pprof/.
+func pprofKind(r *http.Request) string {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "" {
+		return "index"
+	}
+	return name
+}
+
+func constKind(kind string) func(*http.Request) string {
+	return func(*http.Request) string { return kind }
+}
+
+// setupDebugRoutes registers the pprof, execution trace, stored profiles and
+// metrics cardinality endpoints, only served to admin clients.
+func (s *server) setupDebugRoutes() {
+	debug := func(pattern string, kind func(*http.Request) string, h http.HandlerFunc) {
+		s.handle(pattern, s.auth.require(scopeAdmin, captured(kind, h)))
+	}
+	debug("/debug/pprof/", pprofKind, pprof.Index)
+	debug("/debug/pprof/cmdline", constKind("cmdline"), pprof.Cmdline)
+	debug("/debug/pprof/profile", constKind("profile"), s.defaultSeconds(30, pprof.Profile))
+	debug("/debug/pprof/symbol", constKind("symbol"), pprof.Symbol)
+	debug("/debug/pprof/trace", constKind("trace"), s.defaultSeconds(1, pprof.Trace))
+	debug("/debug/trace", constKind("trace"), s.handleTrace)
+	if s.prof != nil {
+		s.handle("/debug/profiles", s.auth.require(scopeAdmin, s.prof.handler()))
+		s.handle("/debug/profiles/", s.auth.require(scopeAdmin, s.prof.handler()))
+	}
+	if s.guard != nil {
+		s.handle("/debug/cardinality", s.auth.require(scopeAdmin, s.guard.Handler()))
+	}
+}
+
+// defaultSeconds wraps a pprof handler which captures for the number of
+// seconds in the query, def by default. pprof rejects durations reaching the
+// server write timeout, so without seconds in the query, the duration is
+// capped just below it: a plain 'go tool pprof' of the CPU profile, 30s by
+// default, works with the default 10s write timeout.
+func (s *server) defaultSeconds(def int64, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("seconds") == "" {
+			secs := def
+			if wt := s.srv.WriteTimeout; wt > 0 {
+				if max := int64((wt - 1) / time.Second); max >= 1 && secs > max {
+					secs = max
+				}
+			}
+			q.Set("seconds", strconv.FormatInt(secs, 10))
+			r.URL.RawQuery = q.Encode()
+		}
+		h(w, r)
+	}
+}
+
+// handleTrace captures an execution trace for the number of seconds (1 by
+// default) in the query, which can be viewed with 'go tool trace'.
+func (s *server) handleTrace(w http.ResponseWriter, r *http.Request) {
+	secs := 1.0
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		var err error
+		if secs, err = strconv.ParseFloat(v, 64); err != nil || secs <= 0 {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+	}
+	d := time.Duration(secs * float64(time.Second))
+	if wt := s.srv.WriteTimeout; wt > 0 && d >= wt {
+		http.Error(w, "seconds exceeds the server write timeout", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		// Likely another trace is being captured.
+		w.Header().Del("Content-Disposition")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.Error(w, "could not start trace: "+err.Error(), http.StatusConflict)
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+	trace.Stop()
+}
+
+const (
+	// flightRecorderInterval is how often the p99 latency is checked.
+	flightRecorderInterval = time.Second
+
+	// flightRecorderMinSamples is the minimum number of requests served during
+	// the window for the p99 latency to be considered.
+	flightRecorderMinSamples = 10
+)
+
+type latencySample struct {
+	t time.Time
+	d time.Duration
+}
+
+// A flightRecorder keeps the execution trace of the last seconds in memory,
+// and dumps it to a file when the p99 latency of the requests served during
+// that time crosses a threshold.
+//
+// A nil flightRecorder is disabled.
+type flightRecorder struct {
+	fr        *trace.FlightRecorder
+	window    time.Duration
+	threshold time.Duration
+	dir       string
+	now       func() time.Time
+
+	mu       sync.Mutex
+	samples  [1024]latencySample // ring buffer of the latest requests
+	next     int
+	lastDump time.Time
+}
+
+// newFlightRecorder creates and starts the flight recorder configured in cfg.
+func newFlightRecorder(cfg *config) (*flightRecorder, error) {
+	fr := trace.NewFlightRecorder(trace.FlightRecorderConfig{
+		MinAge:   cfg.FlightRecorderWindow,
+		MaxBytes: uint64(cfg.FlightRecorderMaxBytes),
+	})
+	if err := fr.Start(); err != nil {
+		return nil, err
+	}
+	return &flightRecorder{
+		fr:        fr,
+		window:    cfg.FlightRecorderWindow,
+		threshold: cfg.FlightRecorderThreshold,
+		dir:       cfg.FlightRecorderDir,
+		now:       time.Now,
+	}, nil
+}
+
+// handler wraps h so that its latency is observed by the flight recorder.
+func (f *flightRecorder) handler(h http.Handler) http.Handler {
+	if f == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t0 := f.now()
+		h.ServeHTTP(w, r)
+		f.observe(t0, f.now().Sub(t0))
+	})
+}
+
+func (f *flightRecorder) observe(t time.Time, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.samples[f.next] = latencySample{t: t, d: d}
+	f.next = (f.next + 1) % len(f.samples)
+}
+
+// p99 returns the 99th percentile latency of the requests served during the
+// window, and their number.
+func (f *flightRecorder) p99() (time.Duration, int) {
+	since := f.now().Add(-f.window)
+	var ds []time.Duration
+	f.mu.Lock()
+	for _, s := range f.samples {
+		if s.t.After(since) {
+			ds = append(ds, s.d)
+		}
+	}
+	f.mu.Unlock()
+
+	if len(ds) == 0 {
+		return 0, 0
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	i := (len(ds)*99+99)/100 - 1 // ceil(0.99*n) - 1
+	return ds[i], len(ds)
+}
+
+// check dumps the execution trace if the p99 latency is above the threshold.
+// It returns the path of the dumped trace, if any.
+//
+// Traces are dumped at most once per window, so that they don't overlap.
+func (f *flightRecorder) check() (string, error) {
+	p99, n := f.p99()
+	if n < flightRecorderMinSamples || p99 <= f.threshold {
+		return "", nil
+	}
+
+	now := f.now()
+	f.mu.Lock()
+	if now.Sub(f.lastDump) < f.window {
+		f.mu.Unlock()
+		return "", nil
+	}
+	f.lastDump = now
+	f.mu.Unlock()
+
+	path := filepath.Join(f.dir, "flight-"+now.UTC().Format("20060102T150405.000")+".trace")
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	size, err := f.fr.WriteTo(file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("dumping trace: %v", err)
+	}
+	debugCaptures.WithLabelValues("flight_recorder").Inc()
+	debugCaptureSize.WithLabelValues("flight_recorder").Observe(float64(size))
+	slog.Warn("flight recorder: p99 latency above threshold, trace dumped",
+		"p99_seconds", p99.Seconds(), "threshold_seconds", f.threshold.Seconds(), "path", path)
+	return path, nil
+}
+
+// run checks the p99 latency at regular interval until ctx is done, then
+// stops the flight recorder.
+func (f *flightRecorder) run(ctx context.Context, interval time.Duration) {
+	defer f.fr.Stop()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if _, err := f.check(); err != nil {
+			slog.Error("flight recorder", "err", err)
+		}
+	}
+}
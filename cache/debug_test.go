@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arl/golab-2019/metrics"
+	"github.com/arl/golab-2019/metrics/metricstest"
+)
+
+func captureCount(kind string) float64 {
+	return metricstest.Value(debugCaptures.WithLabelValues(kind))
+}
+
+func TestDebugRoutesAuth(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AuthTokens, _ = parseCredentials("reader=r:read,admin=a:admin")
+	s := newTestServer(cfg)
+	s.setupRoutes()
+
+	before := captureCount("goroutine")
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"r", http.StatusForbidden},
+		{"a", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("token %q: status = %d, want %d", tt.token, w.Code, tt.want)
+		}
+	}
+	if got := captureCount("goroutine") - before; got != 1 {
+		t.Errorf("goroutine captures = %v, want 1", got)
+	}
+}
+
+func TestDebugTrace(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.WriteTimeout = time.Second
+	s := newTestServer(cfg)
+	s.setupRoutes()
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/trace"+query, nil))
+		return w
+	}
+
+	before := captureCount("trace")
+	w := get("?seconds=0.05")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("go 1.")) {
+		t.Errorf("response is not an execution trace: %q", w.Body.Bytes()[:16])
+	}
+	if got := captureCount("trace") - before; got != 1 {
+		t.Errorf("trace captures = %v, want 1", got)
+	}
+
+	for _, q := range []string{"?seconds=abc", "?seconds=-1", "?seconds=2"} {
+		if w := get(q); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestDebugProfileDefaultSeconds(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.WriteTimeout = 2 * time.Second
+	s := newTestServer(cfg)
+	s.setupRoutes()
+
+	// pprof only checks the write timeout of an actual server.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.srv.Serve(l)
+	defer s.srv.Close()
+
+	// Without seconds, the 30s default of pprof would exceed the write
+	// timeout: the profile is captured for 1s instead.
+	t0 := time.Now()
+	resp, err := http.Get("http://" + l.Addr().String() + "/debug/pprof/profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", resp.StatusCode, body)
+	}
+	if d := time.Since(t0); d >= cfg.WriteTimeout {
+		t.Errorf("profile took %v, want less than the write timeout", d)
+	}
+	if len(body) == 0 {
+		t.Errorf("empty profile")
+	}
+}
+
+func TestFlightRecorder(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.FlightRecorderThreshold = 10 * time.Millisecond
+	cfg.FlightRecorderDir = t.TempDir()
+	f, err := newFlightRecorder(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.fr.Stop()
+
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	observe := func(n int, d time.Duration) {
+		for i := 0; i < n; i++ {
+			f.observe(now, d)
+		}
+	}
+
+	// Fast requests.
+	observe(100, time.Millisecond)
+	if path, err := f.check(); path != "" || err != nil {
+		t.Fatalf("check() = %q, %v, want no dump", path, err)
+	}
+
+	// 1% of slow requests doesn't make the p99 cross the threshold, 2% does.
+	observe(1, time.Second)
+	if p99, _ := f.p99(); p99 != time.Millisecond {
+		t.Errorf("p99 = %v, want 1ms", p99)
+	}
+	observe(1, time.Second)
+
+	before := captureCount("flight_recorder")
+	path, err := f.check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path == "" {
+		t.Fatal("p99 above threshold, trace not dumped")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("go 1.")) {
+		t.Errorf("dumped file is not an execution trace")
+	}
+	if got := captureCount("flight_recorder") - before; got != 1 {
+		t.Errorf("flight recorder captures = %v, want 1", got)
+	}
+
+	// At most one dump per window.
+	if path, _ := f.check(); path != "" {
+		os.Remove(path)
+		t.Errorf("trace dumped twice in the same window")
+	}
+
+	// Old samples are out of the window.
+	now = now.Add(2 * cfg.FlightRecorderWindow)
+	if _, n := f.p99(); n != 0 {
+		t.Errorf("%d samples in window, want 0", n)
+	}
+}
+
+func TestDebugCardinality(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.SeriesLimits = map[string]int{"ratelimit_requests_total": 2}
+	reg := metricstest.NewRegistry()
+	guard := metrics.NewCardinalityGuard(reg, cfg.MaxSeries, cfg.SeriesLimits)
+	p, err := newMetricsProvider(cfg, reg, guard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(cfg, reg, p)
+	s.guard = guard
+	s.setupRoutes()
+
+	for _, class := range []string{"a", "b", "c", "d"} {
+		rateLimitRequests.With("/get", class, "allowed").Inc()
+	}
+
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/cardinality", nil))
+	var report []metrics.MetricCardinality
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	var found bool
+	for _, mc := range report {
+		if mc.Metric == "ratelimit_requests_total" {
+			found = true
+			if mc.Limit != 2 || mc.Series != 2 || mc.Overflow != 2 {
+				t.Errorf("ratelimit_requests_total = %+v, want 2 series and 2 overflowing updates", mc)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("ratelimit_requests_total not reported in %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`ratelimit_requests_total{class="__overflow__",result="__overflow__",route="__overflow__"} 2`,
+		`metric_series_dropped_total{metric="ratelimit_requests_total"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("/metrics doesn't contain %q", want)
+		}
+	}
+}
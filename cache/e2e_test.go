@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arl/golab-2019/cache/client"
+	"github.com/arl/golab-2019/metrics"
+	"github.com/arl/golab-2019/metrics/metricstest"
+)
+
+// An e2e is a server listening on an ephemeral port, wired as by main, and
+// its HTTP client.
+type e2e struct {
+	t    *testing.T
+	s    *server
+	addr string
+}
+
+// startE2E starts a server configured with cfg. It must be stopped with
+// close.
+func startE2E(t *testing.T, cfg *config) *e2e {
+	reg := metricstest.NewRegistry()
+	guard := metrics.NewCardinalityGuard(reg, cfg.MaxSeries, cfg.SeriesLimits)
+	p, err := newMetricsProvider(cfg, reg, guard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(cfg, reg, p)
+	s.guard = guard
+	s.setupRoutes()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.srv.Serve(l)
+	return &e2e{t: t, s: s, addr: l.Addr().String()}
+}
+
+func (e *e2e) close() {
+	if err := e.s.shutdown(); err != nil {
+		e.t.Errorf("shutdown: %v", err)
+	}
+}
+
+// do sends req and returns the response status code and body.
+func (e *e2e) do(req *http.Request, err error) (int, string) {
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// scrape returns a snapshot of the metrics served on /metrics.
+func (e *e2e) scrape() metricstest.Snapshot {
+	resp, err := http.Get("http://" + e.addr + "/metrics")
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return metricstest.Parse(e.t, resp.Body)
+}
+
+// workload is a deterministic sequence of requests, modelled on cache/load,
+// with the responses expected from an empty cache large enough to hold all
+// the keys.
+type workload struct {
+	adds, gets   int
+	hits, misses int
+	reqs         []func(addr string) (*http.Request, error)
+	want         []string // expected bodies
+}
+
+func newWorkload(seed int64, n int) *workload {
+	rnd := rand.New(rand.NewSource(seed))
+	known := []string{"hello", "language", "version", "topic", "pi", "tsdb", "year", "month"}
+	key := func() string {
+		if rnd.Intn(100) < 32 {
+			return known[rnd.Intn(len(known))]
+		}
+		return "key-" + string(rune('a'+rnd.Intn(26)))
+	}
+
+	w := &workload{}
+	values := make(map[string]string)
+	for i := 0; i < n; i++ {
+		k := key()
+		if rnd.Intn(100) < 50 {
+			v := fmt.Sprintf("value-%d", i)
+			values[k] = v
+			w.adds++
+			w.reqs = append(w.reqs, func(addr string) (*http.Request, error) { return client.AddRequest(addr, k, v) })
+			w.want = append(w.want, "")
+			continue
+		}
+		w.gets++
+		if v, ok := values[k]; ok {
+			w.hits++
+			w.want = append(w.want, v)
+		} else {
+			w.misses++
+			w.want = append(w.want, "")
+		}
+		w.reqs = append(w.reqs, func(addr string) (*http.Request, error) { return client.GetRequest(addr, k) })
+	}
+	return w
+}
+
+func TestE2EMetrics(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RouteLimits, _ = parseLimits("/add=100000:100000,/get=100000:100000")
+	e := startE2E(t, cfg)
+	defer e.close()
+
+	w := newWorkload(1, 300)
+	before := e.scrape()
+	for i, req := range w.reqs {
+		_, body := e.do(req(e.addr))
+		if body != w.want[i] {
+			t.Fatalf("request %d: body %q, want %q", i, body, w.want[i])
+		}
+	}
+	after := e.scrape()
+	d := metricstest.Diff(before, after)
+
+	counters := []struct {
+		name   string
+		labels prometheus.Labels
+		want   int
+	}{
+		{"http_requests_total", prometheus.Labels{"route": "/add", "method": "get", "code": "200"}, w.adds},
+		{"http_requests_total", prometheus.Labels{"route": "/get", "method": "get", "code": "200"}, w.hits},
+		{"http_requests_total", prometheus.Labels{"route": "/get", "method": "get", "code": "204"}, w.misses},
+		{"cache_hits_total", nil, w.hits},
+		{"cache_misses_total", nil, w.misses},
+		{"cache_evictions_total", nil, 0},
+		{"ratelimit_requests_total", prometheus.Labels{"route": "/add", "result": "allowed"}, w.adds},
+		{"ratelimit_requests_total", prometheus.Labels{"route": "/get", "result": "allowed"}, w.gets},
+		{"ratelimit_requests_total", prometheus.Labels{"result": "throttled"}, 0},
+		// The scrape of before.
+		{"promhttp_metric_handler_requests_total", prometheus.Labels{"code": "200"}, 1},
+	}
+	for _, c := range counters {
+		metricstest.AssertCounter(t, d, c.name, c.labels, float64(c.want))
+	}
+
+	histograms := []struct {
+		name  string
+		route string
+		want  int
+	}{
+		{"http_request_duration_seconds", "/add", w.adds},
+		{"http_request_duration_seconds", "/get", w.gets},
+		{"http_request_size_bytes", "/get", w.gets},
+		{"http_response_size_bytes", "/add", w.adds},
+	}
+	for _, h := range histograms {
+		metricstest.AssertCount(t, d, h.name, prometheus.Labels{"route": h.route}, uint64(h.want))
+	}
+	// Served from memory, on the loopback interface.
+	metricstest.AssertQuantile(t, d, "http_request_duration_seconds", prometheus.Labels{"route": "/get"}, 0.5, 0, 0.1)
+
+	if v := after.Value("http_requests_in_flight", prometheus.Labels{"route": "/get"}); v != 0 {
+		t.Errorf("http_requests_in_flight{route=/get} = %v, want 0", v)
+	}
+	metricstest.AssertLint(t, after)
+}
+
+func TestE2EEvictions(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CacheSize = 4
+	e := startE2E(t, cfg)
+	defer e.close()
+
+	before := e.scrape()
+	for i := 0; i < 10; i++ {
+		e.do(client.AddRequest(e.addr, fmt.Sprintf("k%d", i), "v"))
+	}
+	// The oldest keys have been evicted.
+	if code, _ := e.do(client.GetRequest(e.addr, "k0")); code != http.StatusNoContent {
+		t.Errorf("get evicted key: status %d, want %d", code, http.StatusNoContent)
+	}
+	if code, body := e.do(client.GetRequest(e.addr, "k9")); code != http.StatusOK || body != "v" {
+		t.Errorf("get last key: status %d, body %q", code, body)
+	}
+	d := metricstest.Diff(before, e.scrape())
+
+	metricstest.AssertCounter(t, d, "cache_evictions_total", nil, 6)
+	metricstest.AssertCounter(t, d, "cache_hits_total", nil, 1)
+	metricstest.AssertCounter(t, d, "cache_misses_total", nil, 1)
+}
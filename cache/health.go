@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A healthCheck is a named check of a component the server depends on.
+type healthCheck struct {
+	name     string
+	liveness bool // whether the check is also a liveness check
+	check    func(ctx context.Context) error
+}
+
+// health is a registry of health checks.
+//
+// All checks contribute to the server readiness, only liveness checks
+// contribute to its liveness: a failed liveness check means the server
+// should be restarted.
+type health struct {
+	timeout time.Duration // maximum duration of a check
+
+	mu     sync.Mutex
+	checks []healthCheck
+}
+
+func newHealth(timeout time.Duration) *health {
+	return &health{timeout: timeout}
+}
+
+// register adds a named check to the registry.
+func (h *health) register(name string, liveness bool, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, healthCheck{name: name, liveness: liveness, check: check})
+}
+
+// A checkResult is the outcome of a health check.
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// run concurrently runs the checks, only the liveness ones if liveness is
+// true, and returns their results by name, as well as whether all succeeded.
+func (h *health) run(ctx context.Context, liveness bool) (map[string]checkResult, bool) {
+	h.mu.Lock()
+	checks := make([]healthCheck, len(h.checks))
+	copy(checks, h.checks)
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[string]checkResult)
+		healthy = true
+	)
+	for _, c := range checks {
+		if liveness && !c.liveness {
+			continue
+		}
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+
+			res := checkResult{Status: "ok"}
+			if err := runCheck(ctx, c.check); err != nil {
+				res = checkResult{Status: "fail", Error: err.Error()}
+				healthCheckStatus.With(c.name).Set(0)
+			} else {
+				healthCheckStatus.With(c.name).Set(1)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[c.name] = res
+			healthy = healthy && res.Status == "ok"
+		}(c)
+	}
+	wg.Wait()
+	return results, healthy
+}
+
+// runCheck runs check, giving up when ctx is done even if check doesn't honour
+// the context, for example because it's blocked on a lock.
+func runCheck(ctx context.Context, check func(ctx context.Context) error) error {
+	errc := make(chan error, 1)
+	go func() { errc <- check(ctx) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check timed out: %v", ctx.Err())
+	}
+}
+
+// handler returns an HTTP handler running the checks and reporting their
+// results as JSON, with status 200 if they all succeeded, 503 otherwise.
+func (h *health) handler(liveness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results, healthy := h.run(r.Context(), liveness)
+
+		resp := struct {
+			Status string                 `json:"status"`
+			Checks map[string]checkResult `json:"checks"`
+		}{Status: "ok", Checks: results}
+
+		code := http.StatusOK
+		if !healthy {
+			resp.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// poll runs all the checks at every interval, keeping the health_check_status
+// gauges up to date, until ctx is done.
+func (h *health) poll(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		h.run(ctx, false)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// dialCheck returns a check verifying that all addrs accept TCP connections.
+// If tlsConfig is not nil and returns a configuration for the host of an
+// address, the check also performs a TLS handshake with that configuration.
+func dialCheck(tlsConfig func(serverName string) *tls.Config, addrs ...string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var (
+			d      net.Dialer
+			failed []string
+		)
+		for _, addr := range addrs {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				failed = append(failed, err.Error())
+				continue
+			}
+			if err := handshake(ctx, conn, addr, tlsConfig); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", addr, err))
+			}
+			conn.Close()
+		}
+		if len(failed) != 0 {
+			return fmt.Errorf("%d/%d unreachable: %s", len(failed), len(addrs), strings.Join(failed, "; "))
+		}
+		return nil
+	}
+}
+
+// handshake performs a TLS handshake on conn, if tlsConfig is not nil and
+// returns a configuration for addr.
+func handshake(ctx context.Context, conn net.Conn, addr string, tlsConfig func(serverName string) *tls.Config) error {
+	if tlsConfig == nil {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	cfg := tlsConfig(host)
+	if cfg == nil {
+		return nil
+	}
+	tconn := tls.Client(conn, cfg)
+	if deadline, ok := ctx.Deadline(); ok {
+		tconn.SetDeadline(deadline)
+	}
+	return tconn.Handshake()
+}
+
+// A task tracks the completion of a background task, to be used as a check.
+type task struct {
+	mu   sync.Mutex
+	done bool
+	err  error
+}
+
+// finish marks the task as done, with err as result.
+func (t *task) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done, t.err = true, err
+}
+
+// finished reports whether the task is done.
+func (t *task) finished() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
+}
+
+func (t *task) check(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.done {
+		return fmt.Errorf("in progress")
+	}
+	return t.err
+}
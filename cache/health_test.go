@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+func getHealth(t *testing.T, h http.Handler) (int, healthResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	var resp healthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, resp
+}
+
+func TestHealthHandler(t *testing.T) {
+	h := newHealth(time.Second)
+	h.register("live", true, func(context.Context) error { return nil })
+
+	var loading task
+	h.register("ready", false, loading.check)
+
+	code, resp := getHealth(t, h.handler(false))
+	if code != http.StatusServiceUnavailable || resp.Status != "fail" {
+		t.Errorf("readiness = (%d, %q), want (%d, %q)", code, resp.Status, http.StatusServiceUnavailable, "fail")
+	}
+	if got := resp.Checks["ready"]; got.Status != "fail" || got.Error == "" {
+		t.Errorf(`check "ready" = %+v, want failure with error`, got)
+	}
+	if got := resp.Checks["live"]; got.Status != "ok" {
+		t.Errorf(`check "live" = %+v, want ok`, got)
+	}
+
+	code, resp = getHealth(t, h.handler(true))
+	if code != http.StatusOK || len(resp.Checks) != 1 {
+		t.Errorf("liveness = (%d, %v), want (%d, only live check)", code, resp.Checks, http.StatusOK)
+	}
+
+	loading.finish(nil)
+	if code, _ := getHealth(t, h.handler(false)); code != http.StatusOK {
+		t.Errorf("readiness = %d, want %d", code, http.StatusOK)
+	}
+
+	loading.finish(errors.New("corrupted"))
+	if _, resp := getHealth(t, h.handler(false)); resp.Checks["ready"].Error != "corrupted" {
+		t.Errorf(`check "ready" = %+v, want error "corrupted"`, resp.Checks["ready"])
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	h := newHealth(10 * time.Millisecond)
+	block := make(chan struct{})
+	defer close(block)
+	h.register("blocked", true, func(context.Context) error { <-block; return nil })
+
+	results, healthy := h.run(context.Background(), true)
+	if healthy || results["blocked"].Status != "fail" {
+		t.Errorf("blocked check = %+v, want failure", results["blocked"])
+	}
+}
+
+func TestDialCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := l.Addr().String()
+
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+	defer l.Close()
+
+	ctx := context.Background()
+	if err := dialCheck(nil, up)(ctx); err != nil {
+		t.Errorf("dialCheck(%s) = %v, want nil", up, err)
+	}
+	if err := dialCheck(nil, up, downAddr)(ctx); err == nil {
+		t.Errorf("dialCheck(%s, %s) should fail", up, downAddr)
+	}
+}
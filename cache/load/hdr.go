@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// hdrSubBits is the log2 of the number of buckets per power of 2 of an
+// hdrHistogram: values are recorded with a relative error of 2^-8, less than
+// 0.4%.
+const hdrSubBits = 8
+
+// An hdrHistogram records durations, like an HdrHistogram: buckets are
+// linear within each power of 2, so that the relative error of any recorded
+// value is bounded, whatever its magnitude, unlike with the Prometheus
+// exponential buckets.
+type hdrHistogram struct {
+	counts []uint64 // by bucket index, grown as needed
+	total  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// hdrIndex returns the index of the bucket of v, in nanoseconds.
+func hdrIndex(v uint64) int {
+	const sub = 1 << hdrSubBits
+	if v < sub {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 1 - hdrSubBits
+	return (shift+1)<<hdrSubBits + int(v>>uint(shift)) - sub
+}
+
+// hdrHighest returns the highest value, in nanoseconds, of the bucket i.
+func hdrHighest(i int) uint64 {
+	const sub = 1 << hdrSubBits
+	shift := i>>hdrSubBits - 1
+	if shift <= 0 {
+		return uint64(i)
+	}
+	lowest := uint64(i&(sub-1)+sub) << uint(shift)
+	return lowest + 1<<uint(shift) - 1
+}
+
+// record records the duration d.
+func (h *hdrHistogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := hdrIndex(uint64(d))
+	if i >= len(h.counts) {
+		counts := make([]uint64, i+1, 2*(i+1))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i]++
+	if h.total == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.total++
+	h.sum += d
+}
+
+// merge adds the durations recorded by o to h.
+func (h *hdrHistogram) merge(o *hdrHistogram) {
+	if o.total == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		counts := make([]uint64, len(o.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	if h.total == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.total += o.total
+	h.sum += o.sum
+}
+
+// quantile returns the q-quantile (0 < q ≤ 1) of the recorded durations: the
+// highest value of the bucket of the ⌈q×total⌉th smallest one, so that it
+// overestimates rather than underestimates latencies, by less than 0.4%. It
+// returns 0 if nothing has been recorded.
+func (h *hdrHistogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var count uint64
+	for i, n := range h.counts {
+		if count += n; count >= rank {
+			if v := time.Duration(hdrHighest(i)); v < h.max {
+				return v
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// mean returns the mean of the recorded durations.
+func (h *hdrHistogram) mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.total)
+}
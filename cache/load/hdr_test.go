@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHDRIndex(t *testing.T) {
+	// Buckets are contiguous, and values within the relative error.
+	prev := -1
+	for _, v := range []uint64{0, 1, 255, 256, 511, 512, 513, 1023, 1024, 1e6, 1e9, 1e12} {
+		i := hdrIndex(v)
+		if i < prev {
+			t.Errorf("hdrIndex(%d) = %d, lower than the index of a lower value", v, i)
+		}
+		prev = i
+		high := hdrHighest(i)
+		if high < v || float64(high-v) > float64(v)/(1<<hdrSubBits) {
+			t.Errorf("highest value of the bucket of %d = %d, out of the relative error", v, high)
+		}
+		if hdrIndex(high) != i || hdrIndex(high+1) != i+1 {
+			t.Errorf("bucket %d ends at %d, but %d is in bucket %d", i, high, high+1, hdrIndex(high+1))
+		}
+	}
+}
+
+func TestHDRQuantile(t *testing.T) {
+	var h, h2 hdrHistogram
+	for i := 1; i <= 1000; i++ {
+		d := time.Duration(i) * time.Millisecond
+		if i%2 == 0 {
+			h.record(d)
+		} else {
+			h2.record(d)
+		}
+	}
+	h.merge(&h2)
+
+	if h.total != 1000 || h.min != time.Millisecond || h.max != time.Second {
+		t.Fatalf("total, min, max = %d, %v, %v", h.total, h.min, h.max)
+	}
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.5, 500 * time.Millisecond},
+		{0.9, 900 * time.Millisecond},
+		{0.99, 990 * time.Millisecond},
+		{0.999, 999 * time.Millisecond},
+		{1, time.Second},
+	}
+	for _, tt := range tests {
+		got := h.quantile(tt.q)
+		if got < tt.want || float64(got-tt.want) > float64(tt.want)/(1<<hdrSubBits) {
+			t.Errorf("quantile(%v) = %v, want %v, at most 0.4%% more", tt.q, got, tt.want)
+		}
+	}
+	if m := h.mean(); m != 500500*time.Microsecond {
+		t.Errorf("mean = %v, want 500.5ms", m)
+	}
+
+	var empty hdrHistogram
+	if q := empty.quantile(0.5); q != 0 {
+		t.Errorf("quantile of an empty histogram = %v, want 0", q)
+	}
+}
@@ -3,168 +3,316 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math"
-	"math/rand"
+	"log"
 	"net/http"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arl/golab-2019/cache/client"
+	"github.com/arl/golab-2019/push"
 )
 
 var (
 	addr     = flag.String("addr", "localhost:8080", "'cache' server address to load")
-	sdur     = flag.String("dur", "10s", "how long")
+	sdur     = flag.String("dur", "10s", "how long, 0 for no limit if -n is set")
+	count    = flag.Int64("n", 0, "number of requests to send, 0 for no limit")
+	rate     = flag.Float64("rate", 0, "requests per second to send at a constant rate whatever the response times (open loop), 0 to wait 50-70ms after each response (closed loop)")
+	nworkers = flag.Int("workers", runtime.NumCPU(), "number of workers, i.e. of concurrent requests at most")
+	token    = flag.String("token", "", "bearer token to authenticate requests")
 	verbose  = flag.Bool("v", false, "print retrieved cache values and error strings")
 	vverbose = flag.Bool("vv", false, "very verbose")
+	output   = flag.String("output", "text", "report format: text, json or csv")
+
+	// info is where everything but the report is written: stderr if the
+	// report is in JSON or CSV, so that only it is written to stdout.
+	info io.Writer = os.Stdout
+
+	reads     = flag.Float64("reads", 0.5, "fraction of the requests which are gets, the others being adds")
+	keys      = flag.Int("keys", 1000, "size of the key space")
+	dist      = flag.String("dist", distUniform, "key distribution: uniform, zipf, hotspot, sequential or latest")
+	zipfSkew  = flag.Float64("zipf-skew", 1.1, "skew of the zipf and latest key distributions, greater than 1")
+	hotKeys   = flag.Float64("hot-keys", 0.2, "fraction of the keys which are hot, with the hotspot distribution")
+	hotOps    = flag.Float64("hot-ops", 0.8, "fraction of the requests for the hot keys, with the hotspot distribution")
+	valueSize = flag.String("value-size", "16", "size of the values added, in bytes: N, MIN-MAX for uniformly distributed sizes, or exp:MEAN for exponentially distributed ones")
+	seed      = flag.Int64("seed", 0, "seed of the workload random generators (default time based)")
+
+	pushGateway  = flag.String("push-gateway", "", "Pushgateway URL to push metrics to, e.g. http://localhost:9091")
+	remoteWrite  = flag.String("remote-write", "", "remote write URL to push metrics to, e.g. http://localhost:9090/api/v1/write")
+	pushInterval = flag.Duration("push-interval", 10*time.Second, "interval between metrics pushes, metrics are also pushed on exit")
 )
 
 var (
-	m       sync.Map
-	keys    []string
-	letters = "abcdefghijklmnopqrstuvwxyz"
+	requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "load_requests_total",
+			Help: "The total number of requests sent, by operation and status code ('error' for transport errors)",
+		}, []string{"op", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "load_request_duration_seconds",
+			Help:    "Duration of the requests, by operation, from their intended send time with -rate",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, []string{"op"})
+
+	scheduleLag = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "load_schedule_lag_seconds",
+			Help:    "Delay between the intended send time of the requests, with -rate, and the time they were sent",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		})
 )
 
-func randomString(length int) string {
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+// httpClient sends the requests, keeping a connection open per worker.
+var httpClient *http.Client
+
+// startPush starts pushing the load metrics to the configured targets, if
+// any. The returned function must be called before exiting.
+func startPush() (stop func()) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(requests, requestDuration, scheduleLag)
+
+	instance, _ := os.Hostname()
+	var targets []push.Target
+	if *pushGateway != "" {
+		targets = append(targets, push.NewPusher(*pushGateway, "load", map[string]string{"instance": instance}, reg, nil))
 	}
-	return string(b)
+	if *remoteWrite != "" {
+		targets = append(targets, push.NewRemoteWriter(*remoteWrite, reg, map[string]string{"job": "load", "instance": instance}, nil))
+	}
+	return push.Start(*pushInterval, func(err error) { log.Println("push:", err) }, targets...)
 }
 
-func randomAdd() *http.Request {
-	var k, v string
-	rnd := rand.Intn(100)
-	if rnd < 32 {
-		k = keys[rnd%len(keys)]
-		iv, ok := m.Load(k)
-		if !ok {
-			panic(fmt.Sprintf("m.Load(%s)", k))
-		}
-		v = iv.(string)
-	} else {
-		ch := randomString(1)
-		k = "key-" + ch
-		v = "value-" + ch // don't care
+// limits are when to stop loading the server: after a duration and/or a
+// number of requests, whichever comes first. Zero means no limit.
+type limits struct {
+	dur   time.Duration
+	count int64
+}
+
+// setup parses the flags and returns the limits of the load, and the
+// workload.
+func setup() (limits, *workload) {
+	flag.Parse()
+	if *vverbose {
+		*verbose = true
 	}
-	q := fmt.Sprintf("http://%s/add?k=%s&v=%v", *addr, k, v)
-	r, err := http.NewRequest("GET", q, nil)
+	if *output != "text" {
+		info = os.Stderr
+	}
+
+	dur, err := time.ParseDuration(*sdur)
 	if err != nil {
-		panic(err)
+		panic(fmt.Sprint("dur:", err))
 	}
-	return r
+	lim := limits{dur: dur, count: *count}
+	if lim.dur <= 0 && lim.count <= 0 {
+		panic("dur or n must be positive")
+	}
+	if *rate < 0 {
+		panic("rate must not be negative")
+	}
+	switch *output {
+	case "text", "json", "csv":
+	default:
+		panic(fmt.Sprintf("unknown output format %q", *output))
+	}
+	if *nworkers <= 0 {
+		panic("workers must be positive")
+	}
+	httpClient = &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: *nworkers,
+	}}
+
+	size, err := parseSizeDist(*valueSize)
+	if err != nil {
+		panic(fmt.Sprint("value-size:", err))
+	}
+	w := &workload{
+		reads:    *reads,
+		keys:     *keys,
+		dist:     *dist,
+		zipfSkew: *zipfSkew,
+		hotKeys:  *hotKeys,
+		hotOps:   *hotOps,
+		size:     size,
+	}
+	if err := w.validate(); err != nil {
+		panic(fmt.Sprint("workload:", err))
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	return lim, w
 }
 
-func randomGet() *http.Request {
-	var k string
-	rnd := rand.Intn(100)
-	if rnd < 32 {
-		k = keys[rnd%len(keys)]
-	} else {
-		k = "key-" + randomString(1)
+// request returns the next request generated by g.
+func request(g *generator) *http.Request {
+	var (
+		r   *http.Request
+		err error
+	)
+	switch op, k, v := g.next(); op {
+	case "get":
+		r, err = client.GetRequest(*addr, k)
+	default:
+		r, err = client.AddRequest(*addr, k, v)
 	}
-	q := fmt.Sprintf("http://%s/get?k=%s", *addr, k)
-	r, err := http.NewRequest("GET", q, nil)
 	if err != nil {
 		panic(err)
 	}
 	return r
 }
 
-func randomRequest() *http.Request {
-	rnd := rand.Intn(100)
-	if rnd < 50 {
-		return randomGet()
-	}
-	return randomAdd()
+// A budget limits the number of requests sent.
+type budget struct {
+	limited bool
+	left    int64
 }
 
-func setup() time.Duration {
-	flag.Parse()
+// newBudget returns a budget of n requests, 0 meaning no limit.
+func newBudget(n int64) *budget {
+	return &budget{limited: n > 0, left: n}
+}
+
+// take reports whether a request can be sent, and counts it.
+func (b *budget) take() bool {
+	return !b.limited || atomic.AddInt64(&b.left, -1) >= 0
+}
+
+// A worker sends requests, one at a time, and counts them.
+type worker struct {
+	g        *generator
+	ops      map[string]*opStats
+	requests int
+	maxLag   time.Duration // largest delay of a request after its intended send time
+	sumLag   time.Duration
+}
+
+func newWorker(g *generator) *worker {
+	return &worker{g: g, ops: make(map[string]*opStats)}
+}
+
+// send sends the next request, intended to be sent at intended: its latency
+// is measured from that time, so that the time it waited for the worker, when
+// the server is slower than the schedule, counts.
+func (wk *worker) send(intended time.Time) {
+	req := request(wk.g)
+	client.Authorize(req, *token)
 	if *vverbose {
-		*verbose = true
+		fmt.Fprintln(info, "request:", req.URL.String())
 	}
+	op := strings.TrimPrefix(req.URL.Path, "/")
 
-	dur, err := time.ParseDuration(*sdur)
-	if err != nil {
-		panic(fmt.Sprint("dur:", err))
+	lag := time.Since(intended)
+	if lag > wk.maxLag {
+		wk.maxLag = lag
 	}
+	wk.sumLag += lag
 
-	rand.Seed(time.Now().UnixNano())
+	stats := wk.ops[op]
+	if stats == nil {
+		stats = newOpStats()
+		wk.ops[op] = stats
+	}
 
-	m.Store("hello", "golab")
-	m.Store("language", "Go")
-	m.Store("version", "1.13")
-	m.Store("topic", "monitoring")
-	m.Store("pi", fmt.Sprint(math.Pi))
-	m.Store("tsdb", "prometheus")
-	m.Store("year", "2019")
-	m.Store("month", "october")
+	resp, err := httpClient.Do(req)
+	var buf []byte
+	if err == nil {
+		buf, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	latency := time.Since(intended)
+	wk.requests++
+	stats.latency.record(latency)
+	requestDuration.WithLabelValues(op).Observe(latency.Seconds())
+	if err != nil {
+		requests.WithLabelValues(op, "error").Inc()
+		stats.transport[errorClass(err)]++
+		if *verbose {
+			fmt.Fprintln(info, "request error:", err)
+		}
+		return
+	}
+	requests.WithLabelValues(op, strconv.Itoa(resp.StatusCode)).Inc()
+	stats.status[resp.StatusCode]++
+	if *verbose && len(buf) != 0 {
+		fmt.Fprintln(info, req.URL.String(), "responded", string(buf))
+	}
+}
 
-	m.Range(func(k, v interface{}) bool {
-		keys = append(keys, k.(string))
-		return true
-	})
-	if len(keys) != 8 {
-		panic("should remain 8 or bad stuff will happen!")
+// closedLoop sends requests one after the other, waiting 50 to 70ms between
+// a response and the next request, until stop is closed or the budget is
+// exhausted. A slow server thus lowers the rate of requests.
+func (wk *worker) closedLoop(stop <-chan struct{}, b *budget) {
+	for {
+		pause := time.NewTimer(time.Duration((wk.g.rnd.Intn(20) + 50)) * time.Millisecond)
+		select {
+		case <-stop:
+			pause.Stop()
+			return
+		case <-pause.C:
+		}
+		if !b.take() {
+			return
+		}
+		wk.send(time.Now())
 	}
-	return dur
 }
 
 func main() {
-	dur := setup()
+	lim, w := setup()
+	stopPush := startPush()
+	fmt.Fprintf(info, "workload: %v, seed %d\n", w, *seed)
 
-	ncpu := runtime.NumCPU()
-	totalRequests := make([]int, ncpu)
-	totalErrors := make([]int, ncpu)
+	stop := make(chan struct{})
+	if lim.dur > 0 {
+		time.AfterFunc(lim.dur, func() { close(stop) })
+	}
+	b := newBudget(lim.count)
+
+	workers := make([]*worker, *nworkers)
+	for p := range workers {
+		workers[p] = newWorker(w.newGenerator(*seed + int64(p)))
+	}
 
+	start := time.Now()
+	var scheduled int64
 	wg := sync.WaitGroup{}
-	wg.Add(ncpu)
-	for p := 0; p < ncpu; p++ {
-		p := p
-		go func() {
-			defer wg.Done()
-			deadline := time.NewTimer(dur)
-			for {
-				timer := time.NewTicker(time.Duration((rand.Intn(20) + 50)) * time.Millisecond)
-				select {
-				case <-deadline.C:
-					return
-				case <-timer.C:
-				}
-				req := randomRequest()
-				if *vverbose {
-					fmt.Println("request:", req.URL.String())
-				}
-				resp, err := http.DefaultClient.Do(req)
-				totalRequests[p]++
-				if err != nil {
-					totalErrors[p]++
-					if *verbose {
-						fmt.Println("request error:", err)
-					}
-					continue
-				}
-				buf, _ := ioutil.ReadAll(resp.Body)
-				if *verbose && len(buf) != 0 {
-					fmt.Println(req.URL.String(), "responded", string(buf))
-				}
-				resp.Body.Close()
-			}
-		}()
+	wg.Add(len(workers))
+	if *rate > 0 {
+		sched := make(chan time.Time)
+		for _, wk := range workers {
+			go func(wk *worker) {
+				defer wg.Done()
+				wk.openLoop(sched)
+			}(wk)
+		}
+		scheduled = schedule(*rate, sched, stop, b)
+	} else {
+		for _, wk := range workers {
+			go func(wk *worker) {
+				defer wg.Done()
+				wk.closedLoop(stop, b)
+			}(wk)
+		}
 	}
 	wg.Wait()
+	elapsed := time.Since(start)
+	stopPush()
 
-	nrequests, nerrors := 0, 0
-	for _, v := range totalErrors {
-		nerrors += v
+	if err := newReport(workers, elapsed, scheduled).write(os.Stdout, *output); err != nil {
+		log.Fatal(err)
 	}
-	for _, v := range totalRequests {
-		nrequests += v
-	}
-
-	fmt.Println("-----------")
-	fmt.Printf("requests %v\n", nrequests)
-	fmt.Printf("errors   %v\t%.01f%%\n", nerrors, float64(nerrors)/float64(nrequests))
 }
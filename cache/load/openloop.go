@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+// schedule sends on sched the intended send times of requests at rate per
+// second, until stop is closed or the budget is exhausted, then closes sched.
+//
+// The intended times only depend on the rate: when no worker is available,
+// because the server is slower than the schedule, the requests sent late keep
+// their intended time, so that their latency includes the time they waited.
+// Otherwise, as with closed loop load generators, slow responses would lower
+// the rate, and be measured as if they had happened once instead of delaying
+// every request after them (coordinated omission).
+//
+// It returns the number of requests scheduled, i.e. which intended send time
+// came within the budget, including those no worker took before stop was
+// closed, the server being too slow.
+func schedule(rate float64, sched chan<- time.Time, stop <-chan struct{}, b *budget) int64 {
+	defer close(sched)
+	interval := time.Duration(float64(time.Second) / rate)
+	start := time.Now()
+	for i := int64(0); ; i++ {
+		intended := start.Add(time.Duration(i) * interval)
+		if d := time.Until(intended); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-stop:
+				timer.Stop()
+				return i
+			case <-timer.C:
+			}
+		}
+		if !b.take() {
+			return i
+		}
+		select {
+		case <-stop:
+			// The requests due while waiting for a worker weren't sent
+			// either.
+			n := i + 1
+			for now := time.Now(); !start.Add(time.Duration(n)*interval).After(now) && b.take(); n++ {
+			}
+			return n
+		case sched <- intended:
+		}
+	}
+}
+
+// openLoop sends the requests scheduled on sched, until it's closed.
+func (wk *worker) openLoop(sched <-chan time.Time) {
+	for intended := range sched {
+		scheduleLag.Observe(time.Since(intended).Seconds())
+		wk.send(intended)
+	}
+}
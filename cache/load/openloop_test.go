@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleCount(t *testing.T) {
+	sched := make(chan time.Time)
+	go schedule(1000, sched, make(chan struct{}), newBudget(20))
+
+	var times []time.Time
+	for intended := range sched {
+		times = append(times, intended)
+	}
+	if len(times) != 20 {
+		t.Fatalf("%d requests scheduled, want 20", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d != time.Millisecond {
+			t.Errorf("request %d scheduled %v after the previous one, want 1ms", i, d)
+		}
+	}
+}
+
+func TestScheduleSlowWorker(t *testing.T) {
+	sched := make(chan time.Time)
+	stop := make(chan struct{})
+	go schedule(1000, sched, stop, newBudget(0))
+
+	// A worker blocked for 20ms doesn't delay the schedule: the requests
+	// it then receives are late.
+	first := <-sched
+	time.Sleep(20 * time.Millisecond)
+	second := <-sched
+	if d := second.Sub(first); d != time.Millisecond {
+		t.Errorf("second request scheduled %v after the first, want 1ms", d)
+	}
+	if lag := time.Since(second); lag < 15*time.Millisecond {
+		t.Errorf("second request lag = %v, want at least 15ms", lag)
+	}
+	close(stop)
+	for range sched {
+	}
+}
+
+func TestScheduleUnsent(t *testing.T) {
+	sched := make(chan time.Time)
+	stop := make(chan struct{})
+	n := make(chan int64)
+	go func() { n <- schedule(1000, sched, stop, newBudget(0)) }()
+
+	// No worker takes the requests due after the first one, they are still
+	// counted as scheduled.
+	<-sched
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	if scheduled := <-n; scheduled < 20 || scheduled > 100 {
+		t.Errorf("%d requests scheduled in 20ms at 1000/s, want about 20", scheduled)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := newBudget(2)
+	if !b.take() || !b.take() || b.take() || b.take() {
+		t.Errorf("a budget of 2 should allow exactly 2 requests")
+	}
+	unlimited := newBudget(0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.take() {
+			t.Fatalf("an unlimited budget refused request %d", i)
+		}
+	}
+}
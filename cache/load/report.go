@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// opStats are the statistics, as observed by load, of the requests of an
+// operation.
+type opStats struct {
+	latency   hdrHistogram
+	status    map[int]int    // responses, by status code
+	transport map[string]int // transport errors, by class
+}
+
+func newOpStats() *opStats {
+	return &opStats{status: make(map[int]int), transport: make(map[string]int)}
+}
+
+func (s *opStats) merge(o *opStats) {
+	s.latency.merge(&o.latency)
+	for code, n := range o.status {
+		s.status[code] += n
+	}
+	for class, n := range o.transport {
+		s.transport[class] += n
+	}
+}
+
+// errorClass returns the class of a transport error, for the report.
+func errorClass(err error) string {
+	var (
+		dnsErr  *net.DNSError
+		netErr  net.Error
+		certErr x509.UnknownAuthorityError
+		hostErr x509.HostnameError
+		invErr  x509.CertificateInvalidError
+		recErr  tls.RecordHeaderError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection closed"
+	case errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &invErr), errors.As(err, &recErr):
+		return "tls"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// A report sums up the load, as observed by load.
+type report struct {
+	Duration   float64 `json:"duration_seconds"`
+	Requests   int     `json:"requests"`
+	Errors     int     `json:"errors"`      // transport errors and non-2xx responses
+	ErrorRatio float64 `json:"error_ratio"` // errors over requests
+	Throughput float64 `json:"throughput"`  // requests per second
+	TargetRate float64 `json:"target_rate,omitempty"`
+	Scheduled  int     `json:"scheduled,omitempty"` // with a target rate, requests which send time came
+	Unsent     int     `json:"unsent,omitempty"`    // scheduled requests no worker could send in time
+	MaxLag     float64 `json:"max_lag_seconds,omitempty"`
+	MeanLag    float64 `json:"mean_lag_seconds,omitempty"`
+
+	// Hits and misses are the gets which responded 200 and 204.
+	Hits     int     `json:"hits"`
+	Misses   int     `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+
+	Status          map[string]int `json:"status"`           // responses, by status code
+	TransportErrors map[string]int `json:"transport_errors"` // by class
+
+	Ops []opReport `json:"ops"` // by operation, then all of them
+}
+
+// An opReport sums up the requests of an operation, "all" for all of them.
+type opReport struct {
+	Op         string  `json:"op"`
+	Requests   int     `json:"requests"`
+	Errors     int     `json:"errors"`
+	Throughput float64 `json:"throughput"`
+	Mean       float64 `json:"mean_seconds"`
+	P50        float64 `json:"p50_seconds"`
+	P90        float64 `json:"p90_seconds"`
+	P99        float64 `json:"p99_seconds"`
+	P999       float64 `json:"p99_9_seconds"`
+	Max        float64 `json:"max_seconds"`
+}
+
+// ratio returns n/d, or 0 if d is 0.
+func ratio(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+// newReport sums up the statistics of the workers, which loaded the server
+// for elapsed, scheduled requests being scheduled with a target rate.
+func newReport(workers []*worker, elapsed time.Duration, scheduled int64) *report {
+	ops := make(map[string]*opStats)
+	all := newOpStats()
+	var (
+		maxLag, sumLag time.Duration
+		nrequests      int
+	)
+	for _, wk := range workers {
+		for op, s := range wk.ops {
+			if ops[op] == nil {
+				ops[op] = newOpStats()
+			}
+			ops[op].merge(s)
+			all.merge(s)
+		}
+		if wk.maxLag > maxLag {
+			maxLag = wk.maxLag
+		}
+		sumLag += wk.sumLag
+		nrequests += wk.requests
+	}
+
+	r := &report{
+		Duration:        elapsed.Seconds(),
+		Status:          make(map[string]int),
+		TransportErrors: all.transport,
+	}
+	if *rate > 0 {
+		r.TargetRate = *rate
+		r.Scheduled = int(scheduled)
+		r.Unsent = r.Scheduled - nrequests
+	}
+	if *rate > 0 && nrequests > 0 {
+		r.MaxLag = maxLag.Seconds()
+		r.MeanLag = (sumLag / time.Duration(nrequests)).Seconds()
+	}
+	for code, n := range all.status {
+		r.Status[strconv.Itoa(code)] = n
+	}
+	if get := ops["get"]; get != nil {
+		r.Hits, r.Misses = get.status[http.StatusOK], get.status[http.StatusNoContent]
+		r.HitRatio = ratio(r.Hits, r.Hits+r.Misses)
+	}
+
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+	for _, op := range names {
+		r.Ops = append(r.Ops, ops[op].report(op, elapsed))
+	}
+	total := all.report("all", elapsed)
+	r.Ops = append(r.Ops, total)
+	r.Requests, r.Errors, r.Throughput = total.Requests, total.Errors, total.Throughput
+	r.ErrorRatio = ratio(r.Errors, r.Requests)
+	return r
+}
+
+func (s *opStats) report(op string, elapsed time.Duration) opReport {
+	r := opReport{
+		Op:       op,
+		Requests: int(s.latency.total),
+		Mean:     s.latency.mean().Seconds(),
+		P50:      s.latency.quantile(0.5).Seconds(),
+		P90:      s.latency.quantile(0.9).Seconds(),
+		P99:      s.latency.quantile(0.99).Seconds(),
+		P999:     s.latency.quantile(0.999).Seconds(),
+		Max:      s.latency.max.Seconds(),
+	}
+	for code, n := range s.status {
+		if code < 200 || code > 299 {
+			r.Errors += n
+		}
+	}
+	for _, n := range s.transport {
+		r.Errors += n
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(r.Requests) / elapsed.Seconds()
+	}
+	return r
+}
+
+// write writes the report to w in format: text, json or csv.
+func (r *report) write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "csv":
+		return r.writeCSV(w)
+	}
+	return r.writeText(w)
+}
+
+// sortedKeys returns the keys of m, sorted.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *report) writeText(w io.Writer) error {
+	sec := func(v float64) time.Duration {
+		return time.Duration(v * float64(time.Second)).Round(time.Microsecond)
+	}
+	fmt.Fprintln(w, "-----------")
+	fmt.Fprintf(w, "requests   %v in %v, %.1f/s\n", r.Requests, sec(r.Duration).Round(time.Millisecond), r.Throughput)
+	if r.TargetRate > 0 {
+		fmt.Fprintf(w, "target     %v/s, lag max %v, mean %v\n", r.TargetRate, sec(r.MaxLag), sec(r.MeanLag))
+		fmt.Fprintf(w, "scheduled  %v, %v unsent\n", r.Scheduled, r.Unsent)
+	}
+	fmt.Fprintf(w, "errors     %v\t%.01f%%\n", r.Errors, 100*r.ErrorRatio)
+	fmt.Fprintf(w, "hit ratio  %.01f%% (%d hits, %d misses)\n", 100*r.HitRatio, r.Hits, r.Misses)
+	for _, code := range sortedKeys(r.Status) {
+		fmt.Fprintf(w, "status %s %v\n", code, r.Status[code])
+	}
+	for _, class := range sortedKeys(r.TransportErrors) {
+		fmt.Fprintf(w, "transport error %q %v\n", class, r.TransportErrors[class])
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\trequests\terrors\treq/s\tmean\tp50\tp90\tp99\tp99.9\tmax\t")
+	for _, op := range r.Ops {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\t%v\t%v\t\n", op.Op, op.Requests, op.Errors, op.Throughput,
+			sec(op.Mean), sec(op.P50), sec(op.P90), sec(op.P99), sec(op.P999), sec(op.Max))
+	}
+	return tw.Flush()
+}
+
+// writeCSV writes a row per operation, then one for all of them, which alone
+// has the scheduled and unsent requests with a target rate. The status codes
+// and transport errors breakdowns are only in the text and JSON reports.
+func (r *report) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"op", "requests", "errors", "error_ratio", "throughput", "hit_ratio",
+		"mean_seconds", "p50_seconds", "p90_seconds", "p99_seconds", "p99_9_seconds", "max_seconds", "scheduled", "unsent"})
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	for _, op := range r.Ops {
+		hitRatio, scheduled, unsent := "", "", ""
+		if op.Op == "get" || op.Op == "all" {
+			hitRatio = f(r.HitRatio)
+		}
+		if op.Op == "all" && r.TargetRate > 0 {
+			scheduled, unsent = strconv.Itoa(r.Scheduled), strconv.Itoa(r.Unsent)
+		}
+		cw.Write([]string{op.Op, strconv.Itoa(op.Requests), strconv.Itoa(op.Errors), f(ratio(op.Errors, op.Requests)),
+			f(op.Throughput), hitRatio, f(op.Mean), f(op.P50), f(op.P90), f(op.P99), f(op.P999), f(op.Max), scheduled, unsent})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.DeadlineExceeded, "timeout"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection refused"},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "connection reset"},
+		{&net.DNSError{Err: "no such host", Name: "cache"}, "dns"},
+		{fmt.Errorf("get: %w", io.EOF), "connection closed"},
+		{errors.New("boom"), "other"},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("errorClass(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// testWorkers returns workers which got 3 hits, a miss, a 429 and a
+// transport error for gets, and 2 adds.
+func testWorkers() []*worker {
+	w1, w2 := newWorker(nil), newWorker(nil)
+	get, add := newOpStats(), newOpStats()
+	for i := 1; i <= 6; i++ {
+		get.latency.record(time.Duration(i) * time.Millisecond)
+	}
+	get.status[http.StatusOK] = 3
+	get.status[http.StatusNoContent] = 1
+	get.status[http.StatusTooManyRequests] = 1
+	get.transport["timeout"] = 1
+	w1.ops["get"] = get
+	w1.requests = 6
+
+	add.latency.record(time.Millisecond)
+	add.latency.record(time.Millisecond)
+	add.status[http.StatusOK] = 2
+	w2.ops["add"] = add
+	w2.requests = 2
+	return []*worker{w1, w2}
+}
+
+func TestReport(t *testing.T) {
+	r := newReport(testWorkers(), 2*time.Second, 0)
+
+	if r.Requests != 8 || r.Errors != 2 || r.ErrorRatio != 0.25 || r.Throughput != 4 {
+		t.Errorf("requests, errors, error ratio, throughput = %d, %d, %v, %v, want 8, 2, 0.25, 4", r.Requests, r.Errors, r.ErrorRatio, r.Throughput)
+	}
+	if r.Hits != 3 || r.Misses != 1 || r.HitRatio != 0.75 {
+		t.Errorf("hits, misses, hit ratio = %d, %d, %v, want 3, 1, 0.75", r.Hits, r.Misses, r.HitRatio)
+	}
+	if r.Status["200"] != 5 || r.Status["429"] != 1 || r.TransportErrors["timeout"] != 1 {
+		t.Errorf("status = %v, transport errors = %v", r.Status, r.TransportErrors)
+	}
+	if len(r.Ops) != 3 || r.Ops[0].Op != "add" || r.Ops[1].Op != "get" || r.Ops[2].Op != "all" {
+		t.Fatalf("ops = %+v, want add, get and all", r.Ops)
+	}
+	if get := r.Ops[1]; get.Requests != 6 || get.Errors != 2 || get.Max != 0.006 {
+		t.Errorf("get = %+v", get)
+	}
+
+	var buf bytes.Buffer
+	if err := r.write(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Errors != 2 || len(decoded.Ops) != 3 {
+		t.Errorf("decoded JSON report = %+v", decoded)
+	}
+
+	buf.Reset()
+	if err := r.write(&buf, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || rows[0][0] != "op" || rows[3][0] != "all" || rows[3][1] != "8" || rows[3][3] != "0.25" {
+		t.Errorf("CSV report = %v", rows)
+	}
+
+	buf.Reset()
+	if err := r.write(&buf, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("errors     2\t25.0%")) {
+		t.Errorf("text report:\n%s", buf.String())
+	}
+}
+
+func TestReportUnsent(t *testing.T) {
+	defer func(old float64) { *rate = old }(*rate)
+	*rate = 5
+	r := newReport(testWorkers(), 2*time.Second, 10)
+	if r.TargetRate != 5 || r.Scheduled != 10 || r.Unsent != 2 {
+		t.Errorf("target rate, scheduled, unsent = %v, %d, %d, want 5, 10, 2", r.TargetRate, r.Scheduled, r.Unsent)
+	}
+
+	var buf bytes.Buffer
+	if err := r.write(&buf, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("scheduled  10, 2 unsent")) {
+		t.Errorf("text report:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := r.write(&buf, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := rows[len(rows)-1]; last[0] != "all" || last[12] != "10" || last[13] != "2" || rows[1][12] != "" {
+		t.Errorf("CSV report = %v", rows)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Key distributions.
+const (
+	distUniform    = "uniform"    // every key is equally likely
+	distZipf       = "zipf"       // the lower the key index, the more likely
+	distHotspot    = "hotspot"    // a fraction of the requests is for a fraction of the keys
+	distSequential = "sequential" // keys are scanned in order, over and over
+	distLatest     = "latest"     // adds write new keys, gets read the most recently written ones
+)
+
+// maxValueSize is the largest value size: values are sent in the query string.
+const maxValueSize = 64 << 10
+
+// A workload describes the requests sent to the cache: which operation, on
+// which key, and the size of the values added.
+type workload struct {
+	reads    float64 // fraction of gets, the others being adds
+	keys     int     // size of the key space
+	dist     string  // key distribution
+	zipfSkew float64 // skew of the zipf and latest distributions, > 1
+	hotKeys  float64 // fraction of the keys which are hot, with hotspot
+	hotOps   float64 // fraction of the requests for the hot keys, with hotspot
+	size     sizeDist
+
+	cursor  uint64 // next key of the sequential distribution
+	written uint64 // number of adds of the latest distribution
+}
+
+// validate checks the workload parameters.
+func (w *workload) validate() error {
+	if w.reads < 0 || w.reads > 1 {
+		return fmt.Errorf("reads: must be within [0, 1], got %v", w.reads)
+	}
+	if w.keys <= 0 {
+		return fmt.Errorf("keys: must be positive, got %d", w.keys)
+	}
+	switch w.dist {
+	case distUniform, distSequential:
+	case distZipf, distLatest:
+		if w.zipfSkew <= 1 {
+			return fmt.Errorf("zipf-skew: must be greater than 1, got %v", w.zipfSkew)
+		}
+	case distHotspot:
+		if w.hotKeys <= 0 || w.hotKeys >= 1 {
+			return fmt.Errorf("hot-keys: must be within ]0, 1[, got %v", w.hotKeys)
+		}
+		if w.hotOps < 0 || w.hotOps > 1 {
+			return fmt.Errorf("hot-ops: must be within [0, 1], got %v", w.hotOps)
+		}
+	default:
+		return fmt.Errorf("unknown key distribution %q", w.dist)
+	}
+	return nil
+}
+
+func (w *workload) String() string {
+	dist := w.dist
+	switch w.dist {
+	case distZipf, distLatest:
+		dist += fmt.Sprintf(" (skew %v)", w.zipfSkew)
+	case distHotspot:
+		dist += fmt.Sprintf(" (%.0f%% of the requests for %.0f%% of the keys)", 100*w.hotOps, 100*w.hotKeys)
+	}
+	return fmt.Sprintf("%.0f%% gets, %d keys %s, values of %v bytes", 100*w.reads, w.keys, dist, w.size)
+}
+
+// A generator generates the requests of a workload. Unlike the workload,
+// which may be shared, it must only be used by a single goroutine.
+type generator struct {
+	w    *workload
+	rnd  *rand.Rand
+	zipf *rand.Zipf
+}
+
+// newGenerator returns a generator of the requests of w, seeded with seed.
+func (w *workload) newGenerator(seed int64) *generator {
+	g := &generator{w: w, rnd: rand.New(rand.NewSource(seed))}
+	if w.dist == distZipf || w.dist == distLatest {
+		g.zipf = rand.NewZipf(g.rnd, w.zipfSkew, 1, uint64(w.keys-1))
+	}
+	return g
+}
+
+// next returns the operation, "get" or "add", and the key of the next
+// request. value is empty for gets.
+func (g *generator) next() (op, key, value string) {
+	if g.rnd.Float64() < g.w.reads {
+		return "get", "key-" + strconv.Itoa(g.key(false)), ""
+	}
+	return "add", "key-" + strconv.Itoa(g.key(true)), g.value(g.w.size.sample(g.rnd))
+}
+
+// key returns the index of the key of the next get or add.
+func (g *generator) key(add bool) int {
+	w := g.w
+	n := uint64(w.keys)
+	switch w.dist {
+	case distZipf:
+		return int(g.zipf.Uint64())
+	case distHotspot:
+		hot := int(w.hotKeys * float64(w.keys))
+		if hot == 0 {
+			hot = 1
+		}
+		if g.rnd.Float64() < w.hotOps || hot == w.keys {
+			return g.rnd.Intn(hot)
+		}
+		return hot + g.rnd.Intn(w.keys-hot)
+	case distSequential:
+		return int((atomic.AddUint64(&w.cursor, 1) - 1) % n)
+	case distLatest:
+		if add {
+			return int((atomic.AddUint64(&w.written, 1) - 1) % n)
+		}
+		written := atomic.LoadUint64(&w.written)
+		if written == 0 {
+			return g.rnd.Intn(w.keys)
+		}
+		// The most recently written key is the most likely, then the
+		// previous one, and so on.
+		return int((written - 1 + n - g.zipf.Uint64()%n) % n)
+	}
+	return g.rnd.Intn(w.keys)
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyz"
+
+// value returns a random value of n bytes.
+func (g *generator) value(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[g.rnd.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// A sizeDist is a distribution of value sizes.
+type sizeDist struct {
+	kind     string // "fixed", "uniform" or "exp"
+	min, max int    // min is the size, or the mean, for fixed and exp
+}
+
+// parseSizeDist parses a value size distribution: N for a fixed size,
+// MIN-MAX for sizes uniformly distributed in [MIN, MAX], or exp:MEAN for
+// exponentially distributed sizes, most values being small but a few large.
+func parseSizeDist(s string) (sizeDist, error) {
+	check := func(n int, err error) (int, error) {
+		if err != nil {
+			return 0, fmt.Errorf("invalid value size %q", s)
+		}
+		if n < 0 || n > maxValueSize {
+			return 0, fmt.Errorf("value size %d: must be within [0, %d]", n, maxValueSize)
+		}
+		return n, nil
+	}
+	if strings.HasPrefix(s, "exp:") {
+		mean, err := check(strconv.Atoi(strings.TrimPrefix(s, "exp:")))
+		if err != nil {
+			return sizeDist{}, err
+		}
+		if mean == 0 {
+			return sizeDist{}, fmt.Errorf("value size %q: mean must be positive", s)
+		}
+		return sizeDist{kind: "exp", min: mean, max: maxValueSize}, nil
+	}
+	if i := strings.Index(s, "-"); i > 0 {
+		min, err := check(strconv.Atoi(s[:i]))
+		if err != nil {
+			return sizeDist{}, err
+		}
+		max, err := check(strconv.Atoi(s[i+1:]))
+		if err != nil {
+			return sizeDist{}, err
+		}
+		if max < min {
+			return sizeDist{}, fmt.Errorf("value size %q: max is lower than min", s)
+		}
+		return sizeDist{kind: "uniform", min: min, max: max}, nil
+	}
+	n, err := check(strconv.Atoi(s))
+	if err != nil {
+		return sizeDist{}, err
+	}
+	return sizeDist{kind: "fixed", min: n, max: n}, nil
+}
+
+// sample returns a value size.
+func (d sizeDist) sample(rnd *rand.Rand) int {
+	switch d.kind {
+	case "uniform":
+		return d.min + rnd.Intn(d.max-d.min+1)
+	case "exp":
+		return int(math.Min(rnd.ExpFloat64()*float64(d.min), float64(d.max)))
+	}
+	return d.min
+}
+
+func (d sizeDist) String() string {
+	switch d.kind {
+	case "uniform":
+		return fmt.Sprintf("%d-%d", d.min, d.max)
+	case "exp":
+		return fmt.Sprintf("exp:%d", d.min)
+	}
+	return strconv.Itoa(d.min)
+}
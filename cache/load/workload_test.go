@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// keyIndex returns the index of key-N.
+func keyIndex(t *testing.T, key string) int {
+	i, err := strconv.Atoi(strings.TrimPrefix(key, "key-"))
+	if err != nil {
+		t.Fatalf("invalid key %q", key)
+	}
+	return i
+}
+
+// run generates n requests of w, returning the number of gets and how many
+// requests were for each key.
+func run(t *testing.T, w *workload, n int) (gets int, counts []int) {
+	if err := w.validate(); err != nil {
+		t.Fatal(err)
+	}
+	g := w.newGenerator(1)
+	counts = make([]int, w.keys)
+	for i := 0; i < n; i++ {
+		op, k, _ := g.next()
+		if op == "get" {
+			gets++
+		}
+		counts[keyIndex(t, k)]++
+	}
+	return gets, counts
+}
+
+func TestWorkloadReads(t *testing.T) {
+	w := &workload{reads: 0.9, keys: 10, dist: distUniform, size: sizeDist{kind: "fixed", min: 8, max: 8}}
+	gets, counts := run(t, w, 10000)
+	if gets < 8800 || gets > 9200 {
+		t.Errorf("%d gets out of 10000, want about 9000", gets)
+	}
+	for i, c := range counts {
+		if c < 800 || c > 1200 {
+			t.Errorf("key-%d requested %d times, want about 1000", i, c)
+		}
+	}
+}
+
+func TestWorkloadZipf(t *testing.T) {
+	w := &workload{reads: 1, keys: 100, dist: distZipf, zipfSkew: 1.5}
+	_, counts := run(t, w, 10000)
+	if counts[0] <= counts[1] || counts[1] <= counts[10] || counts[10] <= counts[99] {
+		t.Errorf("counts of keys 0, 1, 10 and 99 = %d, %d, %d, %d, want decreasing", counts[0], counts[1], counts[10], counts[99])
+	}
+}
+
+func TestWorkloadHotspot(t *testing.T) {
+	w := &workload{reads: 1, keys: 100, dist: distHotspot, hotKeys: 0.1, hotOps: 0.9}
+	_, counts := run(t, w, 10000)
+	hot := 0
+	for _, c := range counts[:10] {
+		hot += c
+	}
+	if hot < 8800 || hot > 9200 {
+		t.Errorf("%d requests for the hot keys out of 10000, want about 9000", hot)
+	}
+}
+
+func TestWorkloadSequential(t *testing.T) {
+	w := &workload{reads: 0.5, keys: 3, dist: distSequential, size: sizeDist{kind: "fixed"}}
+	g := w.newGenerator(1)
+	for i := 0; i < 7; i++ {
+		if _, k, _ := g.next(); keyIndex(t, k) != i%3 {
+			t.Fatalf("request %d for %s, want key-%d", i, k, i%3)
+		}
+	}
+}
+
+func TestWorkloadLatest(t *testing.T) {
+	w := &workload{reads: 0, keys: 1000, dist: distLatest, zipfSkew: 2, size: sizeDist{kind: "fixed"}}
+	g := w.newGenerator(1)
+	for i := 0; i < 1500; i++ {
+		if _, k, _ := g.next(); keyIndex(t, k) != i%1000 {
+			t.Fatalf("add %d of %s, want key-%d", i, k, i%1000)
+		}
+	}
+
+	// Reads are for the latest written keys: 499, 498...
+	w.reads = 1
+	recent := 0
+	for i := 0; i < 1000; i++ {
+		_, k, _ := g.next()
+		if i := keyIndex(t, k); i > 489 && i <= 499 {
+			recent++
+		}
+	}
+	if recent < 900 {
+		t.Errorf("%d gets of the 10 latest keys out of 1000, want most", recent)
+	}
+}
+
+func TestWorkloadValidate(t *testing.T) {
+	valid := workload{reads: 0.5, keys: 10, dist: distUniform, zipfSkew: 1.1, hotKeys: 0.2, hotOps: 0.8}
+	tests := []func(w *workload){
+		func(w *workload) { w.reads = 1.5 },
+		func(w *workload) { w.keys = 0 },
+		func(w *workload) { w.dist = "gaussian" },
+		func(w *workload) { w.dist, w.zipfSkew = distZipf, 1 },
+		func(w *workload) { w.dist, w.hotKeys = distHotspot, 1 },
+		func(w *workload) { w.dist, w.hotOps = distHotspot, -0.1 },
+	}
+	if err := valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i, change := range tests {
+		w := valid
+		change(&w)
+		if err := w.validate(); err == nil {
+			t.Errorf("test %d: workload %v should be invalid", i, &w)
+		}
+	}
+}
+
+func TestParseSizeDist(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		s        string
+		min, max int
+	}{
+		{"16", 16, 16},
+		{"0", 0, 0},
+		{"10-20", 10, 20},
+		{"exp:100", 0, maxValueSize},
+	}
+	for _, tt := range tests {
+		d, err := parseSizeDist(tt.s)
+		if err != nil {
+			t.Errorf("parseSizeDist(%q): %v", tt.s, err)
+			continue
+		}
+		if d.String() != tt.s {
+			t.Errorf("parseSizeDist(%q).String() = %q", tt.s, d.String())
+		}
+		for i := 0; i < 1000; i++ {
+			if n := d.sample(rnd); n < tt.min || n > tt.max {
+				t.Fatalf("%s: sampled size %d not within [%d, %d]", tt.s, n, tt.min, tt.max)
+			}
+		}
+	}
+
+	for _, s := range []string{"", "big", "-1", "20-10", "exp:0", "1-x", "100000"} {
+		if _, err := parseSizeDist(s); err == nil {
+			t.Errorf("parseSizeDist(%q) should fail", s)
+		}
+	}
+}
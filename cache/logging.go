@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/arl/golab-2019/tracing"
+)
+
+// newLogger returns a logger writing JSON lines to w, at level and above, and
+// counting the lines written by level.
+func newLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	return slog.New(countingHandler{h})
+}
+
+// countingHandler is a slog.Handler counting the records it handles.
+type countingHandler struct {
+	slog.Handler
+}
+
+func (h countingHandler) Handle(ctx context.Context, r slog.Record) error {
+	logLines.WithLabelValues(strings.ToLower(r.Level.String())).Inc()
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h countingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return countingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h countingHandler) WithGroup(name string) slog.Handler {
+	return countingHandler{h.Handler.WithGroup(name)}
+}
+
+// parseLevel parses a log level name: debug, info, warn or error.
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+// requestIDHeader is the header carrying the request ID.
+const requestIDHeader = "X-Request-ID"
+
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether a request ID received from a client can be
+// propagated: it must be reasonably short and only contain printable ASCII.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestInfo holds information about a request, collected while serving it,
+// to be reported in the access log.
+type requestInfo struct {
+	id    string // request ID
+	cache string // cache lookup result, hit or miss, if any
+}
+
+type ctxKey int
+
+const requestInfoKey ctxKey = 0
+
+// requestInfoFrom returns the request information attached to ctx, or a
+// throwaway one if there's none.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if ri, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return ri
+	}
+	return &requestInfo{}
+}
+
+// statusRecorder records the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// An accessLogger logs a line per request served.
+type accessLogger struct {
+	logger *slog.Logger // if nil, use slog.Default()
+	sample uint64       // fraction of requests logged, math.Float64bits
+}
+
+func newAccessLogger(sampleRate float64) *accessLogger {
+	al := &accessLogger{}
+	al.setSampleRate(sampleRate)
+	return al
+}
+
+// setSampleRate sets the fraction, between 0 and 1, of successful requests
+// that are logged. Server errors are always logged.
+func (al *accessLogger) setSampleRate(rate float64) {
+	atomic.StoreUint64(&al.sample, math.Float64bits(rate))
+}
+
+func (al *accessLogger) sampled(status int) bool {
+	if status >= 500 {
+		return true
+	}
+	rate := math.Float64frombits(atomic.LoadUint64(&al.sample))
+	return rate >= 1 || mrand.Float64() < rate
+}
+
+// handler wraps h so that a request ID is attached to each request, and each
+// served request is logged, under the given route.
+//
+// The request ID is taken from the X-Request-ID header if valid, otherwise
+// generated, and returned in the response X-Request-ID header.
+func (al *accessLogger) handler(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t0 := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ri := &requestInfo{id: id}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, ri))
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if !al.sampled(rec.status) {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", ri.id),
+			slog.String("route", route),
+			slog.String("method", r.Method),
+			slog.Int("status", rec.status),
+			slog.Float64("duration_seconds", time.Since(t0).Seconds()),
+			slog.Int64("bytes", rec.bytes),
+			slog.String("remote", r.RemoteAddr),
+		}
+		if ri.cache != "" {
+			attrs = append(attrs, slog.String("cache", ri.cache))
+		}
+		if sc := tracing.FromContext(r.Context()).SpanContext(); sc.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", sc.TraceID.String()), slog.String("span_id", sc.SpanID.String()))
+		}
+		logger := al.logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+	})
+}
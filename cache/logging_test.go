@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arl/golab-2019/metrics/metricstest"
+	"github.com/arl/golab-2019/tracing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	al := newAccessLogger(1)
+	al.logger = newLogger(&buf, slog.LevelInfo)
+
+	h := al.handler("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestInfoFrom(r.Context()).cache = "hit"
+		w.Write([]byte("value"))
+	}))
+
+	r := httptest.NewRequest("GET", "/get?k=a", nil)
+	r.Header.Set(requestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if id := w.Header().Get(requestIDHeader); id != "abc-123" {
+		t.Errorf("response request ID = %q, want %q", id, "abc-123")
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("access log line is not JSON: %v: %q", err, buf.String())
+	}
+	want := map[string]interface{}{
+		"level":      "INFO",
+		"msg":        "access",
+		"request_id": "abc-123",
+		"route":      "/get",
+		"method":     "GET",
+		"status":     float64(200),
+		"bytes":      float64(5),
+		"cache":      "hit",
+	}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("access log %s = %v, want %v", k, line[k], v)
+		}
+	}
+	if _, ok := line["duration_seconds"]; !ok {
+		t.Errorf("access log has no duration")
+	}
+}
+
+func TestAccessLogRequestID(t *testing.T) {
+	al := newAccessLogger(0)
+	al.logger = newLogger(&bytes.Buffer{}, slog.LevelInfo)
+	h := al.handler("/", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for _, id := range []string{"", "has space", strings.Repeat("x", 200)} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if id != "" {
+			r.Header.Set(requestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		got := w.Header().Get(requestIDHeader)
+		if got == id || len(got) != 32 {
+			t.Errorf("request ID %q: got %q, want a generated one", id, got)
+		}
+	}
+}
+
+func TestAccessLogTraceID(t *testing.T) {
+	var buf bytes.Buffer
+	al := newAccessLogger(1)
+	al.logger = newLogger(&buf, slog.LevelInfo)
+
+	tr := tracing.NewTracer(tracing.NewFileExporter(ioutil.Discard), tracing.Options{SampleRate: 1})
+	defer tr.Close()
+	h := tr.Handler("/", al.handler("/", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(tracing.TraceparentHeader, "00-"+traceID+"-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["trace_id"] != traceID {
+		t.Errorf("access log trace_id = %v, want %s", line["trace_id"], traceID)
+	}
+	if id, _ := line["span_id"].(string); len(id) != 16 || id == "00f067aa0ba902b7" {
+		t.Errorf("access log span_id = %v, want the server span ID", line["span_id"])
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	al := newAccessLogger(0)
+	al.logger = newLogger(&buf, slog.LevelInfo)
+
+	status := http.StatusOK
+	h := al.handler("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if buf.Len() != 0 {
+		t.Errorf("successful request logged with sample rate 0: %q", buf.String())
+	}
+
+	status = http.StatusInternalServerError
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if buf.Len() == 0 {
+		t.Errorf("server errors should always be logged")
+	}
+}
+
+func TestLoggerCountsLines(t *testing.T) {
+	count := func(level string) float64 {
+		return metricstest.Value(logLines.WithLabelValues(level))
+	}
+	warn, debug := count("warn"), count("debug")
+
+	logger := newLogger(&bytes.Buffer{}, slog.LevelInfo)
+	logger.Warn("warning")
+	logger.With("k", "v").Warn("another warning")
+	logger.Debug("not logged")
+
+	if got := count("warn") - warn; got != 2 {
+		t.Errorf("warn lines = %v, want 2", got)
+	}
+	if got := count("debug") - debug; got != 0 {
+		t.Errorf("debug lines = %v, want 0", got)
+	}
+}
@@ -1,27 +1,172 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/arl/golab-2019/alert"
+	"github.com/arl/golab-2019/instrument"
+	"github.com/arl/golab-2019/metrics"
+	"github.com/arl/golab-2019/tracing"
+	"github.com/arl/golab-2019/tsdb"
 )
 
 type server struct {
-	mux   *http.ServeMux
-	cache Cache
+	reg     *prometheus.Registry
+	mux     *http.ServeMux
+	srv     *http.Server
+	cache   Cache
+	metrics *instrument.Metrics
+	health  *health
+	limiter *rateLimiter
+	auth    *auth
+	certs   *certStore      // nil if TLS is disabled
+	tracer  *tracing.Tracer // nil if tracing is disabled
+	flight  *flightRecorder // nil if the flight recorder is disabled
+	prof    *profiler       // nil if continuous profiling is disabled
+	tsdb    *tsdb.DB        // nil if the embedded TSDB is disabled
+	alerts  *alert.Manager  // nil if no alerting rule is enabled
+	slo     *sloTracker
+	guard   *metrics.CardinalityGuard // set by main, even if unlimited or unused by the backend; nil in tests
+
+	logLevel *slog.LevelVar
+	access   *accessLogger
+
+	mu    sync.Mutex // protects cfg and hooks
+	cfg   *config
+	hooks []shutdownHook
+}
+
+// A shutdownHook is a function run once the server has stopped serving.
+type shutdownHook struct {
+	name string
+	f    func() error
+}
+
+// newServer creates a server, registering its metrics with reg, which is
+// served on /metrics. The cache metrics are created with p.
+func newServer(cfg *config, reg *prometheus.Registry, p metrics.Provider) *server {
+	registerMetrics(reg, cfg)
+	initMetrics(p)
+	iopts := instrument.Opts{DurationBuckets: cfg.durationBuckets()}
+	if cfg.MetricsBackend != "prometheus" {
+		// The request metrics are also sent to the other backend, the
+		// Prometheus ones being still needed by the SLOs.
+		iopts.Provider = p
+	}
+	s := &server{
+		reg:     reg,
+		mux:     http.NewServeMux(),
+		cache:   NewLRUCache(cfg.CacheSize),
+		metrics: instrument.New(reg, iopts),
+		slo:     newSLOTracker(cfg),
+		health:  newHealth(cfg.HealthTimeout),
+		limiter: newRateLimiter(cfg.limits()),
+		auth:    newAuth(cfg),
+		access:  newAccessLogger(cfg.AccessSampleRate),
+		cfg:     cfg,
+	}
+	s.logLevel = new(slog.LevelVar)
+	s.logLevel.Set(cfg.LogLevel)
+
+	// A blocked cache lookup means the server is wedged.
+	s.health.register("cache", true, func(context.Context) error {
+		s.cache.Get("")
+		return nil
+	})
+	if len(cfg.Peers) != 0 {
+		s.health.register("peers", false, dialCheck(s.peerTLSConfig, cfg.Peers...))
+	}
+	if cfg.Origin != "" {
+		s.health.register("origin", false, dialCheck(nil, cfg.Origin))
+	}
+
+	s.srv = &http.Server{
+		Addr:           cfg.Addr,
+		Handler:        s.mux,
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	return s
 }
 
-func newServer(csize int) *server {
-	return &server{
-		mux:   http.NewServeMux(),
-		cache: NewLRUCache(csize),
+// useTLS makes the server serve HTTPS with the certificates of cs.
+func (s *server) useTLS(cs *certStore) {
+	s.certs = cs
+	s.srv.TLSConfig = cs.serverConfig()
+}
+
+// peerTLSConfig returns the TLS configuration to connect to the peer at
+// serverName, or nil if TLS is disabled.
+func (s *server) peerTLSConfig(serverName string) *tls.Config {
+	if s.certs == nil {
+		return nil
 	}
+	return s.certs.peerConfig(serverName)
+}
+
+// config returns the current server configuration.
+func (s *server) config() *config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// onShutdown registers f to be run during shutdown, after the in-flight
+// requests have been drained. Hooks are run in registration order.
+func (s *server) onShutdown(name string, f func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, shutdownHook{name: name, f: f})
+}
+
+// reload loads a new configuration with load and applies the settings that
+// can be changed at runtime. Other changed settings are logged as requiring a
+// restart.
+func (s *server) reload(load func() (*config, error)) error {
+	next, err := load()
+	if err != nil {
+		configReloadFailures.Inc()
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cfg, restart := s.cfg.merge(next)
+	for _, key := range restart {
+		slog.Warn("config: setting changed, restart required to apply it", "key", key)
+	}
+
+	if cfg.CacheSize != s.cfg.CacheSize {
+		if c, ok := s.cache.(interface{ Resize(int) }); ok {
+			c.Resize(cfg.CacheSize)
+		}
+	}
+	s.limiter.setLimits(cfg.limits())
+	s.auth.configure(cfg)
+	s.logLevel.Set(cfg.LogLevel)
+	s.access.setSampleRate(cfg.AccessSampleRate)
+	runtime.SetMutexProfileFraction(cfg.MutexProfileFraction)
+	s.cfg = cfg
+	setTimestamp(configLastReload)
+	return nil
 }
 
 func (s *server) handleAdd(w http.ResponseWriter, r *http.Request) {
@@ -32,7 +177,9 @@ func (s *server) handleAdd(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 	}
 
+	_, span := s.tracer.Start(r.Context(), "cache.add", tracing.KindInternal)
 	s.cache.Add(k, v)
+	span.End()
 }
 
 func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
@@ -44,78 +191,365 @@ func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Cache lookup
+	_, span := s.tracer.Start(r.Context(), "cache.get", tracing.KindInternal)
 	v, ok := s.cache.Get(k)
+	ri := requestInfoFrom(r.Context())
 	if !ok {
 		w.WriteHeader(http.StatusNoContent)
 		cacheMisses.Inc()
+		ri.cache = "miss"
 	} else {
 		cacheHits.Inc()
+		ri.cache = "hit"
 	}
+	span.SetAttr("cache.result", ri.cache)
+	span.End()
 
 	fmt.Fprint(w, v)
 }
 
-func (s *server) serve(addr string) error {
-	log.Println("server starting:", addr)
-	return http.ListenAndServe(addr, s.mux)
+// serve accepts connections until the server is shut down, in which case it
+// returns http.ErrServerClosed.
+func (s *server) serve() error {
+	slog.Info("server starting", "addr", s.srv.Addr, "tls", s.certs != nil)
+	if s.certs != nil {
+		return s.srv.ListenAndServeTLS("", "")
+	}
+	return s.srv.ListenAndServe()
 }
 
-func recordMetrics(name string, h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		totalRequests.Inc()
+// shutdown gracefully shuts down the server. It stops accepting connections,
+// waits for in-flight requests to complete, at most for the configured
+// shutdown timeout, and then runs the shutdown hooks.
+func (s *server) shutdown() error {
+	t0 := time.Now()
+	defer func() {
+		shutdownDuration.Set(time.Since(t0).Seconds())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().ShutdownTimeout)
+	defer cancel()
 
-		// Measure taken by the handler h
-		t0 := time.Now()
-		h(w, r)
-		duration := time.Since(t0) / time.Microsecond
-		requestDuration.WithLabelValues(name).Observe(float64(duration))
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		slog.Error("shutdown: draining connections", "err", err)
 	}
-}
 
-// IMPORT
-// 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	// Hooks are run even if draining timed out.
+	s.mu.Lock()
+	hooks := s.hooks
+	s.mu.Unlock()
+	for _, h := range hooks {
+		if herr := h.f(); herr != nil {
+			slog.Error("shutdown: hook failed", "hook", h.name, "err", herr)
+			if err == nil {
+				err = herr
+			}
+		}
+	}
+	return err
+}
 
 func (s *server) setupRoutes() {
-	s.mux.HandleFunc("/add", recordMetrics("add", s.handleAdd))
-	s.mux.HandleFunc("/get", recordMetrics("get", s.handleGet))
-	s.mux.Handle("/metrics", promhttp.Handler())
+	s.handle("/add", s.flight.handler(s.limiter.handler("/add", s.auth.require(scopeWrite, http.HandlerFunc(s.handleAdd)))))
+	s.handle("/get", s.flight.handler(s.limiter.handler("/get", s.auth.require(scopeRead, http.HandlerFunc(s.handleGet)))))
+	s.handle("/metrics", s.auth.metrics(promhttp.InstrumentMetricHandler(s.reg, promhttp.HandlerFor(s.reg, promhttp.HandlerOpts{}))))
+	s.handle("/healthz", s.health.handler(true))
+	s.handle("/readyz", s.health.handler(false))
+	if s.tsdb != nil {
+		s.handle("/api/v1/", s.auth.metrics(s.tsdb.Handler()))
+	}
+	if s.alerts != nil {
+		s.handle("/api/v1/alerts", s.auth.metrics(http.HandlerFunc(s.handleAlerts)))
+	}
+	s.setupDebugRoutes()
+}
+
+// handle registers h for the given pattern, recording the requests metrics,
+// access log and trace with the pattern as route.
+func (s *server) handle(pattern string, h http.Handler) {
+	h = s.metrics.Handler(pattern, h)
+	h = s.access.handler(pattern, h)
+	s.mux.Handle(pattern, s.tracer.Handler(pattern, h))
 }
 
 var (
-	totalRequests = promauto.NewCounter(
+	tlsCertExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tls_certificate_expiry_timestamp_seconds",
+			Help: "Expiry date of the loaded TLS certificates (the earliest one for the client CA)",
+		}, []string{"cert"})
+
+	logLines = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "cache_requests_total",
-			Help: "The total number of requests",
-		})
+			Name: "log_lines_total",
+			Help: "The total number of log lines written, by level",
+		}, []string{"level"})
 
-	cacheHits = promauto.NewCounter(
+	tracingSpansDropped = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "cache_hits_total",
-			Help: "The total number of cache hits",
+			Name: "tracing_spans_dropped_total",
+			Help: "The total number of spans that couldn't be exported",
 		})
 
-	cacheMisses = promauto.NewCounter(
+	debugCaptures = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "cache_misses_total",
-			Help: "The total number of cache misses",
-		})
+			Name: "debug_captures_total",
+			Help: "The total number of profiles and execution traces captured, by kind",
+		}, []string{"kind"})
 
-	requestDuration = promauto.NewHistogramVec(
+	debugCaptureSize = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    "request_duration_microseconds",
-			Help:    "The duration of requests",
-			Buckets: prometheus.LinearBuckets(0, 5, 20),
-		}, []string{"endpoint"})
+			Name:    "debug_capture_size_bytes",
+			Help:    "Size of the captured profiles and execution traces, by kind",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		}, []string{"kind"})
+
+	profilerCaptures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "profiler_captures_total",
+			Help: "The total number of profiles captured by the continuous profiler, by kind and result",
+		}, []string{"kind", "result"})
+
+	profilerStoreSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "profiler_store_size_bytes",
+			Help: "Total size of the profiles stored by the continuous profiler",
+		})
+
+	alertNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "alert_notifications_total",
+			Help: "The total number of alert notifications sent to the receivers, by result (success or failure)",
+		}, []string{"result"})
+
+	sloObjective = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "slo_objective_ratio",
+			Help: "Target ratio of good requests of the service level objectives",
+		}, []string{"slo"})
+
+	sloErrorBudgetRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "slo_error_budget_remaining",
+			Help: "Ratio of the error budget remaining over the SLO window, negative once exhausted",
+		}, []string{"slo"})
+
+	sloBurnRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "slo_burn_rate",
+			Help: "Rate at which the error budget is consumed over a window, 1 consuming it exactly over the SLO window",
+		}, []string{"slo", "window"})
 )
 
+// Set at link time, see instrument.NewBuildInfo.
+var version, revision string
+
+// registerMetrics registers the server metrics, along with the build
+// information, process and Go runtime collectors, with reg.
+func registerMetrics(reg prometheus.Registerer, cfg *config) {
+	reg.MustRegister(
+		tlsCertExpiry,
+		logLines,
+		tracingSpansDropped,
+		debugCaptures,
+		debugCaptureSize,
+		profilerCaptures,
+		profilerStoreSize,
+		alertNotifications,
+		sloObjective,
+		sloErrorBudgetRemaining,
+		sloBurnRate,
+
+		instrument.NewBuildInfo(version, revision),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		instrument.NewRuntimeCollector(cfg.runtimeMetrics()),
+	)
+}
+
+// flagOptions maps command line flags to the configuration option they set.
+var flagOptions = map[string]string{
+	"addr":      "server.addr",
+	"size":      "cache.size",
+	"tls-cert":  "tls.cert",
+	"tls-key":   "tls.key",
+	"client-ca": "tls.client_ca",
+
+	"metrics-backend": "metrics.backend",
+}
+
 func main() {
-	addr := flag.String("addr", ":8080", "server listen address")
-	csize := flag.Int("size", 256, "LRU cache size")
+	def := defaultConfig()
+	cfgPath := flag.String("config", "", "configuration file (TOML), reloaded on SIGHUP")
+	flag.String("addr", def.Addr, "server listen address")
+	flag.Int("size", def.CacheSize, "LRU cache size")
+	flag.String("tls-cert", "", "TLS certificate file, enables HTTPS")
+	flag.String("tls-key", "", "TLS private key file")
+	flag.String("client-ca", "", "CA certificates file verifying clients and peers, enables mutual TLS")
+	flag.String("metrics-backend", def.MetricsBackend, "backend of the cache metrics: prometheus, statsd, dogstatsd or influx (the request, process and runtime metrics are also served on /metrics)")
+	gen := flag.String("generate", "", "write the Grafana dashboard and the Prometheus rules of the server metrics under `dir` and exit")
+	sloRules := flag.String("slo-rules", "", "write the Prometheus rules of the service level objectives to `file` ('-' for stdout) and exit")
 
 	flag.Parse()
 
-	s := newServer(*csize)
+	// Only flags explicitly set override the configuration file.
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagOptions[f.Name]; ok {
+			flags[key] = f.Value.String()
+		}
+	})
+	load := func() (*config, error) { return loadConfig(*cfgPath, flags) }
+
+	cfg, err := load()
+	if err != nil {
+		log.Fatal("config: ", err)
+	}
+
+	if *gen != "" {
+		if err := generate(*gen, cfg); err != nil {
+			log.Fatal("generate: ", err)
+		}
+		return
+	}
+	if *sloRules != "" {
+		if err := saveSLORules(*sloRules, cfg.Objectives); err != nil {
+			log.Fatal("slo: ", err)
+		}
+		return
+	}
+
+	reg := prometheus.NewRegistry()
+	guard := metrics.NewCardinalityGuard(reg, cfg.MaxSeries, cfg.SeriesLimits)
+	mp, err := newMetricsProvider(cfg, reg, guard)
+	if err != nil {
+		log.Fatal("metrics: ", err)
+	}
+	s := newServer(cfg, reg, mp)
+	s.guard = guard
+	slog.SetDefault(newLogger(os.Stderr, s.logLevel))
+	setTimestamp(configLastReload)
+
+	tracer, closer, err := newTracer(cfg)
+	if err != nil {
+		log.Fatal("tracing: ", err)
+	}
+	s.tracer = tracer
+	if cfg.FlightRecorder {
+		if s.flight, err = newFlightRecorder(cfg); err != nil {
+			log.Fatal("flight recorder: ", err)
+		}
+	}
+	if cfg.ProfilingInterval > 0 {
+		if s.prof, err = newProfiler(cfg); err != nil {
+			log.Fatal("profiler: ", err)
+		}
+	}
+	if cfg.TSDBInterval > 0 {
+		s.tsdb = newTSDB(cfg, reg)
+	}
+	if cfg.alerting() {
+		if s.alerts, err = newAlerting(cfg, s.tsdb); err != nil {
+			log.Fatal("alerting: ", err)
+		}
+	}
+	runtime.SetMutexProfileFraction(cfg.MutexProfileFraction)
 	s.setupRoutes()
 
-	log.Fatal(s.serve(*addr))
+	if cfg.Snapshot != "" {
+		// The server is not ready until the snapshot is loaded.
+		c := s.cache.(snapshotter)
+		var loading task
+		s.health.register("snapshot", false, loading.check)
+		go func() {
+			err := loadSnapshot(c, cfg.Snapshot)
+			if err != nil {
+				slog.Error("snapshot: loading failed", "err", err)
+			}
+			loading.finish(err)
+		}()
+		s.onShutdown("snapshot", func() error {
+			if !loading.finished() {
+				// Don't overwrite the snapshot with a partially restored cache.
+				return fmt.Errorf("not saved, still loading")
+			}
+			return saveSnapshot(c, cfg.Snapshot)
+		})
+	}
+
+	// Pending spans are exported once in-flight requests are drained.
+	s.onShutdown("tracing", func() error {
+		tracer.Close()
+		if closer != nil {
+			return closer.Close()
+		}
+		return nil
+	})
+	// Closed once the server has stopped, to send the shutdown metrics.
+	defer func() {
+		if err := mp.Close(); err != nil {
+			slog.Error("metrics: closing failed", "err", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if cfg.TLSCert != "" {
+		certs, err := newCertStore(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+		if err != nil {
+			log.Fatal("tls: ", err)
+		}
+		s.useTLS(certs)
+		go certs.watch(ctx, certPollInterval)
+	}
+
+	go s.health.poll(ctx, cfg.HealthInterval)
+	if s.flight != nil {
+		go s.flight.run(ctx, flightRecorderInterval)
+	}
+	if s.prof != nil {
+		go s.prof.run(ctx, cfg.ProfilingInterval)
+	}
+	if s.tsdb != nil {
+		go s.tsdb.Run(ctx, reg, cfg.TSDBInterval, func(err error) {
+			slog.Warn("tsdb: scrape failed", "err", err)
+		})
+	}
+	go s.slo.run(ctx, reg)
+	if s.alerts != nil {
+		go s.alerts.Run(ctx, cfg.AlertInterval, func(err error) {
+			slog.Warn("alerting: evaluation failed", "err", err)
+		})
+	}
+
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		var sig os.Signal
+		for sig = range sigs {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			if err := s.reload(load); err != nil {
+				slog.Error("config reload failed", "err", err)
+				continue
+			}
+			slog.Info("config reloaded")
+		}
+
+		slog.Info("server shutting down", "signal", sig.String())
+		if err := s.shutdown(); err != nil {
+			slog.Error("shutdown failed", "err", err)
+		}
+		close(done)
+	}()
+
+	if err := s.serve(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	slog.Info("server stopped")
 }
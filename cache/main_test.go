@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/arl/golab-2019/metrics"
+	"github.com/arl/golab-2019/metrics/metricstest"
+)
+
+// newTestServer creates a server with a new registry, the cache metrics
+// being Prometheus ones.
+func newTestServer(cfg *config) *server {
+	reg := metricstest.NewRegistry()
+	return newServer(cfg, reg, metrics.NewPrometheus(reg))
+}
+
+func TestServerShutdown(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ShutdownTimeout = 5 * time.Second
+	s := newTestServer(cfg)
+
+	started := make(chan struct{})
+	s.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	var hooked bool
+	s.onShutdown("test", func() error { hooked = true; return nil })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.srv.Serve(l) }()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		body <- string(buf)
+	}()
+
+	<-started
+	if err := s.shutdown(); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Serve returned %v, want %v", err, http.ErrServerClosed)
+	}
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight request got %q, want %q", got, "done")
+	}
+	if !hooked {
+		t.Errorf("shutdown hook has not been run")
+	}
+}
+
+func TestMetricsBackend(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cfg := defaultConfig()
+	cfg.MetricsBackend = "dogstatsd"
+	cfg.StatsDAddr = conn.LocalAddr().String()
+	p, err := newMetricsProvider(cfg, metricstest.NewRegistry(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initMetrics(p)
+	defer initMetrics(metrics.Discard)
+
+	cacheHits.Inc()
+	rateLimitRequests.With("/get", "default", "allowed").Inc()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "cache_hits_total:1|c\nratelimit_requests_total:1|c|#route:/get,class:default,result:allowed"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arl/golab-2019/metrics"
+)
+
+// The cache metrics are sent to the configured metrics backend. Until
+// initMetrics is called, they are discarded.
+var (
+	cacheHits            metrics.Counter
+	cacheMisses          metrics.Counter
+	cacheEvictions       metrics.Counter
+	configLastReload     metrics.Gauge
+	configReloadFailures metrics.Counter
+	shutdownDuration     metrics.Gauge
+	healthCheckStatus    metrics.GaugeVec
+	rateLimitRequests    metrics.CounterVec
+	authFailures         metrics.CounterVec
+)
+
+func init() { initMetrics(metrics.Discard) }
+
+// initMetrics creates the cache metrics with p.
+func initMetrics(p metrics.Provider) {
+	cacheHits = p.NewCounter(metrics.Opts{
+		Name: "cache_hits_total",
+		Help: "The total number of cache hits",
+	}).With()
+	cacheMisses = p.NewCounter(metrics.Opts{
+		Name: "cache_misses_total",
+		Help: "The total number of cache misses",
+	}).With()
+	cacheEvictions = p.NewCounter(metrics.Opts{
+		Name: "cache_evictions_total",
+		Help: "The total number of least recently used elements evicted from the cache",
+	}).With()
+	configLastReload = p.NewGauge(metrics.Opts{
+		Name: "config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	}).With()
+	configReloadFailures = p.NewCounter(metrics.Opts{
+		Name: "config_reload_failures_total",
+		Help: "The total number of failed configuration reloads",
+	}).With()
+	shutdownDuration = p.NewGauge(metrics.Opts{
+		Name: "shutdown_duration_seconds",
+		Help: "How long the last graceful shutdown took",
+	}).With()
+	healthCheckStatus = p.NewGauge(metrics.Opts{
+		Name:   "health_check_status",
+		Help:   "Whether the last run of a health check succeeded (1) or not (0)",
+		Labels: []string{"check"},
+	})
+	rateLimitRequests = p.NewCounter(metrics.Opts{
+		Name:   "ratelimit_requests_total",
+		Help:   "The total number of requests checked by the rate limiter, by result (allowed or throttled)",
+		Labels: []string{"route", "class", "result"},
+	})
+	authFailures = p.NewCounter(metrics.Opts{
+		Name:   "auth_failures_total",
+		Help:   "The total number of requests rejected by authentication or authorization, by reason",
+		Labels: []string{"reason"},
+	})
+}
+
+// newMetricsProvider creates the provider of the metrics backend configured in
+// cfg. Prometheus metrics are registered with reg, and their series limited by
+// guard, if not nil.
+func newMetricsProvider(cfg *config, reg prometheus.Registerer, guard *metrics.CardinalityGuard) (metrics.Provider, error) {
+	switch cfg.MetricsBackend {
+	case "statsd", "dogstatsd":
+		return metrics.NewStatsD(cfg.StatsDAddr, metrics.StatsDOpts{
+			DogStatsD: cfg.MetricsBackend == "dogstatsd",
+		})
+	case "influx":
+		return metrics.NewInflux(cfg.InfluxURL, metrics.InfluxOpts{
+			Token:         cfg.InfluxToken,
+			FlushInterval: cfg.InfluxInterval,
+			Client:        &http.Client{Timeout: 10 * time.Second},
+			OnError: func(err error) {
+				slog.Warn("metrics: influx write failed", "err", err)
+			},
+		}), nil
+	case "prometheus":
+		p := metrics.NewPrometheus(reg)
+		p.Guard = guard
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown metrics backend %q", cfg.MetricsBackend)
+}
+
+// setTimestamp sets g to the current Unix time, in seconds.
+func setTimestamp(g metrics.Gauge) {
+	g.Set(float64(time.Now().UnixNano()) / 1e9)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	targets  = flag.String("targets", "localhost:8080", "comma-separated addresses, or URLs, of the 'cache' servers to probe")
+	interval = flag.Duration("interval", 15*time.Second, "interval between probes of each target")
+	timeout  = flag.Duration("timeout", 5*time.Second, "maximum duration of a probe")
+	listen   = flag.String("listen", ":9115", "address serving the probe metrics on /metrics")
+	token    = flag.String("token", "", "bearer token, with the read and write scopes, to authenticate requests")
+	key      = flag.String("key", "", "cache key written by the probes (default \"probe:<hostname>\")")
+	verbose  = flag.Bool("v", false, "log successful probes too")
+)
+
+func main() {
+	flag.Parse()
+
+	var addrs []string
+	for _, t := range strings.Split(*targets, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			addrs = append(addrs, t)
+		}
+	}
+	if len(addrs) == 0 {
+		log.Fatal("no target to probe")
+	}
+	if *key == "" {
+		host, _ := os.Hostname()
+		*key = "probe:" + host
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+	)
+	p := newProber(reg, *key, *token, *timeout)
+	for _, addr := range addrs {
+		go p.run(addr, *interval, *verbose)
+	}
+
+	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	log.Printf("probing %s every %v, metrics served on %s", strings.Join(addrs, ", "), *interval, *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
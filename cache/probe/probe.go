@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arl/golab-2019/cache/client"
+)
+
+// A prober checks cache servers with add-then-get round trips, verifying the
+// value read back is the one just written.
+type prober struct {
+	key, token string
+	timeout    time.Duration
+	client     *http.Client
+
+	success           *prometheus.GaugeVec
+	duration          *prometheus.GaugeVec
+	consistencyErrors *prometheus.CounterVec
+}
+
+// newProber creates a prober writing key, and registers its metrics with reg.
+func newProber(reg prometheus.Registerer, key, token string, timeout time.Duration) *prober {
+	p := &prober{
+		key:     key,
+		token:   token,
+		timeout: timeout,
+		// Every request opens a new connection, so that the DNS and connect
+		// phases are measured each time.
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			DisableKeepAlives: true,
+		}},
+
+		success: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "probe_success",
+				Help: "Whether the last probe of the target succeeded (1) or not (0)",
+			}, []string{"target"}),
+		duration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "probe_duration_seconds",
+				Help: "Duration of the phases (dns, connect, tls, ttfb and transfer) of the requests (add and get) of the last probe of the target",
+			}, []string{"target", "op", "phase"}),
+		consistencyErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "probe_consistency_errors_total",
+				Help: "The total number of probes which read back a value different from the one written",
+			}, []string{"target"}),
+	}
+	reg.MustRegister(p.success, p.duration, p.consistencyErrors)
+	return p
+}
+
+// run probes the server at addr every interval, forever.
+func (p *prober) run(addr string, interval time.Duration, verbose bool) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		if err := p.probe(addr); err != nil {
+			log.Printf("probe %s: %v", addr, err)
+		} else if verbose {
+			log.Printf("probe %s: ok", addr)
+		}
+		<-tick.C
+	}
+}
+
+// errInconsistent is returned by probe when the value read back isn't the
+// one written.
+type errInconsistent struct{ got, want string }
+
+func (e errInconsistent) Error() string {
+	return fmt.Sprintf("read back %q, want %q", e.got, e.want)
+}
+
+// probe adds a random value to the server at addr and gets it back,
+// recording the outcome in the metrics.
+func (p *prober) probe(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	err := p.roundTrip(ctx, addr)
+	if _, ok := err.(errInconsistent); ok {
+		p.consistencyErrors.WithLabelValues(addr).Inc()
+	}
+	if err != nil {
+		p.success.WithLabelValues(addr).Set(0)
+		return err
+	}
+	p.success.WithLabelValues(addr).Set(1)
+	return nil
+}
+
+func (p *prober) roundTrip(ctx context.Context, addr string) error {
+	value := strconv.FormatInt(rand.Int63(), 36)
+
+	req, err := client.AddRequest(addr, p.key, value)
+	if err != nil {
+		return err
+	}
+	if _, err := p.do(ctx, addr, "add", req); err != nil {
+		return err
+	}
+
+	if req, err = client.GetRequest(addr, p.key); err != nil {
+		return err
+	}
+	got, err := p.do(ctx, addr, "get", req)
+	if err != nil {
+		return err
+	}
+	if got != value {
+		return errInconsistent{got: got, want: value}
+	}
+	return nil
+}
+
+// do sends req and returns the response body, recording the duration of its
+// phases. Only 200 responses are successful.
+func (p *prober) do(ctx context.Context, addr, op string, req *http.Request) (string, error) {
+	// The trace hooks may be called from other goroutines, until the
+	// connection is established.
+	var mu sync.Mutex
+	var dnsStart, dnsDone, connStart, connDone, tlsStart, tlsDone, wrote, firstByte, end time.Time
+	mark := func(t *time.Time) {
+		mu.Lock()
+		if t.IsZero() {
+			*t = time.Now()
+		}
+		mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { mark(&dnsDone) },
+		ConnectStart:         func(string, string) { mark(&connStart) },
+		ConnectDone:          func(string, string, error) { mark(&connDone) },
+		TLSHandshakeStart:    func() { mark(&tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { mark(&tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&wrote) },
+		GotFirstResponseByte: func() { mark(&firstByte) },
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		// Phases which didn't happen, like dns with an IP address, last 0.
+		phase := func(name string, from, to time.Time) {
+			d := 0.0
+			if !from.IsZero() && to.After(from) {
+				d = to.Sub(from).Seconds()
+			}
+			p.duration.WithLabelValues(addr, op, name).Set(d)
+		}
+		phase("dns", dnsStart, dnsDone)
+		phase("connect", connStart, connDone)
+		if req.URL.Scheme == "https" {
+			phase("tls", tlsStart, tlsDone)
+		}
+		phase("ttfb", wrote, firstByte)
+		phase("transfer", firstByte, end)
+	}()
+
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	client.Authorize(req, p.token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", op, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	mark(&end)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", op, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: unexpected status %s", op, resp.Status)
+	}
+	return string(body), nil
+}
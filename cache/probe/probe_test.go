@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeCache serves /add and /get like a cache server, returning corrupt
+// values if corrupt is set.
+func fakeCache(corrupt bool) *httptest.Server {
+	var mu sync.Mutex
+	values := make(map[string]string)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0k3n" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		values[r.URL.Query().Get("k")] = r.URL.Query().Get("v")
+		mu.Unlock()
+	})
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		v := values[r.URL.Query().Get("k")]
+		mu.Unlock()
+		if corrupt {
+			v += "!"
+		}
+		w.Write([]byte(v))
+	})
+	return httptest.NewServer(mux)
+}
+
+func gaugeValue(g *prometheus.GaugeVec, lvs ...string) float64 {
+	var m dto.Metric
+	g.WithLabelValues(lvs...).Write(&m)
+	return m.GetGauge().GetValue()
+}
+
+func TestProbe(t *testing.T) {
+	ok, corrupt := fakeCache(false), fakeCache(true)
+	defer ok.Close()
+	defer corrupt.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	p := newProber(prometheus.NewRegistry(), "probe:test", "t0k3n", time.Second)
+	for _, tt := range []struct {
+		target       string
+		success      float64
+		inconsistent float64
+	}{
+		{ok.URL, 1, 0},
+		{corrupt.URL, 0, 1},
+		{down.URL, 0, 0},
+	} {
+		err := p.probe(tt.target)
+		if (err == nil) != (tt.success == 1) {
+			t.Errorf("probe(%s) = %v", tt.target, err)
+		}
+		if v := gaugeValue(p.success, tt.target); v != tt.success {
+			t.Errorf("probe_success{target=%q} = %v, want %v", tt.target, v, tt.success)
+		}
+		var m dto.Metric
+		p.consistencyErrors.WithLabelValues(tt.target).Write(&m)
+		if v := m.GetCounter().GetValue(); v != tt.inconsistent {
+			t.Errorf("probe_consistency_errors_total{target=%q} = %v, want %v", tt.target, v, tt.inconsistent)
+		}
+	}
+
+	for _, op := range []string{"add", "get"} {
+		if v := gaugeValue(p.duration, ok.URL, op, "connect"); v <= 0 {
+			t.Errorf("%s connect duration = %v, want > 0", op, v)
+		}
+		if v := gaugeValue(p.duration, ok.URL, op, "ttfb"); v <= 0 {
+			t.Errorf("%s ttfb duration = %v, want > 0", op, v)
+		}
+		// The target is an IP address.
+		if v := gaugeValue(p.duration, ok.URL, op, "dns"); v != 0 {
+			t.Errorf("%s dns duration = %v, want 0", op, v)
+		}
+	}
+
+	// Unauthorized.
+	p.token = ""
+	if err := p.probe(ok.URL); err == nil {
+		t.Error("probe without token should fail")
+	}
+}
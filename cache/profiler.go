@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// profileKinds are the profiles captured by the continuous profiler.
+var profileKinds = []string{"cpu", "heap", "goroutine", "mutex"}
+
+// profileTimeLayout is the layout of the timestamps identifying the profiles
+// captured together, used in file names and URLs.
+const profileTimeLayout = "20060102T150405Z"
+
+// A profiler periodically captures profiles into a directory, deleting the
+// oldest ones when their total size exceeds a limit.
+//
+// Profiles are stored as <timestamp>-<kind>.pb.gz.
+type profiler struct {
+	dir         string
+	maxBytes    int64
+	cpuDuration time.Duration
+	now         func() time.Time
+
+	mu sync.Mutex // serializes captures and pruning
+}
+
+func newProfiler(cfg *config) (*profiler, error) {
+	if err := os.MkdirAll(cfg.ProfilingDir, 0755); err != nil {
+		return nil, err
+	}
+	return &profiler{
+		dir:         cfg.ProfilingDir,
+		maxBytes:    int64(cfg.ProfilingMaxBytes),
+		cpuDuration: cfg.ProfilingCPUDuration,
+		now:         time.Now,
+	}, nil
+}
+
+// run captures profiles every interval until ctx is done.
+func (p *profiler) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		p.collect(ctx)
+	}
+}
+
+// collect captures all the profiles, then prunes the store. It returns the
+// timestamp identifying the captured profiles.
+func (p *profiler) collect(ctx context.Context) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ts := p.now().UTC().Format(profileTimeLayout)
+	for _, kind := range profileKinds {
+		result := "success"
+		if err := p.capture(ctx, ts, kind); err != nil {
+			slog.Error("profiler: capture failed", "kind", kind, "err", err)
+			result = "failure"
+		}
+		profilerCaptures.WithLabelValues(kind, result).Inc()
+	}
+	if err := p.prune(); err != nil {
+		slog.Error("profiler: pruning failed", "err", err)
+	}
+	return ts
+}
+
+func (p *profiler) path(ts, kind string) string {
+	return filepath.Join(p.dir, ts+"-"+kind+".pb.gz")
+}
+
+// capture writes a profile to a temporary file, renamed once complete.
+func (p *profiler) capture(ctx context.Context, ts, kind string) error {
+	f, err := ioutil.TempFile(p.dir, ".profile-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if kind == "cpu" {
+		// Fails if a CPU profile is already being captured via /debug/pprof.
+		if err = pprof.StartCPUProfile(f); err == nil {
+			select {
+			case <-time.After(p.cpuDuration):
+			case <-ctx.Done():
+			}
+			pprof.StopCPUProfile()
+		}
+	} else {
+		err = pprof.Lookup(kind).WriteTo(f, 0)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p.path(ts, kind))
+}
+
+// A storedProfiles lists the profiles captured at the same time.
+type storedProfiles struct {
+	Timestamp string            `json:"timestamp"`
+	Profiles  map[string]string `json:"profiles"` // download URLs by kind
+	Size      int64             `json:"size_bytes"`
+}
+
+// list returns the stored profiles, from the oldest to the latest.
+func (p *profiler) list() ([]storedProfiles, error) {
+	files, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		all   []storedProfiles
+		index = make(map[string]int)
+	)
+	for _, fi := range files {
+		ts, kind, ok := parseProfileName(fi.Name())
+		if !ok {
+			continue
+		}
+		i, found := index[ts]
+		if !found {
+			i = len(all)
+			index[ts] = i
+			all = append(all, storedProfiles{Timestamp: ts, Profiles: make(map[string]string)})
+		}
+		all[i].Profiles[kind] = "/debug/profiles/" + ts + "/" + kind
+		all[i].Size += fi.Size()
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Timestamp < all[j].Timestamp })
+	return all, nil
+}
+
+// parseProfileName parses the name of a stored profile file.
+func parseProfileName(name string) (ts, kind string, ok bool) {
+	name = strings.TrimSuffix(name, ".pb.gz")
+	i := strings.Index(name, "-")
+	if i == -1 {
+		return "", "", false
+	}
+	ts, kind = name[:i], name[i+1:]
+	if _, err := time.Parse(profileTimeLayout, ts); err != nil || !validProfileKind(kind) {
+		return "", "", false
+	}
+	return ts, kind, true
+}
+
+func validProfileKind(kind string) bool {
+	for _, k := range profileKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// prune deletes the oldest profiles until the store size is below the limit.
+// The latest profiles are always kept.
+func (p *profiler) prune() error {
+	all, err := p.list()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, sp := range all {
+		total += sp.Size
+	}
+	for len(all) > 1 && total > p.maxBytes {
+		for kind := range all[0].Profiles {
+			if err := os.Remove(p.path(all[0].Timestamp, kind)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		total -= all[0].Size
+		all = all[1:]
+	}
+	profilerStoreSize.Set(float64(total))
+	return nil
+}
+
+// handler serves the index of the stored profiles, as JSON, on
+// /debug/profiles, and the profiles on /debug/profiles/<timestamp>/<kind>.
+func (p *profiler) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/debug/profiles"), "/")
+		if rest == "" {
+			all, err := p.list()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// Latest first.
+			for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+				all[i], all[j] = all[j], all[i]
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(all)
+			return
+		}
+
+		parts := strings.Split(rest, "/")
+		if len(parts) != 2 || !validProfileKind(parts[1]) {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := time.Parse(profileTimeLayout, parts[0]); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.pb.gz"`, parts[0], parts[1]))
+		http.ServeFile(w, r, p.path(parts[0], parts[1]))
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProfiler(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ProfilingDir = t.TempDir()
+	cfg.ProfilingCPUDuration = 50 * time.Millisecond
+	p, err := newProfiler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 10, 21, 10, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	first := p.collect(context.Background())
+	if first != "20191021T100000Z" {
+		t.Errorf("timestamp = %q", first)
+	}
+	all, err := p.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || len(all[0].Profiles) != len(profileKinds) {
+		t.Fatalf("stored profiles = %+v, want one of each kind", all)
+	}
+
+	// Junk in the directory is ignored.
+	ioutil.WriteFile(cfg.ProfilingDir+"/notes.txt", []byte("hello"), 0644)
+
+	// The store is bounded: the oldest profiles are deleted.
+	p.maxBytes = all[0].Size + 1
+	now = now.Add(time.Minute)
+	latest := p.collect(context.Background())
+	if all, _ = p.list(); len(all) != 1 || all[0].Timestamp != latest {
+		t.Fatalf("stored profiles = %+v, want only %s", all, latest)
+	}
+
+	h := p.handler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/profiles", nil))
+	var index []storedProfiles
+	if err := json.Unmarshal(w.Body.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 1 || index[0].Profiles["heap"] != "/debug/profiles/"+latest+"/heap" {
+		t.Errorf("index = %+v", index)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", index[0].Profiles["heap"], nil))
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("download: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+
+	for _, path := range []string{
+		"/debug/profiles/" + first + "/heap", // pruned
+		"/debug/profiles/" + latest + "/threadcreate",
+		"/debug/profiles/../heap",
+		"/debug/profiles/" + latest + "/heap/more",
+	} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", path, w.Code)
+		}
+	}
+}
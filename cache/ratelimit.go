@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A limit is the configuration of a token bucket: it's refilled at rate
+// tokens per second, up to burst tokens.
+type limit struct {
+	rate  float64
+	burst int
+}
+
+func (l limit) String() string {
+	return strconv.FormatFloat(l.rate, 'g', -1, 64) + ":" + strconv.Itoa(l.burst)
+}
+
+// parseLimit parses a limit written as 'rate:burst'.
+func parseLimit(s string) (limit, error) {
+	i := strings.Index(s, ":")
+	if i == -1 {
+		return limit{}, fmt.Errorf("invalid limit %q, want 'rate:burst'", s)
+	}
+	rate, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return limit{}, err
+	}
+	burst, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return limit{}, err
+	}
+	if rate < 0 || burst < 1 {
+		return limit{}, fmt.Errorf("invalid limit %q, rate must not be negative and burst must be positive", s)
+	}
+	return limit{rate: rate, burst: burst}, nil
+}
+
+// A bucket is a token bucket.
+type bucket struct {
+	limit  limit
+	tokens float64
+	last   time.Time // last time tokens has been updated
+}
+
+// peek refills the bucket up to now and reports whether it holds a token,
+// otherwise it returns how long to wait for the next one. The token is only
+// taken by commit.
+func (b *bucket) peek(now time.Time) (ok bool, retry time.Duration) {
+	l := b.limit
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	if l.rate == 0 {
+		return false, time.Hour
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// commit takes the token peek reported.
+func (b *bucket) commit() {
+	b.tokens--
+}
+
+// full reports whether the bucket would be full at time now.
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.rate >= float64(b.limit.burst)
+}
+
+// limits is the rate limiter configuration.
+type limits struct {
+	routes     map[string]limit  // limit per route
+	namespaces map[string]limit  // limit per cache key namespace
+	classes    map[string]string // client class per API key
+}
+
+// sweepInterval is how often buckets that have been refilled, and thus hold
+// no state, are removed.
+const sweepInterval = time.Minute
+
+// A rateLimiter limits the rate of requests per client, with a token bucket
+// per client and per route or namespace.
+//
+// Clients are identified by their API key, in the X-API-Key header, or by
+// their IP address. The namespace of a request is the part of the cache key
+// preceding the first colon, if any.
+type rateLimiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	limits    limits
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(l limits) *rateLimiter {
+	return &rateLimiter{
+		now:     time.Now,
+		limits:  l,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// setLimits replaces the limiter configuration. If it changed, all clients
+// start again with full buckets.
+func (rl *rateLimiter) setLimits(l limits) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if reflect.DeepEqual(rl.limits, l) {
+		return
+	}
+	rl.limits = l
+	rl.buckets = make(map[string]*bucket)
+}
+
+// allow reports whether the request of client on route and namespace (which
+// may be empty) is allowed, and if not, after how long to retry.
+func (rl *rateLimiter) allow(client, route, ns string) (ok bool, retry time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	if now.Sub(rl.lastSweep) > sweepInterval {
+		rl.sweep(now)
+	}
+
+	// Tokens are only taken if both the route and namespace buckets allow
+	// the request, so that a throttled namespace doesn't drain the route
+	// bucket, throttling the other namespaces too.
+	var bs []*bucket
+	if l, found := rl.limits.routes[route]; found {
+		bs = append(bs, rl.bucket(client+"\x00route\x00"+route, l, now))
+	}
+	if l, found := rl.limits.namespaces[ns]; ns != "" && found {
+		bs = append(bs, rl.bucket(client+"\x00ns\x00"+ns, l, now))
+	}
+	ok = true
+	for _, b := range bs {
+		if bok, bretry := b.peek(now); !bok {
+			ok = false
+			if bretry > retry {
+				retry = bretry
+			}
+		}
+	}
+	if ok {
+		for _, b := range bs {
+			b.commit()
+		}
+	}
+	return ok, retry
+}
+
+// bucket returns the bucket of key, created full if missing.
+func (rl *rateLimiter) bucket(key string, l limit, now time.Time) *bucket {
+	b, found := rl.buckets[key]
+	if !found {
+		b = &bucket{limit: l, tokens: float64(l.burst), last: now}
+		rl.buckets[key] = b
+	}
+	return b
+}
+
+// sweep removes the full buckets, which are equivalent to missing ones.
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.full(now) {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// client returns the identity of the client sending r and its class, which is
+// 'unknown' for clients without a configured API key.
+func (rl *rateLimiter) client(r *http.Request) (id, class string) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		rl.mu.Lock()
+		class, ok := rl.limits.classes[key]
+		rl.mu.Unlock()
+		if ok {
+			return "key:" + key, class
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host, "unknown"
+}
+
+// namespace returns the namespace of the cache key in r, or "".
+func namespace(r *http.Request) string {
+	k := r.URL.Query().Get("k")
+	if i := strings.Index(k, ":"); i != -1 {
+		return k[:i]
+	}
+	return ""
+}
+
+// handler wraps h so that requests exceeding the rate limit of the route are
+// rejected with 429 Too Many Requests.
+func (rl *rateLimiter) handler(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, class := rl.client(r)
+		ok, retry := rl.allow(client, route, namespace(r))
+		if !ok {
+			rateLimitRequests.With(route, class, "throttled").Inc()
+			secs := int(math.Ceil(retry.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		rateLimitRequests.With(route, class, "allowed").Inc()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parseLimits parses a list of comma-separated 'name=rate:burst' limits.
+func parseLimits(v string) (map[string]limit, error) {
+	m := make(map[string]limit)
+	for _, s := range splitList(v) {
+		i := strings.Index(s, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid limit %q, want 'name=rate:burst'", s)
+		}
+		l, err := parseLimit(s[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		m[s[:i]] = l
+	}
+	return m, nil
+}
+
+func formatLimits(m map[string]limit) string {
+	kv := make(map[string]string, len(m))
+	for k, l := range m {
+		kv[k] = l.String()
+	}
+	return formatMap(kv)
+}
+
+// limits returns the rate limiter configuration.
+func (c *config) limits() limits {
+	return limits{
+		routes:     c.RouteLimits,
+		namespaces: c.NamespaceLimits,
+		classes:    c.ClientClasses,
+	}
+}
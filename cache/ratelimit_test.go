@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseLimits(t *testing.T) {
+	got, err := parseLimits("/add=1.5:10,/get=100:200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["/add"] != (limit{1.5, 10}) || got["/get"] != (limit{100, 200}) {
+		t.Errorf("parseLimits() = %v", got)
+	}
+	if s := formatLimits(got); s != "/add=1.5:10,/get=100:200" {
+		t.Errorf("formatLimits() = %q", s)
+	}
+
+	for _, tt := range []string{"/add", "/add=1", "/add=a:1", "/add=1:0", "/add=-1:1"} {
+		if _, err := parseLimits(tt); err == nil {
+			t.Errorf("parseLimits(%q) should fail", tt)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Unix(0, 0)
+	rl := newRateLimiter(limits{
+		routes:     map[string]limit{"/add": {rate: 2, burst: 2}},
+		namespaces: map[string]limit{"slow": {rate: 1, burst: 1}},
+	})
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allow("a", "/add", ""); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	ok, retry := rl.allow("a", "/add", "")
+	if ok {
+		t.Fatalf("request should be throttled once burst is exhausted")
+	}
+	if retry != 500*time.Millisecond {
+		t.Errorf("retry = %v, want %v", retry, 500*time.Millisecond)
+	}
+
+	// Buckets are per client and per route.
+	if ok, _ := rl.allow("b", "/add", ""); !ok {
+		t.Errorf("other client should be allowed")
+	}
+	if ok, _ := rl.allow("a", "/get", ""); !ok {
+		t.Errorf("unlimited route should be allowed")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := rl.allow("a", "/add", ""); !ok {
+		t.Errorf("request should be allowed after refill")
+	}
+
+	if ok, _ := rl.allow("a", "/get", "slow"); !ok {
+		t.Errorf("first request in namespace should be allowed")
+	}
+	if ok, _ := rl.allow("a", "/get", "slow"); ok {
+		t.Errorf("second request in namespace should be throttled")
+	}
+
+	// Refilled buckets are swept.
+	now = now.Add(2 * sweepInterval)
+	rl.allow("c", "/get", "")
+	if len(rl.buckets) != 0 {
+		t.Errorf("%d buckets left after sweep, want 0", len(rl.buckets))
+	}
+}
+
+func TestRateLimiterNamespaceKeepsRouteTokens(t *testing.T) {
+	now := time.Unix(0, 0)
+	rl := newRateLimiter(limits{
+		routes:     map[string]limit{"/get": {rate: 1, burst: 3}},
+		namespaces: map[string]limit{"hot": {rate: 1, burst: 1}},
+	})
+	rl.now = func() time.Time { return now }
+
+	if ok, _ := rl.allow("a", "/get", "hot"); !ok {
+		t.Fatalf("first request in namespace should be allowed")
+	}
+	for i := 0; i < 5; i++ {
+		if ok, _ := rl.allow("a", "/get", "hot"); ok {
+			t.Fatalf("request %d in the exhausted namespace should be throttled", i)
+		}
+	}
+	if b := rl.buckets["a\x00route\x00/get"]; b.tokens != 2 {
+		t.Errorf("route bucket holds %v tokens, want 2: throttled requests took tokens", b.tokens)
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allow("a", "/get", "cold"); !ok {
+			t.Errorf("request %d in another namespace should be allowed", i)
+		}
+	}
+}
+
+func TestRateLimiterHandler(t *testing.T) {
+	rl := newRateLimiter(limits{
+		routes:  map[string]limit{"/get": {rate: 0.1, burst: 1}},
+		classes: map[string]string{"secret": "batch"},
+	})
+	h := rl.handler("/get", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	get := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/get?k=a", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get(""); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	w := get("")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "10" {
+		t.Errorf("Retry-After = %q, want %q", ra, "10")
+	}
+
+	// A known API key has its own bucket, unknown keys share the IP one.
+	if w := get("secret"); w.Code != http.StatusOK {
+		t.Errorf("known API key: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := get("other"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("unknown API key: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
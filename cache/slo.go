@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// An objective is a service level objective of a route: the percentage of
+// its requests, over the SLO window, which must be successful (availability)
+// or served in less than a threshold (latency).
+type objective struct {
+	name      string
+	route     string
+	kind      string        // availability or latency
+	target    float64       // percentage of good requests, e.g. 99.9
+	threshold time.Duration // with the latency kind
+}
+
+// errorBudget returns the allowed ratio of bad requests.
+func (o objective) errorBudget() float64 { return 1 - o.target/100 }
+
+// describe returns a human readable description of the objective.
+func (o objective) describe() string {
+	target := strconv.FormatFloat(o.target, 'g', -1, 64)
+	if o.kind == "latency" {
+		return fmt.Sprintf("%s%% of %s requests served in less than %v", target, o.route, o.threshold)
+	}
+	return fmt.Sprintf("%s%% of %s requests successful", target, o.route)
+}
+
+func (o objective) String() string {
+	s := o.name + "=" + o.route + ":" + o.kind + ":" + strconv.FormatFloat(o.target, 'g', -1, 64)
+	if o.kind == "latency" {
+		s += ":" + o.threshold.String()
+	}
+	return s
+}
+
+// parseObjectives parses a list of comma-separated objectives, as
+// 'name=route:availability:target' or 'name=route:latency:target:threshold'.
+func parseObjectives(v string) ([]objective, error) {
+	var objs []objective
+	for _, s := range splitList(v) {
+		i := strings.Index(s, "=")
+		fields := strings.Split(s[i+1:], ":")
+		if i <= 0 || len(fields) < 3 {
+			return nil, fmt.Errorf("invalid objective %q, want 'name=route:availability:target' or 'name=route:latency:target:threshold'", s)
+		}
+		o := objective{name: s[:i], route: fields[0], kind: fields[1]}
+		target, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || target <= 0 || target >= 100 {
+			return nil, fmt.Errorf("objective %s: target must be a percentage between 0 and 100 excluded", o.name)
+		}
+		o.target = target
+		switch {
+		case o.kind == "availability" && len(fields) == 3:
+		case o.kind == "latency" && len(fields) == 4:
+			if o.threshold, err = time.ParseDuration(fields[3]); err != nil || o.threshold <= 0 {
+				return nil, fmt.Errorf("objective %s: invalid latency threshold %q", o.name, fields[3])
+			}
+		default:
+			return nil, fmt.Errorf("invalid objective %q, want 'name=route:availability:target' or 'name=route:latency:target:threshold'", s)
+		}
+		objs = append(objs, o)
+	}
+	return objs, nil
+}
+
+func formatObjectives(objs []objective) string {
+	ss := make([]string, len(objs))
+	for i, o := range objs {
+		ss[i] = o.String()
+	}
+	return strings.Join(ss, ",")
+}
+
+// burnWindows are the windows over which burn rates are computed: the long
+// and short windows of the multiwindow, multi-burn-rate alerts described in
+// the Site Reliability Workbook, chapter 5.
+var burnWindows = []struct {
+	name string // as a Prometheus duration
+	d    time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"2h", 2 * time.Hour},
+	{"6h", 6 * time.Hour},
+	{"1d", 24 * time.Hour},
+	{"3d", 72 * time.Hour},
+}
+
+// burnAlerts fire when the error budget is burnt faster than factor times the
+// sustainable rate over both windows. With a 30 days window, the first one
+// fires when 2% of the budget is consumed in one hour.
+var burnAlerts = []struct {
+	long, short string
+	factor      float64
+	severity    string
+}{
+	{"1h", "5m", 14.4, "page"},
+	{"6h", "30m", 6, "page"},
+	{"1d", "2h", 3, "ticket"},
+	{"3d", "6h", 1, "ticket"},
+}
+
+// sloResolution is the interval between updates of the SLO metrics.
+const sloResolution = time.Minute
+
+// sloCounts are the cumulative counts of good and total requests of an
+// objective at a given time.
+type sloCounts struct {
+	t           time.Time
+	good, total float64
+}
+
+// sloTracker computes the SLIs of the objectives from the requests metrics,
+// keeping their history over the SLO window.
+type sloTracker struct {
+	objectives []objective
+	window     time.Duration
+
+	mu      sync.Mutex
+	history map[string][]sloCounts // by objective, by increasing time
+}
+
+func newSLOTracker(cfg *config) *sloTracker {
+	return &sloTracker{
+		objectives: cfg.Objectives,
+		window:     cfg.SLOWindow,
+		history:    make(map[string][]sloCounts),
+	}
+}
+
+// run updates the SLO metrics from the metrics gathered from g, every
+// sloResolution, until ctx is done.
+func (st *sloTracker) run(ctx context.Context, g prometheus.Gatherer) {
+	tick := time.NewTicker(sloResolution)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-tick.C:
+			st.update(g, t)
+		}
+	}
+}
+
+// update records the counts of good and total requests at time now, and
+// updates the error budget and burn rates gauges.
+func (st *sloTracker) update(g prometheus.Gatherer, now time.Time) {
+	// Gather returns what it could gather along with the error.
+	mfs, _ := g.Gather()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, o := range st.objectives {
+		c := countRequests(mfs, o)
+		c.t = now
+		h := append(st.history[o.name], c)
+		// Keep the counts at the start of the window.
+		i := 0
+		for i+1 < len(h) && !h[i+1].t.After(now.Add(-st.window)) {
+			i++
+		}
+		h = h[i:]
+		st.history[o.name] = h
+
+		sloObjective.WithLabelValues(o.name).Set(o.target / 100)
+		sloErrorBudgetRemaining.WithLabelValues(o.name).Set(1 - burnRate(o, h, st.window))
+		for _, w := range burnWindows {
+			if w.d <= st.window {
+				sloBurnRate.WithLabelValues(o.name, w.name).Set(burnRate(o, h, w.d))
+			}
+		}
+	}
+}
+
+// burnRate returns the ratio of bad requests over the window d ending with
+// the last counts of h, to the error budget. It's 0 if there were no
+// requests. The window is shorter if h doesn't go back as far.
+func burnRate(o objective, h []sloCounts, d time.Duration) float64 {
+	last := h[len(h)-1]
+	// The latest counts at, or before, the start of the window.
+	i := sort.Search(len(h), func(i int) bool { return h[i].t.After(last.t.Add(-d)) })
+	if i > 0 {
+		i--
+	}
+	first := h[i]
+	total := last.total - first.total
+	if total <= 0 {
+		return 0
+	}
+	bad := total - (last.good - first.good)
+	return bad / total / o.errorBudget()
+}
+
+// countRequests returns the cumulative counts of good and total requests of
+// the objective o, from the requests metrics.
+func countRequests(mfs []*dto.MetricFamily, o objective) sloCounts {
+	var c sloCounts
+	for _, mf := range mfs {
+		switch {
+		case o.kind == "availability" && mf.GetName() == "http_requests_total":
+			for _, m := range mf.GetMetric() {
+				if labelValue(m, "route") != o.route {
+					continue
+				}
+				v := m.GetCounter().GetValue()
+				c.total += v
+				if !strings.HasPrefix(labelValue(m, "code"), "5") {
+					c.good += v
+				}
+			}
+		case o.kind == "latency" && mf.GetName() == "http_request_duration_seconds":
+			for _, m := range mf.GetMetric() {
+				if labelValue(m, "route") != o.route {
+					continue
+				}
+				c.total += float64(m.GetHistogram().GetSampleCount())
+				for _, b := range m.GetHistogram().GetBucket() {
+					if b.GetUpperBound() == o.threshold.Seconds() {
+						c.good += float64(b.GetCumulativeCount())
+					}
+				}
+			}
+		}
+	}
+	return c
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
+
+// writeSLORules writes the Prometheus recording and alerting rules of the
+// objectives: the ratio of bad requests over each burn rate window, and the
+// multiwindow, multi-burn-rate alerts.
+func writeSLORules(w io.Writer, objs []objective) error {
+	bw := bufio.NewWriter(w)
+	p := func(format string, args ...interface{}) { fmt.Fprintf(bw, format+"\n", args...) }
+
+	p("# Generated by 'cache -slo-rules', DO NOT EDIT.")
+	p("groups:")
+	p("- name: slo_recording")
+	p("  rules:")
+	for _, o := range objs {
+		for _, win := range burnWindows {
+			p("  - record: slo:sli_error:ratio_rate%s", win.name)
+			p("    expr: |")
+			switch o.kind {
+			case "availability":
+				p(`      (sum(rate(http_requests_total{route=%q,code=~"5.."}[%s])) or vector(0))`, o.route, win.name)
+				p("      /")
+				p(`      sum(rate(http_requests_total{route=%q}[%s]))`, o.route, win.name)
+			case "latency":
+				p("      1 - (")
+				p(`        sum(rate(http_request_duration_seconds_bucket{route=%q,le="%s"}[%s]))`,
+					o.route, strconv.FormatFloat(o.threshold.Seconds(), 'g', -1, 64), win.name)
+				p("        /")
+				p(`        sum(rate(http_request_duration_seconds_count{route=%q}[%s]))`, o.route, win.name)
+				p("      )")
+			}
+			p("    labels:")
+			p("      slo: %s", o.name)
+		}
+	}
+
+	p("- name: slo_alerts")
+	p("  rules:")
+	for _, o := range objs {
+		budget := strconv.FormatFloat(o.errorBudget(), 'g', 6, 64)
+		for _, severity := range []string{"page", "ticket"} {
+			p("  - alert: SLOErrorBudgetBurn")
+			p("    expr: |")
+			sep := ""
+			for _, a := range burnAlerts {
+				if a.severity != severity {
+					continue
+				}
+				threshold := fmt.Sprintf("(%g * %s)", a.factor, budget)
+				p("      %s(", sep)
+				p(`        slo:sli_error:ratio_rate%s{slo=%q} > %s`, a.long, o.name, threshold)
+				p("      and")
+				p(`        slo:sli_error:ratio_rate%s{slo=%q} > %s`, a.short, o.name, threshold)
+				p("      )")
+				sep = "or "
+			}
+			p("    labels:")
+			p("      severity: %s", severity)
+			p("      slo: %s", o.name)
+			p("    annotations:")
+			p("      summary: 'Error budget of %s burning too fast, objective: %s'", o.name, o.describe())
+		}
+	}
+	return bw.Flush()
+}
+
+// saveSLORules writes the rules of the objectives to the file path, or to
+// the standard output if path is '-'.
+func saveSLORules(path string, objs []objective) error {
+	if path == "-" {
+		return writeSLORules(os.Stdout, objs)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeSLORules(f, objs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arl/golab-2019/metrics/metricstest"
+)
+
+func TestParseObjectives(t *testing.T) {
+	objs, err := parseObjectives("a=/get:availability:99.9, l=/add:latency:99:5ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []objective{
+		{name: "a", route: "/get", kind: "availability", target: 99.9},
+		{name: "l", route: "/add", kind: "latency", target: 99, threshold: 5 * time.Millisecond},
+	}
+	if len(objs) != len(want) || objs[0] != want[0] || objs[1] != want[1] {
+		t.Errorf("parseObjectives = %+v, want %+v", objs, want)
+	}
+	if s := formatObjectives(objs); s != "a=/get:availability:99.9,l=/add:latency:99:5ms" {
+		t.Errorf("formatObjectives = %q", s)
+	}
+
+	for _, s := range []string{
+		"/get:availability:99.9",
+		"a=/get:availability",
+		"a=/get:availability:100",
+		"a=/get:availability:99:5ms",
+		"a=/get:latency:99",
+		"a=/get:latency:99:fast",
+		"a=/get:throughput:99",
+	} {
+		if _, err := parseObjectives(s); err == nil {
+			t.Errorf("parseObjectives(%q) should fail", s)
+		}
+	}
+}
+
+func TestDurationBuckets(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DurationBuckets = []float64{0.001, 0.01}
+	cfg.Objectives = []objective{
+		{name: "a", route: "/get", kind: "availability", target: 99},
+		{name: "l1", route: "/get", kind: "latency", target: 99, threshold: 5 * time.Millisecond},
+		{name: "l2", route: "/add", kind: "latency", target: 99, threshold: 10 * time.Millisecond},
+	}
+	got := cfg.durationBuckets()
+	want := []float64{0.001, 0.005, 0.01}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("durationBuckets = %v, want %v", got, want)
+	}
+}
+
+func TestSLOTracker(t *testing.T) {
+	reg := metricstest.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "http_requests_total"}, []string{"route", "method", "code"})
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Buckets: []float64{0.001, 0.005, 0.01},
+	}, []string{"route", "method", "code"})
+	reg.MustRegister(requests, durations)
+
+	cfg := defaultConfig()
+	cfg.SLOWindow = 24 * time.Hour
+	cfg.Objectives = []objective{
+		{name: "test_availability", route: "/test", kind: "availability", target: 99},
+		{name: "test_latency", route: "/test", kind: "latency", target: 90, threshold: 5 * time.Millisecond},
+	}
+	st := newSLOTracker(cfg)
+
+	gauge := func(g *prometheus.GaugeVec, lvs ...string) float64 {
+		return metricstest.Value(g.WithLabelValues(lvs...))
+	}
+	approx := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+
+	// A flawless day of 1000 requests per hour.
+	t0 := time.Now()
+	for h := 0; h <= 24; h++ {
+		if h > 0 {
+			requests.WithLabelValues("/test", "GET", "200").Add(1000)
+			for i := 0; i < 1000; i++ {
+				durations.WithLabelValues("/test", "GET", "200").Observe(0.002)
+			}
+		}
+		st.update(reg, t0.Add(time.Duration(h)*time.Hour))
+	}
+	if v := gauge(sloErrorBudgetRemaining, "test_availability"); v != 1 {
+		t.Errorf("availability budget remaining = %v, want 1", v)
+	}
+
+	// Then an hour with 5% errors and 20% of slow requests.
+	requests.WithLabelValues("/test", "GET", "200").Add(950)
+	requests.WithLabelValues("/test", "GET", "500").Add(50)
+	for i := 0; i < 1000; i++ {
+		d := 0.002
+		if i < 200 {
+			d = 0.008
+		}
+		durations.WithLabelValues("/test", "GET", "200").Observe(d)
+	}
+	st.update(reg, t0.Add(25*time.Hour))
+
+	tests := []struct {
+		slo, window string
+		want        float64
+	}{
+		// 5% of errors for a 1% budget.
+		{"test_availability", "1h", 5},
+		// 50 errors out of 6000 requests.
+		{"test_availability", "6h", 50.0 / 6000 / 0.01},
+		// 20% of slow requests for a 10% budget.
+		{"test_latency", "1h", 2},
+		{"test_latency", "1d", 200.0 / 24000 / 0.1},
+	}
+	for _, tt := range tests {
+		if got := gauge(sloBurnRate, tt.slo, tt.window); !approx(got, tt.want) {
+			t.Errorf("burn rate of %s over %s = %v, want %v", tt.slo, tt.window, got, tt.want)
+		}
+	}
+	// The window only covers the last 24 hours.
+	if got, want := gauge(sloErrorBudgetRemaining, "test_availability"), 1-50.0/24000/0.01; !approx(got, want) {
+		t.Errorf("availability budget remaining = %v, want %v", got, want)
+	}
+	if got := gauge(sloObjective, "test_latency"); got != 0.9 {
+		t.Errorf("objective = %v, want 0.9", got)
+	}
+}
+
+func TestWriteSLORules(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSLORules(&buf, defaultConfig().Objectives); err != nil {
+		t.Fatal(err)
+	}
+	rules := buf.String()
+	for _, want := range []string{
+		"- record: slo:sli_error:ratio_rate5m",
+		"- record: slo:sli_error:ratio_rate3d",
+		`http_request_duration_seconds_bucket{route="/get",le="0.005"}[1h]`,
+		`http_requests_total{route="/add",code=~"5.."}[30m]`,
+		`slo:sli_error:ratio_rate1h{slo="add_latency"} > (14.4 * 0.001)`,
+		`slo:sli_error:ratio_rate3d{slo="get_availability"} > (1 * 0.001)`,
+		"severity: page",
+		"severity: ticket",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules don't contain %q", want)
+		}
+	}
+}
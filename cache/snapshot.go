@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A snapshotter is a cache which content can be saved and restored.
+type snapshotter interface {
+	Save(w io.Writer) error
+	Load(r io.Reader) error
+}
+
+// saveSnapshot saves the content of c into the file at path.
+//
+// The snapshot is first written to a temporary file, then renamed, so that
+// path always contains a complete snapshot.
+func saveSnapshot(c snapshotter, path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := c.Save(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshot restores into c the snapshot saved at path. A missing snapshot
+// file is not an error.
+func loadSnapshot(c snapshotter, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.Load(f)
+}
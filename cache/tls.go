@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certPollInterval is how often certificate files are checked for changes.
+const certPollInterval = 10 * time.Second
+
+// A certStore holds the server certificate and the CA used to verify clients
+// and peers certificates, reloading them when their files change.
+type certStore struct {
+	certFile, keyFile string
+	caFile            string // optional, enables mutual TLS
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// newCertStore creates a certStore and loads the certificates.
+func newCertStore(certFile, keyFile, caFile string) (*certStore, error) {
+	cs := &certStore{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *certStore) files() []string {
+	files := []string{cs.certFile, cs.keyFile}
+	if cs.caFile != "" {
+		files = append(files, cs.caFile)
+	}
+	return files
+}
+
+// load (re)loads the certificates, the current ones are kept in case of error.
+func (cs *certStore) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, f := range cs.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(cs.certFile, cs.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	tlsCertExpiry.WithLabelValues("server").Set(float64(cert.Leaf.NotAfter.Unix()))
+
+	var pool *x509.CertPool
+	if cs.caFile != "" {
+		data, err := ioutil.ReadFile(cs.caFile)
+		if err != nil {
+			return err
+		}
+		var notAfter time.Time
+		if pool, notAfter, err = parseCAs(data); err != nil {
+			return fmt.Errorf("%s: %v", cs.caFile, err)
+		}
+		tlsCertExpiry.WithLabelValues("client_ca").Set(float64(notAfter.Unix()))
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.cert, cs.pool, cs.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// parseCAs parses PEM encoded certificates, returning them in a pool, along
+// with the earliest expiry date.
+func parseCAs(data []byte) (*x509.CertPool, time.Time, error) {
+	var (
+		pool     = x509.NewCertPool()
+		notAfter time.Time
+	)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, notAfter, err
+		}
+		pool.AddCert(cert)
+		if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	if notAfter.IsZero() {
+		return nil, notAfter, fmt.Errorf("no certificate found")
+	}
+	return pool, notAfter, nil
+}
+
+// changed reports whether any of the certificate files has been modified
+// since it's been loaded.
+func (cs *certStore) changed() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, f := range cs.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			// Probably being replaced, retry later.
+			continue
+		}
+		if !fi.ModTime().Equal(cs.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates when their files change, until ctx is done.
+func (cs *certStore) watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !cs.changed() {
+			continue
+		}
+		if err := cs.load(); err != nil {
+			slog.Error("tls: reloading certificates", "err", err)
+			continue
+		}
+		slog.Info("tls: certificates reloaded")
+	}
+}
+
+func (cs *certStore) current() (*tls.Certificate, *x509.CertPool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.cert, cs.pool
+}
+
+// serverConfig returns the TLS configuration of the server, which always uses
+// the latest certificates. Clients must present a certificate signed by the
+// client CA, if any.
+func (cs *certStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := cs.current()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// peerConfig returns the TLS configuration to connect to the peer at
+// serverName: the server certificate is presented as client certificate, and
+// the peer certificate is verified with the client CA.
+func (cs *certStore) peerConfig(serverName string) *tls.Config {
+	cert, pool := cs.current()
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   serverName,
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      pool,
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arl/golab-2019/metrics/metricstest"
+)
+
+// testCA is a self-signed certificate authority generating certificates for
+// tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue writes into dir a certificate for 127.0.0.1, valid for both server
+// and client authentication, and its key. It returns the files paths.
+func (ca *testCA) issue(t *testing.T, dir string, notAfter time.Time) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: "cache"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", kder)
+	return certFile, keyFile
+}
+
+func (ca *testCA) write(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "ca.pem")
+	writePEM(t, path, "CERTIFICATE", ca.cert.Raw)
+	return path
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertStoreMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	certFile, keyFile := ca.issue(t, dir, notAfter)
+	caFile := ca.write(t, dir)
+
+	cs, err := newCertStore(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := metricstest.Value(tlsCertExpiry.WithLabelValues("server")); got != float64(notAfter.Unix()) {
+		t.Errorf("server certificate expiry = %v, want %v", got, notAfter.Unix())
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		TLSConfig: cs.serverConfig(),
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	url := "https://" + l.Addr().String() + "/"
+	get := func(cfg *tls.Config) (*x509.Certificate, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0], nil
+	}
+
+	// A peer presenting its certificate is accepted.
+	served, err := get(cs.peerConfig("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("peer request: %v", err)
+	}
+
+	// Without client certificate, the handshake fails.
+	_, pool := cs.current()
+	if _, err := get(&tls.Config{RootCAs: pool}); err == nil {
+		t.Errorf("request without client certificate should fail")
+	}
+
+	// Certificates are reloaded when their files change.
+	if cs.changed() {
+		t.Fatalf("certificates should not have changed")
+	}
+	ca.issue(t, dir, notAfter.Add(time.Hour))
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if !cs.changed() {
+		t.Fatalf("certificates should have changed")
+	}
+	if err := cs.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := get(cs.peerConfig("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("peer request after reload: %v", err)
+	}
+	if reloaded.SerialNumber.Cmp(served.SerialNumber) == 0 {
+		t.Errorf("server still serves the certificate with serial %v after reload", served.SerialNumber)
+	}
+
+	if err := dialCheck(cs.peerConfig, l.Addr().String())(context.Background()); err != nil {
+		t.Errorf("peers check with mutual TLS: %v", err)
+	}
+}
+
+func TestCertStoreInvalid(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, time.Now().Add(time.Hour))
+
+	if _, err := newCertStore(certFile, certFile, ""); err == nil {
+		t.Errorf("loading a certificate as key should fail")
+	}
+	if _, err := newCertStore(certFile, keyFile, keyFile); err == nil {
+		t.Errorf("loading a key as CA should fail")
+	}
+}
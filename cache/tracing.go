@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/arl/golab-2019/tracing"
+)
+
+// newTracer creates the tracer configured in cfg, or returns a nil tracer,
+// which disables tracing, if there's no exporter. The returned closer, if not
+// nil, must be closed once the tracer is.
+func newTracer(cfg *config) (*tracing.Tracer, io.Closer, error) {
+	var (
+		exp    tracing.Exporter
+		closer io.Closer
+	)
+	switch cfg.TracingExporter {
+	case "none":
+		return nil, nil, nil
+	case "file":
+		f, err := os.OpenFile(cfg.TracingFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		exp, closer = tracing.NewFileExporter(f), f
+	case "otlp":
+		exp = tracing.NewOTLPExporter(cfg.TracingEndpoint, "cache", &http.Client{Timeout: 10 * time.Second})
+	}
+
+	tr := tracing.NewTracer(exp, tracing.Options{
+		SampleRate: cfg.TracingSampleRate,
+		OnError: func(err error, dropped int) {
+			slog.Warn("tracing: spans dropped", "err", err, "count", dropped)
+			tracingSpansDropped.Add(float64(dropped))
+		},
+	})
+	return tr, closer, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arl/golab-2019/tsdb"
+)
+
+// newTSDB creates the embedded time series database, which size is exported
+// with reg.
+func newTSDB(cfg *config, reg prometheus.Registerer) *tsdb.DB {
+	db := tsdb.New(tsdb.Options{Retention: cfg.TSDBRetention})
+	reg.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tsdb_series",
+			Help: "Number of series in the embedded time series database",
+		}, func() float64 {
+			series, _ := db.Stats()
+			return float64(series)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tsdb_chunks_size_bytes",
+			Help: "Size of the compressed samples in the embedded time series database",
+		}, func() float64 {
+			_, size := db.Stats()
+			return float64(size)
+		}),
+	)
+	return db
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTSDBQuery(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MetricsToken = "scrape"
+	s := newTestServer(cfg)
+	s.tsdb = newTSDB(cfg, s.reg)
+	s.setupRoutes()
+
+	for _, k := range []string{"a", "b", "c"} {
+		s.mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/get?k="+k, nil))
+	}
+	now := time.Now()
+	if err := s.tsdb.Scrape(s.reg, now); err != nil {
+		t.Fatal(err)
+	}
+
+	query := url.Values{
+		"query": {`sum(http_requests_total{route="/get"}) + cache_misses_total`},
+		"time":  {now.Format(time.RFC3339Nano)},
+	}
+	r := httptest.NewRequest("GET", "/api/v1/query?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status without metrics token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	r.Header.Set("Authorization", "Bearer scrape")
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	var resp struct {
+		Data struct {
+			Result []struct {
+				Value [2]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("status %d: %v: %s", w.Code, err, w.Body)
+	}
+	if res := resp.Data.Result; len(res) != 1 || res[0].Value[1] != "6" {
+		t.Errorf("result = %+v, want 3 requests + 3 misses", res)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"math"
 	"sync"
+	"time"
 
 	"gonum.org/v1/plot/palette"
 )
@@ -150,9 +151,12 @@ func (m *mandelbrot) renderAnimatedGif(w io.Writer) {
 		go func(i int) {
 			defer wg.Done()
 
+			t0 := time.Now()
 			img := image.NewPaletted(image.Rect(0, 0, m.width, m.height), gopalette.Plan9)
 			m.renderFrame(bounds[i], img)
 			images[i] = img
+			frameDuration.Observe(time.Since(t0).Seconds())
+			framesRendered.Inc()
 		}(i)
 	}
 	wg.Wait()
@@ -3,9 +3,32 @@ package main
 import (
 	"image"
 	gopalette "image/color/palette"
+	"io/ioutil"
 	"testing"
+
+	"github.com/arl/golab-2019/metrics/metricstest"
 )
 
+func TestRenderMetrics(t *testing.T) {
+	reg := metricstest.NewRegistry()
+	reg.MustRegister(framesRendered, frameDuration, renderDuration)
+
+	m := defaultCfg
+	m.nframes = 4
+	m.width, m.height = 16, 16
+	m.maxiter = 64
+
+	before := metricstest.Gather(t, reg)
+	m.renderAnimatedGif(ioutil.Discard)
+	d := metricstest.Diff(before, metricstest.Gather(t, reg))
+
+	metricstest.AssertCounter(t, d, "fractal_frames_rendered_total", nil, 4)
+	metricstest.AssertCount(t, d, "fractal_frame_render_duration_seconds", nil, 4)
+	// Tiny frames render in less than the first bucket, 10ms.
+	metricstest.AssertQuantile(t, d, "fractal_frame_render_duration_seconds", nil, 0.99, 0, 0.01)
+	metricstest.AssertLint(t, metricstest.Gather(t, reg))
+}
+
 func BenchmarkRenderFrame(b *testing.B) {
 	m := defaultCfg
 	img := image.NewPaletted(image.Rect(0, 0, m.width, m.height), gopalette.Plan9)
@@ -5,6 +5,11 @@ import (
 	"log"
 	"os"
 	"runtime/trace"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arl/golab-2019/push"
 )
 
 func check(err error) {
@@ -13,6 +18,45 @@ func check(err error) {
 	}
 }
 
+var (
+	framesRendered = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "fractal_frames_rendered_total",
+			Help: "The total number of frames rendered",
+		})
+
+	frameDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "fractal_frame_render_duration_seconds",
+			Help:    "Duration of the rendering of a frame",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		})
+
+	renderDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "fractal_render_duration_seconds",
+			Help: "Duration of the rendering of the whole animation, GIF encoding included",
+		})
+)
+
+// startPush starts pushing the fractal metrics to the Pushgateway and/or
+// remote write endpoint, if not empty. The returned function must be called
+// before exiting.
+func startPush(gateway, remoteWrite string, interval time.Duration) (stop func()) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(framesRendered, frameDuration, renderDuration)
+
+	instance, _ := os.Hostname()
+	var targets []push.Target
+	if gateway != "" {
+		targets = append(targets, push.NewPusher(gateway, "fractal", map[string]string{"instance": instance}, reg, nil))
+	}
+	if remoteWrite != "" {
+		targets = append(targets, push.NewRemoteWriter(remoteWrite, reg, map[string]string{"job": "fractal", "instance": instance}, nil))
+	}
+	return push.Start(interval, func(err error) { log.Println("push:", err) }, targets...)
+}
+
 // GO111MODULE=off go build .
 // go get gonum.org/.../palette
 
@@ -31,8 +75,14 @@ func main() {
 	dim := flag.Int("dim", m.width, "image dimension")
 	zoomLevel := flag.Float64("zoom", m.zoomLevel, "scale to apply at each frame (zoom)")
 	maxIter := flag.Int("i", m.maxiter, "max iterations to apply on 𝒛")
+	gateway := flag.String("push-gateway", "", "Pushgateway URL to push metrics to, e.g. http://localhost:9091")
+	remoteWrite := flag.String("remote-write", "", "remote write URL to push metrics to, e.g. http://localhost:9090/api/v1/write")
+	pushInterval := flag.Duration("push-interval", 10*time.Second, "interval between metrics pushes, metrics are also pushed on exit")
 	flag.Parse()
 
+	stopPush := startPush(*gateway, *remoteWrite, *pushInterval)
+	defer stopPush()
+
 	m.nframes = *nframes
 	m.width, m.height = *dim, *dim
 	m.zoomLevel = *zoomLevel
@@ -42,5 +92,7 @@ func main() {
 	check(err)
 	defer giff.Close()
 
+	t0 := time.Now()
 	m.renderAnimatedGif(giff)
+	renderDuration.Set(time.Since(t0).Seconds())
 }
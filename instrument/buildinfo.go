@@ -0,0 +1,45 @@
+package instrument
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NewBuildInfo returns a collector exporting build_info, a gauge always set to
+// 1, labelled by version, revision and goversion, typically used to annotate
+// deployments on dashboards.
+//
+// version and revision are usually set at link time, with:
+//
+//	go build -ldflags "-X main.version=v1.0.0 -X main.revision=$(git rev-parse HEAD)"
+//
+// If empty, version defaults to the main module version, and revision to the
+// VCS revision recorded by the go command, or "unknown".
+func NewBuildInfo(version, revision string) prometheus.Collector {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			if revision == "" && s.Key == "vcs.revision" {
+				revision = s.Value
+			}
+		}
+	}
+	if version == "" {
+		version = "unknown"
+	}
+	if revision == "" {
+		revision = "unknown"
+	}
+
+	g := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "build_info",
+			Help: "Build information, always 1",
+		}, []string{"version", "revision", "goversion"})
+	g.WithLabelValues(version, revision, runtime.Version()).Set(1)
+	return g
+}
@@ -0,0 +1,200 @@
+// Package instrument provides an HTTP middleware recording the RED metrics
+// (Rate, Errors and Duration) of the requests served by a handler.
+//
+// Requests are partitioned by route, HTTP method and status code. For each
+// route, the middleware records:
+//   - http_requests_total: the number of requests served
+//   - http_request_duration_seconds: a histogram of requests durations
+//   - http_request_size_bytes: a histogram of approximate requests sizes
+//   - http_response_size_bytes: a histogram of responses sizes
+//   - http_requests_in_flight: the number of requests being served
+//
+// The requests count, duration and in-flight metrics can also be recorded with
+// a metrics.Provider, for monitoring systems other than Prometheus.
+//
+// It also provides collectors for the build information and the Go runtime
+// metrics.
+package instrument
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/arl/golab-2019/metrics"
+)
+
+// Opts configures the metrics recorded by the middleware.
+type Opts struct {
+	// Namespace, if not empty, prefixes the name of all metrics.
+	Namespace string
+
+	// DurationBuckets are the buckets of the request duration histogram, in
+	// seconds. Defaults to prometheus.DefBuckets.
+	DurationBuckets []float64
+
+	// SizeBuckets are the buckets of the request and response size
+	// histograms, in bytes. Defaults to DefSizeBuckets.
+	SizeBuckets []float64
+
+	// Provider, if not nil, also records the requests count, duration and
+	// in-flight metrics, with the same names and labels. It must not register
+	// them with the same Prometheus registry.
+	Provider metrics.Provider
+}
+
+// DefSizeBuckets are the default buckets of the request and response size
+// histograms, from 32B to 512KiB.
+var DefSizeBuckets = prometheus.ExponentialBuckets(32, 4, 8)
+
+// Metrics holds the metrics recorded by the middleware.
+type Metrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	reqSize  *prometheus.HistogramVec
+	respSize *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+
+	// Recorded with Opts.Provider, if not nil.
+	pRequests metrics.CounterVec
+	pDuration metrics.HistogramVec
+	pInFlight metrics.GaugeVec
+}
+
+// New creates the middleware metrics and registers them with reg. It panics if
+// any of the metrics can't be registered.
+func New(reg prometheus.Registerer, opts Opts) *Metrics {
+	if opts.DurationBuckets == nil {
+		opts.DurationBuckets = prometheus.DefBuckets
+	}
+	if opts.SizeBuckets == nil {
+		opts.SizeBuckets = DefSizeBuckets
+	}
+
+	labels := []string{"route", "method", "code"}
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: opts.Namespace,
+				Name:      "http_requests_total",
+				Help:      "The total number of HTTP requests",
+			}, labels),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: opts.Namespace,
+				Name:      "http_request_duration_seconds",
+				Help:      "The duration of HTTP requests",
+				Buckets:   opts.DurationBuckets,
+			}, labels),
+		reqSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: opts.Namespace,
+				Name:      "http_request_size_bytes",
+				Help:      "The approximate size of HTTP requests",
+				Buckets:   opts.SizeBuckets,
+			}, labels),
+		respSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: opts.Namespace,
+				Name:      "http_response_size_bytes",
+				Help:      "The size of HTTP responses",
+				Buckets:   opts.SizeBuckets,
+			}, labels),
+		inFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: opts.Namespace,
+				Name:      "http_requests_in_flight",
+				Help:      "The number of HTTP requests currently being served",
+			}, []string{"route"}),
+	}
+	reg.MustRegister(m.requests, m.duration, m.reqSize, m.respSize, m.inFlight)
+
+	if p := opts.Provider; p != nil {
+		prefix := ""
+		if opts.Namespace != "" {
+			prefix = opts.Namespace + "_"
+		}
+		m.pRequests = p.NewCounter(metrics.Opts{
+			Name:   prefix + "http_requests_total",
+			Help:   "The total number of HTTP requests",
+			Labels: labels,
+		})
+		m.pDuration = p.NewHistogram(metrics.Opts{
+			Name:    prefix + "http_request_duration_seconds",
+			Help:    "The duration of HTTP requests",
+			Labels:  labels,
+			Buckets: opts.DurationBuckets,
+		})
+		m.pInFlight = p.NewGauge(metrics.Opts{
+			Name:   prefix + "http_requests_in_flight",
+			Help:   "The number of HTTP requests currently being served",
+			Labels: []string{"route"},
+		})
+	}
+	return m
+}
+
+// Handler wraps h so that the requests it serves are recorded under the given
+// route. Routes should be bounded in number, like the patterns registered on
+// an http.ServeMux, not request paths.
+func (m *Metrics) Handler(route string, h http.Handler) http.Handler {
+	curry := prometheus.Labels{"route": route}
+	h = promhttp.InstrumentHandlerResponseSize(m.respSize.MustCurryWith(curry), h)
+	h = promhttp.InstrumentHandlerRequestSize(m.reqSize.MustCurryWith(curry), h)
+	h = promhttp.InstrumentHandlerDuration(m.duration.MustCurryWith(curry), h)
+	h = promhttp.InstrumentHandlerCounter(m.requests.MustCurryWith(curry), h)
+	h = promhttp.InstrumentHandlerInFlight(m.inFlight.WithLabelValues(route), h)
+	if m.pRequests != nil {
+		h = m.providerHandler(route, h)
+	}
+	return h
+}
+
+// providerHandler wraps h so that its requests are recorded with the
+// provider metrics.
+func (m *Metrics) providerHandler(route string, h http.Handler) http.Handler {
+	inFlight := m.pInFlight.With(route)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		t0 := time.Now()
+		h.ServeHTTP(rec, r)
+		method, code := strings.ToLower(r.Method), strconv.Itoa(rec.status)
+		m.pDuration.With(route, method, code).Observe(time.Since(t0).Seconds())
+		m.pRequests.With(route, method, code).Inc()
+	})
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = code, true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		r.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
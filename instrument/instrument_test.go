@@ -0,0 +1,153 @@
+package instrument
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/arl/golab-2019/metrics"
+)
+
+func gather(t *testing.T, reg *prometheus.Registry) map[string]*dto.MetricFamily {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		m[mf.GetName()] = mf
+	}
+	return m
+}
+
+func labelsOf(m *dto.Metric) map[string]string {
+	l := make(map[string]string)
+	for _, lp := range m.GetLabel() {
+		l[lp.GetName()] = lp.GetValue()
+	}
+	return l
+}
+
+func TestHandler(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := New(reg, Opts{Namespace: "test", DurationBuckets: []float64{0.1, 1}})
+
+	h := m.Handler("/hello", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+
+	for _, url := range []string{"/hello", "/hello", "/hello?fail=1"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hello", strings.NewReader("body")))
+
+	mfs := gather(t, reg)
+
+	counts := make(map[string]float64)
+	for _, metric := range mfs["test_http_requests_total"].GetMetric() {
+		l := labelsOf(metric)
+		if l["route"] != "/hello" {
+			t.Errorf("route = %q, want %q", l["route"], "/hello")
+		}
+		counts[l["method"]+" "+l["code"]] = metric.GetCounter().GetValue()
+	}
+	want := map[string]float64{"get 200": 2, "get 400": 1, "post 200": 1}
+	for k, v := range want {
+		if counts[k] != v {
+			t.Errorf("requests{%s} = %v, want %v", k, counts[k], v)
+		}
+	}
+
+	for _, name := range []string{
+		"test_http_request_duration_seconds",
+		"test_http_request_size_bytes",
+		"test_http_response_size_bytes",
+	} {
+		var n uint64
+		for _, metric := range mfs[name].GetMetric() {
+			n += metric.GetHistogram().GetSampleCount()
+		}
+		if n != 4 {
+			t.Errorf("%s sample count = %d, want 4", name, n)
+		}
+	}
+
+	buckets := mfs["test_http_request_duration_seconds"].GetMetric()[0].GetHistogram().GetBucket()
+	if len(buckets) != 2 || buckets[1].GetUpperBound() != 1 {
+		t.Errorf("duration buckets = %v, want [0.1 1]", buckets)
+	}
+
+	inflight := mfs["test_http_requests_in_flight"].GetMetric()
+	if len(inflight) != 1 || inflight[0].GetGauge().GetValue() != 0 {
+		t.Errorf("in flight = %v, want 0", inflight)
+	}
+}
+
+func TestHandlerInFlight(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg, Opts{})
+
+	var inflight float64
+	h := m.Handler("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight = gather(t, reg)["http_requests_in_flight"].GetMetric()[0].GetGauge().GetValue()
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if inflight != 1 {
+		t.Errorf("in flight while serving = %v, want 1", inflight)
+	}
+}
+
+func TestHandlerProvider(t *testing.T) {
+	// The provider records with its own registry, as another backend would.
+	preg := prometheus.NewPedanticRegistry()
+	var inflight float64
+	m := New(prometheus.NewRegistry(), Opts{Namespace: "test", Provider: metrics.NewPrometheus(preg)})
+	h := m.Handler("/hello", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight = gather(t, preg)["test_http_requests_in_flight"].GetMetric()[0].GetGauge().GetValue()
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	for _, url := range []string{"/hello", "/hello", "/hello?fail=1"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+	if inflight != 1 {
+		t.Errorf("in flight while serving = %v, want 1", inflight)
+	}
+
+	mfs := gather(t, preg)
+	counts := make(map[string]float64)
+	for _, metric := range mfs["test_http_requests_total"].GetMetric() {
+		l := labelsOf(metric)
+		counts[l["route"]+" "+l["method"]+" "+l["code"]] = metric.GetCounter().GetValue()
+	}
+	want := map[string]float64{"/hello get 200": 2, "/hello get 400": 1}
+	for k, v := range want {
+		if counts[k] != v {
+			t.Errorf("requests{%s} = %v, want %v", k, counts[k], v)
+		}
+	}
+
+	var n uint64
+	for _, metric := range mfs["test_http_request_duration_seconds"].GetMetric() {
+		n += metric.GetHistogram().GetSampleCount()
+	}
+	if n != 3 {
+		t.Errorf("duration sample count = %d, want 3", n)
+	}
+	if g := mfs["test_http_requests_in_flight"].GetMetric()[0].GetGauge().GetValue(); g != 0 {
+		t.Errorf("in flight = %v, want 0", g)
+	}
+}
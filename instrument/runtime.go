@@ -0,0 +1,140 @@
+package instrument
+
+import (
+	"math"
+	"runtime/metrics"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RuntimeOpts selects the Go runtime metrics exported by a runtime collector.
+type RuntimeOpts struct {
+	// GC exports go_gc_pauses_seconds, a histogram of the stop-the-world
+	// pauses caused by the garbage collector.
+	GC bool
+
+	// Sched exports go_sched_latencies_seconds, a histogram of the time
+	// goroutines spend runnable before running, and go_sched_goroutines, the
+	// number of goroutines by state.
+	Sched bool
+
+	// Memory exports go_memory_classes_*_bytes, the memory mapped by the Go
+	// runtime, by class.
+	Memory bool
+
+	// Buckets are the buckets of the histograms, in seconds. Defaults to
+	// DefRuntimeBuckets.
+	Buckets []float64
+}
+
+// DefRuntimeBuckets are the default buckets of the runtime histograms, from
+// 1µs to 1s.
+var DefRuntimeBuckets = prometheus.ExponentialBuckets(1e-6, 4, 11)
+
+// runtimeMetric maps a runtime/metrics sample to a Prometheus metric.
+type runtimeMetric struct {
+	desc  *prometheus.Desc
+	label string // value of the desc single variable label, if any
+}
+
+type runtimeCollector struct {
+	samples []metrics.Sample
+	metrics []runtimeMetric // same order as samples
+	buckets []float64
+}
+
+// NewRuntimeCollector returns a collector exporting the Go runtime metrics
+// selected by opts, read with the runtime/metrics package. It complements
+// prometheus.NewGoCollector, which is based on runtime.MemStats.
+func NewRuntimeCollector(opts RuntimeOpts) prometheus.Collector {
+	c := &runtimeCollector{buckets: opts.Buckets}
+	if c.buckets == nil {
+		c.buckets = DefRuntimeBuckets
+	}
+	add := func(name string, m runtimeMetric) {
+		c.samples = append(c.samples, metrics.Sample{Name: name})
+		c.metrics = append(c.metrics, m)
+	}
+
+	goroutines := prometheus.NewDesc("go_sched_goroutines", "Number of goroutines, by state.", []string{"state"}, nil)
+	for _, d := range metrics.All() {
+		switch {
+		case opts.GC && d.Name == "/sched/pauses/total/gc:seconds":
+			add(d.Name, runtimeMetric{desc: prometheus.NewDesc("go_gc_pauses_seconds", d.Description, nil, nil)})
+		case opts.Sched && d.Name == "/sched/latencies:seconds":
+			add(d.Name, runtimeMetric{desc: prometheus.NewDesc("go_sched_latencies_seconds", d.Description, nil, nil)})
+		case opts.Sched && strings.HasPrefix(d.Name, "/sched/goroutines/") && d.Kind == metrics.KindUint64:
+			state := strings.TrimSuffix(strings.TrimPrefix(d.Name, "/sched/goroutines/"), ":goroutines")
+			add(d.Name, runtimeMetric{desc: goroutines, label: state})
+		case opts.Memory && strings.HasPrefix(d.Name, "/memory/classes/") && d.Kind == metrics.KindUint64:
+			class := strings.TrimSuffix(strings.TrimPrefix(d.Name, "/memory/classes/"), ":bytes")
+			name := "go_memory_classes_" + strings.NewReplacer("/", "_", "-", "_").Replace(class) + "_bytes"
+			add(d.Name, runtimeMetric{desc: prometheus.NewDesc(name, d.Description, nil, nil)})
+		}
+	}
+	return c
+}
+
+func (c *runtimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	seen := make(map[*prometheus.Desc]bool)
+	for _, m := range c.metrics {
+		if !seen[m.desc] {
+			seen[m.desc] = true
+			ch <- m.desc
+		}
+	}
+}
+
+func (c *runtimeCollector) Collect(ch chan<- prometheus.Metric) {
+	samples := make([]metrics.Sample, len(c.samples))
+	copy(samples, c.samples)
+	metrics.Read(samples)
+
+	for i, s := range samples {
+		m := c.metrics[i]
+		var labels []string
+		if m.label != "" {
+			labels = []string{m.label}
+		}
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, float64(s.Value.Uint64()), labels...)
+		case metrics.KindFloat64Histogram:
+			count, sum, buckets := rebucket(s.Value.Float64Histogram(), c.buckets)
+			ch <- prometheus.MustNewConstHistogram(m.desc, count, sum, buckets, labels...)
+		}
+	}
+}
+
+// rebucket converts a runtime histogram into a Prometheus one with the given
+// upper bounds. A runtime bucket is counted in the first bucket including its
+// upper bound entirely. The sum is estimated with the middle of the buckets.
+func rebucket(h *metrics.Float64Histogram, bounds []float64) (count uint64, sum float64, buckets map[float64]uint64) {
+	buckets = make(map[float64]uint64, len(bounds))
+	j := 0
+	var cum uint64
+	for i, n := range h.Counts {
+		lo, hi := h.Buckets[i], h.Buckets[i+1]
+		for j < len(bounds) && hi > bounds[j] {
+			buckets[bounds[j]] = cum
+			j++
+		}
+		cum += n
+		if n == 0 {
+			continue
+		}
+		switch {
+		case math.IsInf(lo, -1):
+			sum += float64(n) * hi
+		case math.IsInf(hi, 1):
+			sum += float64(n) * lo
+		default:
+			sum += float64(n) * (lo + hi) / 2
+		}
+	}
+	for ; j < len(bounds); j++ {
+		buckets[bounds[j]] = cum
+	}
+	return cum, sum, buckets
+}
@@ -0,0 +1,79 @@
+package instrument
+
+import (
+	"math"
+	"runtime"
+	"runtime/metrics"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRebucket(t *testing.T) {
+	h := &metrics.Float64Histogram{
+		Buckets: []float64{math.Inf(-1), 0, 1, 2, 4, math.Inf(1)},
+		Counts:  []uint64{0, 3, 2, 1, 1},
+	}
+	count, sum, buckets := rebucket(h, []float64{1, 3, 4})
+	if count != 7 {
+		t.Errorf("count = %d, want 7", count)
+	}
+	// 3 in [0,1), 2 in [1,2), 1 in [2,4) and 1 in [4,+Inf).
+	if want := 3*0.5 + 2*1.5 + 1*3.0 + 1*4.0; sum != want {
+		t.Errorf("sum = %v, want %v", sum, want)
+	}
+	// [2,4) isn't entirely below 3, so it's only counted from 4.
+	want := map[float64]uint64{1: 3, 3: 5, 4: 6}
+	for b, n := range want {
+		if buckets[b] != n {
+			t.Errorf("bucket %v = %d, want %d", b, buckets[b], n)
+		}
+	}
+}
+
+func TestRuntimeCollector(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewRuntimeCollector(RuntimeOpts{GC: true, Sched: true, Memory: true}))
+	runtime.GC()
+
+	mfs := gather(t, reg)
+	for _, name := range []string{"go_gc_pauses_seconds", "go_sched_latencies_seconds"} {
+		h := mfs[name].GetMetric()[0].GetHistogram()
+		if len(h.GetBucket()) != len(DefRuntimeBuckets) {
+			t.Errorf("%s has %d buckets, want %d", name, len(h.GetBucket()), len(DefRuntimeBuckets))
+		}
+	}
+	if mfs["go_gc_pauses_seconds"].GetMetric()[0].GetHistogram().GetSampleCount() == 0 {
+		t.Errorf("no GC pause recorded after runtime.GC()")
+	}
+	if v := mfs["go_memory_classes_total_bytes"].GetMetric()[0].GetGauge().GetValue(); v == 0 {
+		t.Errorf("go_memory_classes_total_bytes = 0")
+	}
+	if _, ok := mfs["go_memory_classes_os_stacks_bytes"]; !ok {
+		t.Errorf("go_memory_classes_os_stacks_bytes not exported")
+	}
+	states := make(map[string]bool)
+	for _, m := range mfs["go_sched_goroutines"].GetMetric() {
+		states[labelsOf(m)["state"]] = true
+	}
+	if !states["running"] || !states["waiting"] {
+		t.Errorf("goroutine states = %v", states)
+	}
+
+	// Only the selected groups are exported.
+	reg = prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewRuntimeCollector(RuntimeOpts{GC: true}))
+	if mfs = gather(t, reg); len(mfs) != 1 {
+		t.Errorf("got %d metrics with GC only, want 1", len(mfs))
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewBuildInfo("v1.2.3", "abcdef"))
+
+	l := labelsOf(gather(t, reg)["build_info"].GetMetric()[0])
+	if l["version"] != "v1.2.3" || l["revision"] != "abcdef" || l["goversion"] != runtime.Version() {
+		t.Errorf("build_info labels = %v", l)
+	}
+}
@@ -0,0 +1,271 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Overflow is the value of all the labels of the series collecting the
+// updates of the label combinations exceeding the limit of a guarded vector.
+const Overflow = "__overflow__"
+
+// A CardinalityGuard limits the number of series, i.e. of label values
+// combinations, of Prometheus metric vectors, so that a label taking
+// unbounded values, such as one derived from user input, can't overwhelm
+// Prometheus.
+//
+// Once a guarded vector reaches its limit, updates of new combinations are
+// recorded in a single series which labels are all Overflow, and counted by
+// metric_series_dropped_total.
+type CardinalityGuard struct {
+	max     int
+	limits  map[string]int
+	dropped *prometheus.CounterVec
+
+	mu      sync.Mutex
+	metrics []*seriesSet
+}
+
+// NewCardinalityGuard creates a guard limiting the number of series of the
+// vectors it creates to max, unless limits, by metric name, says otherwise.
+// A limit of 0 means no limit. The metric_series_dropped_total counter is
+// registered with reg.
+func NewCardinalityGuard(reg prometheus.Registerer, max int, limits map[string]int) *CardinalityGuard {
+	g := &CardinalityGuard{
+		max:    max,
+		limits: limits,
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "metric_series_dropped_total",
+				Help: "The total number of updates of series exceeding the series limit of their metric, recorded in its overflow series, by metric",
+			}, []string{"metric"}),
+	}
+	reg.MustRegister(g.dropped)
+	return g
+}
+
+// track returns the set of series of a new vector.
+func (g *CardinalityGuard) track(name string, labels []string) *seriesSet {
+	limit, ok := g.limits[name]
+	if !ok {
+		limit = g.max
+	}
+	s := &seriesSet{
+		name:    name,
+		labels:  labels,
+		limit:   limit,
+		series:  make(map[string][]string),
+		dropped: g.dropped.WithLabelValues(name),
+	}
+	g.mu.Lock()
+	g.metrics = append(g.metrics, s)
+	g.mu.Unlock()
+	return s
+}
+
+// seriesSet records the label values combinations of a vector.
+type seriesSet struct {
+	name    string
+	labels  []string
+	limit   int
+	dropped prometheus.Counter
+
+	mu       sync.Mutex
+	series   map[string][]string // label values, by their joined values
+	overflow float64             // number of updates of the overflow series
+}
+
+// admit returns the label values under which an update of the series with
+// label values lvs is recorded: lvs, or Overflow for each label if it's a new
+// combination and the limit is reached.
+func (s *seriesSet) admit(lvs []string) []string {
+	if len(lvs) != len(s.labels) {
+		return lvs // let the vector report the error
+	}
+	key := strings.Join(lvs, "\xff")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.series[key]; ok {
+		return lvs
+	}
+	if s.limit > 0 && len(s.series) >= s.limit {
+		s.overflow++
+		s.dropped.Inc()
+		overflow := make([]string, len(lvs))
+		for i := range overflow {
+			overflow[i] = Overflow
+		}
+		return overflow
+	}
+	s.series[key] = append([]string(nil), lvs...)
+	return lvs
+}
+
+// A GuardedCounterVec is a prometheus.CounterVec which number of series is
+// limited.
+type GuardedCounterVec struct {
+	v *prometheus.CounterVec
+	s *seriesSet
+}
+
+// NewCounterVec creates a counter vector guarded by g. It must be registered
+// like any collector.
+func (g *CardinalityGuard) NewCounterVec(opts prometheus.CounterOpts, labels []string) *GuardedCounterVec {
+	return &GuardedCounterVec{
+		v: prometheus.NewCounterVec(opts, labels),
+		s: g.track(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), labels),
+	}
+}
+
+// WithLabelValues returns the counter of the label values, or the overflow
+// counter.
+func (v *GuardedCounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	return v.v.WithLabelValues(v.s.admit(lvs)...)
+}
+
+func (v *GuardedCounterVec) Describe(ch chan<- *prometheus.Desc) { v.v.Describe(ch) }
+func (v *GuardedCounterVec) Collect(ch chan<- prometheus.Metric) { v.v.Collect(ch) }
+
+// A GuardedGaugeVec is a prometheus.GaugeVec which number of series is
+// limited.
+type GuardedGaugeVec struct {
+	v *prometheus.GaugeVec
+	s *seriesSet
+}
+
+// NewGaugeVec creates a gauge vector guarded by g. It must be registered like
+// any collector.
+func (g *CardinalityGuard) NewGaugeVec(opts prometheus.GaugeOpts, labels []string) *GuardedGaugeVec {
+	return &GuardedGaugeVec{
+		v: prometheus.NewGaugeVec(opts, labels),
+		s: g.track(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), labels),
+	}
+}
+
+// WithLabelValues returns the gauge of the label values, or the overflow
+// gauge.
+func (v *GuardedGaugeVec) WithLabelValues(lvs ...string) prometheus.Gauge {
+	return v.v.WithLabelValues(v.s.admit(lvs)...)
+}
+
+func (v *GuardedGaugeVec) Describe(ch chan<- *prometheus.Desc) { v.v.Describe(ch) }
+func (v *GuardedGaugeVec) Collect(ch chan<- prometheus.Metric) { v.v.Collect(ch) }
+
+// A GuardedHistogramVec is a prometheus.HistogramVec which number of series
+// is limited.
+type GuardedHistogramVec struct {
+	v *prometheus.HistogramVec
+	s *seriesSet
+}
+
+// NewHistogramVec creates a histogram vector guarded by g. It must be
+// registered like any collector.
+func (g *CardinalityGuard) NewHistogramVec(opts prometheus.HistogramOpts, labels []string) *GuardedHistogramVec {
+	return &GuardedHistogramVec{
+		v: prometheus.NewHistogramVec(opts, labels),
+		s: g.track(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), labels),
+	}
+}
+
+// WithLabelValues returns the histogram of the label values, or the overflow
+// histogram.
+func (v *GuardedHistogramVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	return v.v.WithLabelValues(v.s.admit(lvs)...)
+}
+
+func (v *GuardedHistogramVec) Describe(ch chan<- *prometheus.Desc) { v.v.Describe(ch) }
+func (v *GuardedHistogramVec) Collect(ch chan<- prometheus.Metric) { v.v.Collect(ch) }
+
+// MetricCardinality reports the series of a guarded metric.
+type MetricCardinality struct {
+	Metric   string             `json:"metric"`
+	Limit    int                `json:"limit"`    // 0 if unlimited
+	Series   int                `json:"series"`   // excluding the overflow series
+	Overflow float64            `json:"overflow"` // updates of the overflow series
+	Labels   []LabelCardinality `json:"labels"`
+}
+
+// LabelCardinality reports the values of a label of a guarded metric.
+type LabelCardinality struct {
+	Name   string       `json:"name"`
+	Values int          `json:"values"` // number of distinct values
+	Top    []LabelValue `json:"top"`    // values with the most series first
+}
+
+// A LabelValue is a label value and the number of series having it.
+type LabelValue struct {
+	Value  string `json:"value"`
+	Series int    `json:"series"`
+}
+
+// Report returns the cardinality of the guarded metrics, those with the most
+// series first, with the top label values of each label.
+func (g *CardinalityGuard) Report(top int) []MetricCardinality {
+	g.mu.Lock()
+	sets := append([]*seriesSet(nil), g.metrics...)
+	g.mu.Unlock()
+
+	report := make([]MetricCardinality, 0, len(sets))
+	for _, s := range sets {
+		s.mu.Lock()
+		mc := MetricCardinality{Metric: s.name, Limit: s.limit, Series: len(s.series), Overflow: s.overflow, Labels: []LabelCardinality{}}
+		counts := make([]map[string]int, len(s.labels))
+		for i := range counts {
+			counts[i] = make(map[string]int)
+		}
+		for _, lvs := range s.series {
+			for i, lv := range lvs {
+				counts[i][lv]++
+			}
+		}
+		s.mu.Unlock()
+
+		for i, name := range s.labels {
+			lc := LabelCardinality{Name: name, Values: len(counts[i]), Top: []LabelValue{}}
+			for v, n := range counts[i] {
+				lc.Top = append(lc.Top, LabelValue{Value: v, Series: n})
+			}
+			sort.Slice(lc.Top, func(i, j int) bool {
+				if lc.Top[i].Series != lc.Top[j].Series {
+					return lc.Top[i].Series > lc.Top[j].Series
+				}
+				return lc.Top[i].Value < lc.Top[j].Value
+			})
+			if len(lc.Top) > top {
+				lc.Top = lc.Top[:top]
+			}
+			mc.Labels = append(mc.Labels, lc)
+		}
+		report = append(report, mc)
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		if report[i].Series != report[j].Series {
+			return report[i].Series > report[j].Series
+		}
+		return report[i].Metric < report[j].Metric
+	})
+	return report
+}
+
+// Handler serves the cardinality report as JSON, with the number of top label
+// values in the 'top' query parameter, 10 by default.
+func (g *CardinalityGuard) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		top := 10
+		if v := r.URL.Query().Get("top"); v != "" {
+			var err error
+			if top, err = strconv.Atoi(v); err != nil || top < 0 {
+				http.Error(w, "invalid top", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.Report(top))
+	})
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arl/golab-2019/metrics/metricstest"
+)
+
+func TestCardinalityGuard(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := NewCardinalityGuard(reg, 3, map[string]int{"unlimited_total": 0})
+	reqs := g.NewCounterVec(prometheus.CounterOpts{Name: "requests_total"}, []string{"route", "client"})
+	unlimited := g.NewCounterVec(prometheus.CounterOpts{Name: "unlimited_total"}, []string{"key"})
+	reg.MustRegister(reqs, unlimited)
+
+	reqs.WithLabelValues("/get", "a").Inc()
+	reqs.WithLabelValues("/get", "b").Inc()
+	reqs.WithLabelValues("/add", "a").Inc()
+	// Over the limit.
+	reqs.WithLabelValues("/get", "c").Inc()
+	reqs.WithLabelValues("/get", "d").Add(2)
+	// Existing series are still updated.
+	reqs.WithLabelValues("/get", "a").Inc()
+	for i := 0; i < 10; i++ {
+		unlimited.WithLabelValues(strconv.Itoa(i)).Inc()
+	}
+
+	if v := metricstest.Value(reqs.WithLabelValues("/get", "a")); v != 2 {
+		t.Errorf("requests_total{/get,a} = %v, want 2", v)
+	}
+	if v := metricstest.Value(reqs.v.WithLabelValues(Overflow, Overflow)); v != 3 {
+		t.Errorf("overflow series = %v, want 3", v)
+	}
+	if v := metricstest.Value(g.dropped.WithLabelValues("requests_total")); v != 2 {
+		t.Errorf("metric_series_dropped_total = %v, want 2", v)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := make(map[string]int)
+	for _, mf := range mfs {
+		series[mf.GetName()] = len(mf.GetMetric())
+	}
+	if series["requests_total"] != 4 || series["unlimited_total"] != 10 {
+		t.Errorf("series = %v, want 4 requests_total (with the overflow one) and 10 unlimited_total", series)
+	}
+
+	report := g.Report(1)
+	if len(report) != 2 || report[0].Metric != "unlimited_total" || report[1].Metric != "requests_total" {
+		t.Fatalf("report = %+v, want unlimited_total then requests_total", report)
+	}
+	r := report[1]
+	if r.Limit != 3 || r.Series != 3 || r.Overflow != 2 {
+		t.Errorf("requests_total report = %+v", r)
+	}
+	if len(r.Labels) != 2 || r.Labels[0].Name != "route" || r.Labels[0].Values != 2 ||
+		len(r.Labels[0].Top) != 1 || r.Labels[0].Top[0] != (LabelValue{Value: "/get", Series: 2}) {
+		t.Errorf("requests_total labels = %+v", r.Labels)
+	}
+
+	w := httptest.NewRecorder()
+	g.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/cardinality?top=5", nil))
+	var served []MetricCardinality
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 2 || len(served[0].Labels[0].Top) != 5 {
+		t.Errorf("served report = %+v", served)
+	}
+}
+
+func TestPrometheusGuard(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p := NewPrometheus(reg)
+	p.Guard = NewCardinalityGuard(reg, 1, nil)
+	record(p)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "requests_total" {
+			continue
+		}
+		m := mf.GetMetric()
+		if len(m) != 2 || m[1].GetLabel()[0].GetValue() != Overflow || m[1].GetCounter().GetValue() != 1 {
+			t.Errorf("requests_total = %v, want code 200 and overflow series", m)
+		}
+	}
+}
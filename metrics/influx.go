@@ -0,0 +1,268 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfluxOpts configures an Influx provider.
+type InfluxOpts struct {
+	// Token, if not empty, is sent in the Authorization header, as expected
+	// by InfluxDB 2.
+	Token string
+
+	// FlushInterval is the interval between writes, defaults to 10s.
+	FlushInterval time.Duration
+
+	// Client sends the requests, defaults to http.DefaultClient.
+	Client *http.Client
+
+	// OnError, if not nil, is called when metrics can't be written in the
+	// background.
+	OnError func(error)
+}
+
+// Influx is a Provider aggregating metrics in memory and periodically writing
+// their values to InfluxDB, with the line protocol over HTTP.
+//
+// Each series is written as a point of the measurement named after the
+// metric, tagged with its labels. Counters and gauges have a single field,
+// value. Histograms have the fields count, sum, and le_<bound> for the
+// cumulative count of each bucket.
+type Influx struct {
+	url  string
+	opts InfluxOpts
+	now  func() time.Time
+
+	mu     sync.Mutex
+	series map[string]*influxSeries // by key
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewInflux creates an Influx provider writing to writeURL, e.g.
+// http://localhost:8086/write?db=cache for InfluxDB 1, or
+// http://localhost:8086/api/v2/write?org=o&bucket=cache for InfluxDB 2.
+func NewInflux(writeURL string, opts InfluxOpts) *Influx {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	in := &Influx{
+		url:    writeURL,
+		opts:   opts,
+		now:    time.Now,
+		series: make(map[string]*influxSeries),
+		done:   make(chan struct{}),
+	}
+	in.wg.Add(1)
+	go in.run()
+	return in
+}
+
+func (in *Influx) run() {
+	defer in.wg.Done()
+	t := time.NewTicker(in.opts.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-in.done:
+			return
+		case <-t.C:
+			if err := in.Flush(); err != nil && in.opts.OnError != nil {
+				in.opts.OnError(err)
+			}
+		}
+	}
+}
+
+// Close writes the metrics a last time.
+func (in *Influx) Close() error {
+	close(in.done)
+	in.wg.Wait()
+	return in.Flush()
+}
+
+type influxKind int
+
+const (
+	influxCounter influxKind = iota
+	influxGauge
+	influxHistogram
+)
+
+// influxSeries holds the state of a series, protected by Influx.mu.
+type influxSeries struct {
+	key   string // measurement and tags
+	kind  influxKind
+	value float64 // counters and gauges
+
+	// Histograms.
+	bounds []float64
+	counts []uint64 // per bucket, non cumulative
+	count  uint64
+	sum    float64
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// get returns the series of a metric, creating it if needed.
+func (in *Influx) get(kind influxKind, opts Opts, lvs []string) *influxSeries {
+	type tag struct{ k, v string }
+	tags := make([]tag, 0, len(opts.Labels))
+	for i, l := range opts.Labels {
+		if lvs[i] != "" { // empty tag values are invalid
+			tags = append(tags, tag{l, lvs[i]})
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].k < tags[j].k })
+	key := influxMeasurementEscaper.Replace(opts.Name)
+	for _, t := range tags {
+		key += "," + influxTagEscaper.Replace(t.k) + "=" + influxTagEscaper.Replace(t.v)
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	s, ok := in.series[key]
+	if !ok {
+		s = &influxSeries{key: key, kind: kind}
+		if kind == influxHistogram {
+			s.bounds = opts.Buckets
+			if s.bounds == nil {
+				s.bounds = DefBuckets
+			}
+			s.counts = make([]uint64, len(s.bounds))
+		}
+		in.series[key] = s
+	}
+	return s
+}
+
+// Flush writes the current values of all series.
+func (in *Influx) Flush() error {
+	ts := strconv.FormatInt(in.now().UnixNano(), 10)
+
+	var buf bytes.Buffer
+	in.mu.Lock()
+	keys := make([]string, 0, len(in.series))
+	for k := range in.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := in.series[k]
+		buf.WriteString(s.key)
+		buf.WriteByte(' ')
+		switch s.kind {
+		case influxCounter, influxGauge:
+			buf.WriteString("value=" + formatValue(s.value))
+		case influxHistogram:
+			buf.WriteString("count=" + strconv.FormatUint(s.count, 10) + "i,sum=" + formatValue(s.sum))
+			var cum uint64
+			for i, b := range s.bounds {
+				cum += s.counts[i]
+				buf.WriteString(",le_" + formatValue(b) + "=" + strconv.FormatUint(cum, 10) + "i")
+			}
+		}
+		buf.WriteString(" " + ts + "\n")
+	}
+	in.mu.Unlock()
+
+	if buf.Len() == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, in.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if in.opts.Token != "" {
+		req.Header.Set("Authorization", "Token "+in.opts.Token)
+	}
+	resp, err := in.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx: %s: %s: %s", in.url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+type influxVec struct {
+	in   *Influx
+	kind influxKind
+	opts Opts
+}
+
+type influxMetric struct {
+	in *Influx
+	s  *influxSeries
+}
+
+// NewCounter creates a counter.
+func (in *Influx) NewCounter(opts Opts) CounterVec { return influxCounters{in, influxCounter, opts} }
+
+// NewGauge creates a gauge.
+func (in *Influx) NewGauge(opts Opts) GaugeVec { return influxGauges{in, influxGauge, opts} }
+
+// NewHistogram creates a histogram.
+func (in *Influx) NewHistogram(opts Opts) HistogramVec {
+	return influxHistograms{in, influxHistogram, opts}
+}
+
+type influxCounters influxVec
+type influxGauges influxVec
+type influxHistograms influxVec
+
+func (v influxCounters) With(lvs ...string) Counter {
+	return influxMetric{v.in, v.in.get(v.kind, v.opts, lvs)}
+}
+
+func (v influxGauges) With(lvs ...string) Gauge {
+	return influxMetric{v.in, v.in.get(v.kind, v.opts, lvs)}
+}
+
+func (v influxHistograms) With(lvs ...string) Histogram {
+	return influxMetric{v.in, v.in.get(v.kind, v.opts, lvs)}
+}
+
+func (m influxMetric) Inc() { m.Add(1) }
+
+func (m influxMetric) Add(delta float64) {
+	m.in.mu.Lock()
+	m.s.value += delta
+	m.in.mu.Unlock()
+}
+
+func (m influxMetric) Set(v float64) {
+	m.in.mu.Lock()
+	m.s.value = v
+	m.in.mu.Unlock()
+}
+
+func (m influxMetric) Observe(v float64) {
+	m.in.mu.Lock()
+	defer m.in.mu.Unlock()
+	m.s.count++
+	m.s.sum += v
+	if i := sort.SearchFloat64s(m.s.bounds, v); i < len(m.s.bounds) {
+		m.s.counts[i]++
+	}
+}
@@ -0,0 +1,93 @@
+// Package metrics is a small facade over metrics backends, so that
+// applications can record counters, gauges and histograms without depending
+// on a particular monitoring system.
+//
+// Backends are available for Prometheus, StatsD and DogStatsD over UDP, and
+// InfluxDB line protocol over HTTP.
+package metrics
+
+// A Counter is a value that only goes up.
+type Counter interface {
+	Inc()
+	Add(delta float64) // delta must not be negative
+}
+
+// A Gauge is a value that can go up and down.
+type Gauge interface {
+	Set(v float64)
+	Add(delta float64)
+}
+
+// A Histogram samples observations, such as request durations.
+type Histogram interface {
+	Observe(v float64)
+}
+
+// A CounterVec is a set of counters partitioned by labels.
+type CounterVec interface {
+	// With returns the counter for the given label values, in the order of
+	// Opts.Labels.
+	With(labelValues ...string) Counter
+}
+
+// A GaugeVec is a set of gauges partitioned by labels.
+type GaugeVec interface {
+	With(labelValues ...string) Gauge
+}
+
+// A HistogramVec is a set of histograms partitioned by labels.
+type HistogramVec interface {
+	With(labelValues ...string) Histogram
+}
+
+// Opts describes a metric.
+type Opts struct {
+	Name   string   // e.g. cache_hits_total
+	Help   string   // description, if supported by the backend
+	Labels []string // label names, if any
+
+	// Buckets are the upper bounds of the histogram buckets, if the backend
+	// aggregates histograms itself. Defaults to DefBuckets.
+	Buckets []float64
+}
+
+// DefBuckets are the default histogram buckets, suited to durations in
+// seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A Provider creates metrics sent to a backend.
+type Provider interface {
+	NewCounter(opts Opts) CounterVec
+	NewGauge(opts Opts) GaugeVec
+	NewHistogram(opts Opts) HistogramVec
+
+	// Close sends the metrics not sent yet and releases the resources held by
+	// the provider.
+	Close() error
+}
+
+// Discard is a Provider which metrics do nothing.
+var Discard Provider = discard{}
+
+type discard struct{}
+
+func (discard) NewCounter(Opts) CounterVec     { return discardCounters{} }
+func (discard) NewGauge(Opts) GaugeVec         { return discardGauges{} }
+func (discard) NewHistogram(Opts) HistogramVec { return discardHistograms{} }
+func (discard) Close() error                   { return nil }
+
+type (
+	discardCounters   struct{}
+	discardGauges     struct{}
+	discardHistograms struct{}
+	discardMetric     struct{}
+)
+
+func (discardCounters) With(...string) Counter     { return discardMetric{} }
+func (discardGauges) With(...string) Gauge         { return discardMetric{} }
+func (discardHistograms) With(...string) Histogram { return discardMetric{} }
+
+func (discardMetric) Inc()            {}
+func (discardMetric) Add(float64)     {}
+func (discardMetric) Set(float64)     {}
+func (discardMetric) Observe(float64) {}
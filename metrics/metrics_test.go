@@ -0,0 +1,245 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// record records the same metrics with p.
+func record(p Provider) {
+	reqs := p.NewCounter(Opts{Name: "requests_total", Help: "Requests.", Labels: []string{"code"}})
+	reqs.With("200").Inc()
+	reqs.With("200").Add(2)
+	reqs.With("500").Inc()
+
+	inflight := p.NewGauge(Opts{Name: "inflight", Help: "In-flight requests."})
+	inflight.With().Set(3)
+	inflight.With().Add(-5)
+
+	dur := p.NewHistogram(Opts{Name: "duration_seconds", Help: "Duration.", Labels: []string{"op"}, Buckets: []float64{0.1, 1}})
+	dur.With("get").Observe(0.05)
+	dur.With("get").Observe(0.5)
+}
+
+func TestDiscard(t *testing.T) {
+	record(Discard)
+	if err := Discard.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	record(NewPrometheus(reg))
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*dto.MetricFamily)
+	for _, mf := range mfs {
+		got[mf.GetName()] = mf
+	}
+
+	reqs := got["requests_total"].GetMetric()
+	if len(reqs) != 2 || reqs[0].GetCounter().GetValue() != 3 || reqs[1].GetCounter().GetValue() != 1 {
+		t.Errorf("requests_total = %v", reqs)
+	}
+	if v := got["inflight"].GetMetric()[0].GetGauge().GetValue(); v != -2 {
+		t.Errorf("inflight = %v, want -2", v)
+	}
+	h := got["duration_seconds"].GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 2 || h.GetSampleSum() != 0.55 || h.GetBucket()[0].GetCumulativeCount() != 1 {
+		t.Errorf("duration_seconds = %v", h)
+	}
+}
+
+// readStatsD returns the lines received on conn until a read times out.
+func readStatsD(t *testing.T, conn net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	tests := []struct {
+		name string
+		opts StatsDOpts
+		want []string
+	}{
+		{
+			name: "statsd",
+			opts: StatsDOpts{Prefix: "app."},
+			want: []string{
+				"app.requests_total.200:1|c",
+				"app.requests_total.200:2|c",
+				"app.requests_total.500:1|c",
+				"app.inflight:3|g",
+				"app.inflight:0|g",
+				"app.inflight:-2|g",
+				"app.duration_seconds.get:50|ms",
+				"app.duration_seconds.get:500|ms",
+			},
+		},
+		{
+			name: "dogstatsd",
+			opts: StatsDOpts{DogStatsD: true},
+			want: []string{
+				"requests_total:1|c|#code:200",
+				"requests_total:2|c|#code:200",
+				"requests_total:1|c|#code:500",
+				"inflight:3|g",
+				"inflight:-2|g",
+				"duration_seconds:0.05|h|#op:get",
+				"duration_seconds:0.5|h|#op:get",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			// Small packets to check lines are never split.
+			tt.opts.MaxPacketSize = 64
+			p, err := NewStatsD(conn.LocalAddr().String(), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record(p)
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := readStatsD(t, conn)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got lines:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestStatsDGaugeConcurrentAdd(t *testing.T) {
+	for _, dog := range []bool{false, true} {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewStatsD(conn.LocalAddr().String(), StatsDOpts{DogStatsD: dog})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := p.NewGauge(Opts{Name: "inflight"}).With()
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					g.Add(1)
+					g.Add(-1)
+				}
+			}()
+		}
+		wg.Wait()
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := readStatsD(t, conn)
+		conn.Close()
+		if len(got) == 0 || got[len(got)-1] != "inflight:0|g" {
+			t.Errorf("dogstatsd %v: last line of %d = %q, want the gauge to end at 0", dog, len(got), got[len(got)-1:])
+		}
+	}
+}
+
+func TestStatsDFlushInterval(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p, err := NewStatsD(conn.LocalAddr().String(), StatsDOpts{FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.NewCounter(Opts{Name: "ticks_total"}).With().Inc()
+
+	if got := readStatsD(t, conn); len(got) != 1 || got[0] != "ticks_total:1|c" {
+		t.Errorf("got %q, want the counter to be sent before Close", got)
+	}
+}
+
+func TestInflux(t *testing.T) {
+	var (
+		auth string
+		body []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = strings.Split(strings.TrimSpace(string(b)), "\n")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	p := NewInflux(srv.URL+"/api/v2/write?bucket=b", InfluxOpts{Token: "t0k", FlushInterval: time.Hour})
+	p.now = func() time.Time { return time.Unix(1, 0) }
+	record(p)
+	p.NewGauge(Opts{Name: "my metric", Labels: []string{"b", "a,x", "empty"}}).With("1 2", "=", "").Set(1)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if auth != "Token t0k" {
+		t.Errorf("Authorization = %q, want %q", auth, "Token t0k")
+	}
+	sort.Strings(body)
+	want := []string{
+		"duration_seconds,op=get count=2i,sum=0.55,le_0.1=1i,le_1=2i 1000000000",
+		"inflight value=-2 1000000000",
+		`my\ metric,a\,x=\=,b=1\ 2 value=1 1000000000`,
+		"requests_total,code=200 value=3 1000000000",
+		"requests_total,code=500 value=1 1000000000",
+	}
+	if strings.Join(body, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines:\n%s\nwant:\n%s", strings.Join(body, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestInfluxError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	p := NewInflux(srv.URL, InfluxOpts{FlushInterval: time.Hour})
+	p.NewCounter(Opts{Name: "c"}).With().Inc()
+	err := p.Close()
+	if err == nil || !strings.Contains(err.Error(), "database not found") {
+		t.Errorf("Close() = %v, want the server error", err)
+	}
+}
@@ -0,0 +1,84 @@
+package metricstest
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"unicode"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// A Problem is a metric family not following the Prometheus naming
+// conventions.
+type Problem struct {
+	Metric string
+	Text   string
+}
+
+func (p Problem) String() string { return p.Metric + ": " + p.Text }
+
+var validName = regexp.MustCompile(`^[a-z_:][a-z0-9_:]*$`)
+
+// nonBaseUnits are unit suffixes which should be converted to their base
+// unit, seconds or bytes.
+var nonBaseUnits = []string{
+	"nanoseconds", "microseconds", "milliseconds", "minutes", "hours", "days",
+	"kilobytes", "megabytes", "gigabytes", "bits", "percent",
+}
+
+// Lint returns the problems of the metric families of s, sorted by metric
+// name:
+//   - names must be snake_case,
+//   - counters, and only them, must end with _total,
+//   - names must not end with the suffixes of the series of histograms and
+//     summaries (_count, _sum, _bucket),
+//   - units must be base units (seconds, bytes...),
+//   - help strings must not be empty, and must start with an upper case
+//     letter.
+func Lint(s Snapshot) []Problem {
+	var problems []Problem
+	for name, mf := range s {
+		add := func(format string, args ...interface{}) {
+			problems = append(problems, Problem{Metric: name, Text: fmt.Sprintf(format, args...)})
+		}
+		if !validName.MatchString(name) {
+			add("name is not snake_case")
+		}
+		total := strings.HasSuffix(name, "_total")
+		switch typ := mf.GetType(); {
+		case typ == dto.MetricType_COUNTER && !total:
+			add("counter name should end with _total")
+		case typ != dto.MetricType_COUNTER && total:
+			add("%s name should not end with _total", strings.ToLower(typ.String()))
+		}
+		for _, suffix := range []string{"_count", "_sum", "_bucket"} {
+			if strings.HasSuffix(name, suffix) {
+				add("name should not end with %s, reserved for the series of histograms and summaries", suffix)
+			}
+		}
+		for _, unit := range nonBaseUnits {
+			if strings.Contains("_"+name+"_", "_"+unit+"_") {
+				add("unit %s is not a base unit", unit)
+			}
+		}
+		switch help := mf.GetHelp(); {
+		case strings.TrimSpace(help) == "":
+			add("help is empty")
+		case !unicode.IsUpper([]rune(help)[0]):
+			add("help should start with an upper case letter")
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Metric < problems[j].Metric })
+	return problems
+}
+
+// AssertLint checks that the metric families of s have no Lint problems.
+func AssertLint(t testing.TB, s Snapshot) {
+	t.Helper()
+	for _, p := range Lint(s) {
+		t.Errorf("lint: %s", p)
+	}
+}
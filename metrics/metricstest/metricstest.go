@@ -0,0 +1,315 @@
+// Package metricstest provides utilities to test Prometheus metrics: isolated
+// registries, snapshots of the gathered or scraped metric families and their
+// differences, and assertions on counters and histograms.
+//
+// A typical test takes a snapshot before and after exercising the code, and
+// checks the difference:
+//
+//	reg := metricstest.NewRegistry()
+//	reg.MustRegister(requests)
+//	before := metricstest.Gather(t, reg)
+//	serve()
+//	d := metricstest.Diff(before, metricstest.Gather(t, reg))
+//	metricstest.AssertCounter(t, d, "requests_total", prometheus.Labels{"code": "200"}, 1)
+package metricstest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// NewRegistry returns a new registry, isolated from the default one, which
+// checks the consistency of the collected metrics with their descriptions.
+func NewRegistry() *prometheus.Registry {
+	return prometheus.NewPedanticRegistry()
+}
+
+// A Snapshot is a set of metric families, by name.
+type Snapshot map[string]*dto.MetricFamily
+
+// Gather returns a snapshot of the metrics gathered by g.
+func Gather(t testing.TB, g prometheus.Gatherer) Snapshot {
+	t.Helper()
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	s := make(Snapshot, len(mfs))
+	for _, mf := range mfs {
+		s[mf.GetName()] = mf
+	}
+	return s
+}
+
+// Parse returns a snapshot of the metrics read from r, in the text
+// exposition format, e.g. scraped from a /metrics endpoint.
+func Parse(t testing.TB, r io.Reader) Snapshot {
+	t.Helper()
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		t.Fatalf("parsing metrics: %v", err)
+	}
+	return mfs
+}
+
+// String returns the snapshot in the text exposition format, the metric
+// families sorted by name.
+func (s Snapshot) String() string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		expfmt.MetricFamilyToText(&buf, s[name])
+	}
+	return buf.String()
+}
+
+// Matches reports whether m has all the labels. Nil labels match any metric.
+func Matches(m *dto.Metric, labels prometheus.Labels) bool {
+	for name, value := range labels {
+		found := false
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() == name && lp.GetValue() == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Metrics returns the series of the metric family name which have the labels.
+func (s Snapshot) Metrics(name string, labels prometheus.Labels) []*dto.Metric {
+	var ms []*dto.Metric
+	for _, m := range s[name].GetMetric() {
+		if Matches(m, labels) {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// Value returns the sum of the values of the counter, gauge or untyped series
+// of the metric family name which have the labels.
+func (s Snapshot) Value(name string, labels prometheus.Labels) float64 {
+	v := 0.0
+	for _, m := range s.Metrics(name, labels) {
+		v += m.GetCounter().GetValue() + m.GetGauge().GetValue() + m.GetUntyped().GetValue()
+	}
+	return v
+}
+
+// Histogram returns the sum of the histogram series of the metric family name
+// which have the labels. Their buckets must be the same.
+func (s Snapshot) Histogram(name string, labels prometheus.Labels) *dto.Histogram {
+	h := &dto.Histogram{SampleCount: proto.Uint64(0), SampleSum: proto.Float64(0)}
+	for _, m := range s.Metrics(name, labels) {
+		mh := m.GetHistogram()
+		h.SampleCount = proto.Uint64(h.GetSampleCount() + mh.GetSampleCount())
+		h.SampleSum = proto.Float64(h.GetSampleSum() + mh.GetSampleSum())
+		for i, b := range mh.GetBucket() {
+			if i == len(h.Bucket) {
+				h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(b.GetUpperBound()), CumulativeCount: proto.Uint64(0)})
+			}
+			h.Bucket[i].CumulativeCount = proto.Uint64(h.Bucket[i].GetCumulativeCount() + b.GetCumulativeCount())
+		}
+	}
+	return h
+}
+
+// Count returns the total sample count of the histogram or summary series of
+// the metric family name which have the labels.
+func (s Snapshot) Count(name string, labels prometheus.Labels) uint64 {
+	var n uint64
+	for _, m := range s.Metrics(name, labels) {
+		n += m.GetHistogram().GetSampleCount() + m.GetSummary().GetSampleCount()
+	}
+	return n
+}
+
+// Diff returns the changes from before to after: the increase of the counters
+// and of the histograms and summaries counts, sums and buckets, and the new
+// value of the gauges and untyped metrics. Series which haven't changed are
+// left out, as are families without any changed series.
+func Diff(before, after Snapshot) Snapshot {
+	d := make(Snapshot)
+	for name, mf := range after {
+		old := make(map[string]*dto.Metric)
+		for _, m := range before[name].GetMetric() {
+			old[labelsKey(m)] = m
+		}
+		var changed []*dto.Metric
+		for _, m := range mf.GetMetric() {
+			if dm := diffMetric(old[labelsKey(m)], m); dm != nil {
+				changed = append(changed, dm)
+			}
+		}
+		if len(changed) != 0 {
+			d[name] = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: changed}
+		}
+	}
+	return d
+}
+
+// diffMetric returns the change from m0, which may be nil, to m, or nil if
+// there's none.
+func diffMetric(m0, m *dto.Metric) *dto.Metric {
+	if m0 == nil {
+		m0 = &dto.Metric{}
+	}
+	d := &dto.Metric{Label: m.Label}
+	switch {
+	case m.Counter != nil:
+		v := m.GetCounter().GetValue() - m0.GetCounter().GetValue()
+		if v == 0 {
+			return nil
+		}
+		d.Counter = &dto.Counter{Value: proto.Float64(v)}
+	case m.Gauge != nil:
+		if m0.Gauge != nil && m.GetGauge().GetValue() == m0.GetGauge().GetValue() {
+			return nil
+		}
+		d.Gauge = m.Gauge
+	case m.Untyped != nil:
+		if m0.Untyped != nil && m.GetUntyped().GetValue() == m0.GetUntyped().GetValue() {
+			return nil
+		}
+		d.Untyped = m.Untyped
+	case m.Histogram != nil:
+		h, h0 := m.GetHistogram(), m0.GetHistogram()
+		n := h.GetSampleCount() - h0.GetSampleCount()
+		if n == 0 {
+			return nil
+		}
+		d.Histogram = &dto.Histogram{
+			SampleCount: proto.Uint64(n),
+			SampleSum:   proto.Float64(h.GetSampleSum() - h0.GetSampleSum()),
+		}
+		b0 := h0.GetBucket()
+		for i, b := range h.GetBucket() {
+			c := b.GetCumulativeCount()
+			if i < len(b0) {
+				c -= b0[i].GetCumulativeCount()
+			}
+			d.Histogram.Bucket = append(d.Histogram.Bucket, &dto.Bucket{UpperBound: b.UpperBound, CumulativeCount: proto.Uint64(c)})
+		}
+	case m.Summary != nil:
+		s, s0 := m.GetSummary(), m0.GetSummary()
+		n := s.GetSampleCount() - s0.GetSampleCount()
+		if n == 0 {
+			return nil
+		}
+		// Quantiles can't be subtracted, they are those of after.
+		d.Summary = &dto.Summary{
+			SampleCount: proto.Uint64(n),
+			SampleSum:   proto.Float64(s.GetSampleSum() - s0.GetSampleSum()),
+			Quantile:    s.Quantile,
+		}
+	}
+	return d
+}
+
+// labelsKey identifies a series of a metric family by its labels.
+func labelsKey(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		pairs = append(pairs, lp.GetName()+"="+lp.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+// Quantile returns the q-quantile (0 ≤ q ≤ 1) of the observations of h,
+// estimated like the histogram_quantile PromQL function: by linear
+// interpolation within the bucket holding it. It returns NaN if h is empty.
+func Quantile(q float64, h *dto.Histogram) float64 {
+	buckets := h.GetBucket()
+	total := float64(h.GetSampleCount())
+	if total == 0 || len(buckets) == 0 {
+		return math.NaN()
+	}
+	rank := q * total
+	lower, prev := 0.0, 0.0
+	for _, b := range buckets {
+		upper, count := b.GetUpperBound(), float64(b.GetCumulativeCount())
+		if count >= rank && count > prev {
+			if math.IsInf(upper, 1) {
+				return lower
+			}
+			return lower + (upper-lower)*(rank-prev)/(count-prev)
+		}
+		lower, prev = upper, count
+	}
+	// The rank falls in the implicit +Inf bucket: the highest finite bound
+	// is the best estimate.
+	return buckets[len(buckets)-1].GetUpperBound()
+}
+
+// Value returns the value of a counter, gauge or untyped metric, such as one
+// of a vector, without registering it.
+func Value(m prometheus.Metric) float64 {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		panic(fmt.Sprintf("metricstest: writing %s: %v", m.Desc(), err))
+	}
+	return pb.GetCounter().GetValue() + pb.GetGauge().GetValue() + pb.GetUntyped().GetValue()
+}
+
+// AssertCounter checks that the sum of the series of the counter name which
+// have the labels is want in s, typically a Diff.
+func AssertCounter(t testing.TB, s Snapshot, name string, labels prometheus.Labels, want float64) {
+	t.Helper()
+	if got := s.Value(name, labels); got != want {
+		t.Errorf("%s%s = %v, want %v", name, formatLabels(labels), got, want)
+	}
+}
+
+// AssertCount checks that the total sample count of the series of the
+// histogram or summary name which have the labels is want in s, typically a
+// Diff.
+func AssertCount(t testing.TB, s Snapshot, name string, labels prometheus.Labels, want uint64) {
+	t.Helper()
+	if got := s.Count(name, labels); got != want {
+		t.Errorf("%s%s count = %d, want %d", name, formatLabels(labels), got, want)
+	}
+}
+
+// AssertQuantile checks that the q-quantile of the histogram name, summed
+// over the series having the labels, is within [min, max]. Since quantiles are
+// estimated from the buckets, the bounds should be bucket bounds.
+func AssertQuantile(t testing.TB, s Snapshot, name string, labels prometheus.Labels, q, min, max float64) {
+	t.Helper()
+	if got := Quantile(q, s.Histogram(name, labels)); !(got >= min && got <= max) {
+		t.Errorf("%s%s %v-quantile = %v, want within [%v, %v]", name, formatLabels(labels), q, got, min, max)
+	}
+}
+
+// formatLabels formats labels like PromQL, sorted by name.
+func formatLabels(labels prometheus.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,151 @@
+package metricstest
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDiff(t *testing.T) {
+	reg := NewRegistry()
+	reqs := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests"}, []string{"code"})
+	inflight := prometheus.NewGauge(prometheus.GaugeOpts{Name: "inflight", Help: "In-flight requests"})
+	dur := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "duration_seconds", Help: "Duration", Buckets: []float64{0.1, 1}}, []string{"code"})
+	reg.MustRegister(reqs, inflight, dur)
+
+	reqs.WithLabelValues("200").Add(5)
+	reqs.WithLabelValues("500").Inc()
+	dur.WithLabelValues("200").Observe(0.5)
+	before := Gather(t, reg)
+
+	reqs.WithLabelValues("200").Add(2)
+	reqs.WithLabelValues("404").Inc()
+	inflight.Set(3)
+	dur.WithLabelValues("200").Observe(0.05)
+	dur.WithLabelValues("500").Observe(2)
+	d := Diff(before, Gather(t, reg))
+
+	AssertCounter(t, d, "requests_total", prometheus.Labels{"code": "200"}, 2)
+	AssertCounter(t, d, "requests_total", prometheus.Labels{"code": "404"}, 1)
+	AssertCounter(t, d, "requests_total", nil, 3)
+	if n := len(d["requests_total"].GetMetric()); n != 2 {
+		t.Errorf("requests_total has %d changed series, want 2", n)
+	}
+	if v := d.Value("inflight", nil); v != 3 {
+		t.Errorf("inflight = %v, want 3", v)
+	}
+	AssertCount(t, d, "duration_seconds", prometheus.Labels{"code": "200"}, 1)
+	AssertCount(t, d, "duration_seconds", nil, 2)
+
+	h := d.Histogram("duration_seconds", nil)
+	var counts []uint64
+	for _, b := range h.GetBucket() {
+		counts = append(counts, b.GetCumulativeCount())
+	}
+	if want := []uint64{1, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("duration_seconds buckets = %v, want %v", counts, want)
+	}
+	if h.GetSampleSum() != 2.05 {
+		t.Errorf("duration_seconds sum = %v, want 2.05", h.GetSampleSum())
+	}
+
+	// Nothing changed.
+	s := Gather(t, reg)
+	if d := Diff(s, s); len(d) != 0 {
+		t.Errorf("Diff of the same snapshot = %v, want none", d)
+	}
+}
+
+func TestParse(t *testing.T) {
+	s := Parse(t, strings.NewReader(`# HELP hits_total Hits
+# TYPE hits_total counter
+hits_total{route="/get"} 3
+hits_total{route="/add"} 1
+`))
+	if v := s.Value("hits_total", prometheus.Labels{"route": "/get"}); v != 3 {
+		t.Errorf("hits_total{route=/get} = %v, want 3", v)
+	}
+	if !strings.Contains(s.String(), `hits_total{route="/add"} 1`) {
+		t.Errorf("String() = %q", s.String())
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	reg := NewRegistry()
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "h", Help: "H", Buckets: []float64{1, 2, 4}})
+	reg.MustRegister(h)
+	for i := 0; i < 10; i++ {
+		h.Observe(0.5) // 10 in (0,1]
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(3) // 10 in (2,4]
+	}
+	s := Gather(t, reg)
+	hist := s.Histogram("h", nil)
+
+	tests := []struct{ q, want float64 }{
+		{0.25, 0.5},
+		{0.5, 1},
+		{0.75, 3},
+		{1, 4},
+	}
+	for _, tt := range tests {
+		if got := Quantile(tt.q, hist); got != tt.want {
+			t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+	AssertQuantile(t, s, "h", nil, 0.9, 2, 4)
+
+	h.Observe(10) // in the implicit +Inf bucket
+	if got := Quantile(1, Gather(t, reg).Histogram("h", nil)); got != 4 {
+		t.Errorf("Quantile(1) = %v, want 4, the highest bound", got)
+	}
+	if got := Quantile(0.5, Diff(s, s).Histogram("h", nil)); !math.IsNaN(got) {
+		t.Errorf("Quantile of an empty histogram = %v, want NaN", got)
+	}
+}
+
+func TestValue(t *testing.T) {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "c_total", Help: "C"}, []string{"l"})
+	c.WithLabelValues("a").Add(4)
+	if v := Value(c.WithLabelValues("a")); v != 4 {
+		t.Errorf("Value = %v, want 4", v)
+	}
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "g", Help: "G"})
+	g.Set(-2)
+	if v := Value(g); v != -2 {
+		t.Errorf("Value = %v, want -2", v)
+	}
+}
+
+func TestLint(t *testing.T) {
+	reg := NewRegistry()
+	reg.MustRegister(
+		prometheus.NewCounter(prometheus.CounterOpts{Name: "requests_total", Help: "The total number of requests"}),
+		prometheus.NewCounter(prometheus.CounterOpts{Name: "errors", Help: "Errors"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "queued_total", Help: "Queued"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "latency_milliseconds", Help: "latency"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "fooBar", Help: ""}),
+		prometheus.NewHistogram(prometheus.HistogramOpts{Name: "size_bytes_sum", Help: "Sizes"}),
+	)
+
+	var got []string
+	for _, p := range Lint(Gather(t, reg)) {
+		got = append(got, p.String())
+	}
+	want := []string{
+		"errors: counter name should end with _total",
+		"fooBar: name is not snake_case",
+		"fooBar: help is empty",
+		"latency_milliseconds: unit milliseconds is not a base unit",
+		"latency_milliseconds: help should start with an upper case letter",
+		"queued_total: gauge name should not end with _total",
+		"size_bytes_sum: name should not end with _sum, reserved for the series of histograms and summaries",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lint =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
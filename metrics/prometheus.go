@@ -0,0 +1,89 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Prometheus is a Provider creating Prometheus metrics, registered with a
+// registry, to be scraped.
+type Prometheus struct {
+	reg prometheus.Registerer
+
+	// Guard, if set, limits the number of series of the metrics with labels.
+	Guard *CardinalityGuard
+}
+
+// NewPrometheus creates a Prometheus provider registering the metrics with
+// reg. Creating a metric panics if it can't be registered.
+func NewPrometheus(reg prometheus.Registerer) *Prometheus {
+	return &Prometheus{reg: reg}
+}
+
+type promCounters struct {
+	v interface {
+		WithLabelValues(...string) prometheus.Counter
+	}
+}
+type promGauges struct {
+	v interface {
+		WithLabelValues(...string) prometheus.Gauge
+	}
+}
+type promHistograms struct {
+	v interface {
+		WithLabelValues(...string) prometheus.Observer
+	}
+}
+
+func (c promCounters) With(lvs ...string) Counter     { return c.v.WithLabelValues(lvs...) }
+func (g promGauges) With(lvs ...string) Gauge         { return g.v.WithLabelValues(lvs...) }
+func (h promHistograms) With(lvs ...string) Histogram { return h.v.WithLabelValues(lvs...) }
+
+// NewCounter creates and registers a counter.
+func (p *Prometheus) NewCounter(opts Opts) CounterVec {
+	popts := prometheus.CounterOpts{Name: opts.Name, Help: opts.Help}
+	if p.guarded(opts) {
+		v := p.Guard.NewCounterVec(popts, opts.Labels)
+		p.reg.MustRegister(v)
+		return promCounters{v}
+	}
+	v := prometheus.NewCounterVec(popts, opts.Labels)
+	p.reg.MustRegister(v)
+	return promCounters{v}
+}
+
+// NewGauge creates and registers a gauge.
+func (p *Prometheus) NewGauge(opts Opts) GaugeVec {
+	popts := prometheus.GaugeOpts{Name: opts.Name, Help: opts.Help}
+	if p.guarded(opts) {
+		v := p.Guard.NewGaugeVec(popts, opts.Labels)
+		p.reg.MustRegister(v)
+		return promGauges{v}
+	}
+	v := prometheus.NewGaugeVec(popts, opts.Labels)
+	p.reg.MustRegister(v)
+	return promGauges{v}
+}
+
+// NewHistogram creates and registers a histogram.
+func (p *Prometheus) NewHistogram(opts Opts) HistogramVec {
+	buckets := opts.Buckets
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	popts := prometheus.HistogramOpts{Name: opts.Name, Help: opts.Help, Buckets: buckets}
+	if p.guarded(opts) {
+		v := p.Guard.NewHistogramVec(popts, opts.Labels)
+		p.reg.MustRegister(v)
+		return promHistograms{v}
+	}
+	v := prometheus.NewHistogramVec(popts, opts.Labels)
+	p.reg.MustRegister(v)
+	return promHistograms{v}
+}
+
+// guarded reports whether the series of the metric are limited.
+func (p *Prometheus) guarded(opts Opts) bool {
+	return p.Guard != nil && len(opts.Labels) > 0
+}
+
+// Close does nothing, the metrics being scraped.
+func (p *Prometheus) Close() error { return nil }
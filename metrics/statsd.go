@@ -0,0 +1,260 @@
+package metrics
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsDOpts configures a StatsD provider.
+type StatsDOpts struct {
+	// Prefix is prepended to all metric names, e.g. "cache.".
+	Prefix string
+
+	// DogStatsD enables the DogStatsD extensions: labels are sent as tags.
+	// Otherwise, label values are appended to the metric name, separated by
+	// dots.
+	DogStatsD bool
+
+	// FlushInterval is the maximum duration metrics are buffered before being
+	// sent, defaults to 100ms.
+	FlushInterval time.Duration
+
+	// MaxPacketSize is the maximum size of the UDP packets, defaults to 1432
+	// bytes, which fits in an Ethernet frame.
+	MaxPacketSize int
+}
+
+// StatsD is a Provider sending metrics to a StatsD, or DogStatsD, daemon over
+// UDP, which aggregates them.
+//
+// Counters increments are sent as counters (c), gauges values as gauges (g),
+// and histogram observations as histograms (h) for DogStatsD, or as timers
+// (ms) for StatsD, in which case observations of metrics which name ends with
+// _seconds are converted to milliseconds.
+type StatsD struct {
+	opts StatsDOpts
+	conn net.Conn
+
+	mu   sync.Mutex
+	buf  []byte
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewStatsD creates a StatsD provider sending metrics to the daemon listening
+// at addr, e.g. localhost:8125.
+func NewStatsD(addr string, opts StatsDOpts) (*StatsD, error) {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 100 * time.Millisecond
+	}
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = 1432
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsD{
+		opts: opts,
+		conn: conn,
+		buf:  make([]byte, 0, opts.MaxPacketSize),
+		done: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *StatsD) run() {
+	defer s.wg.Done()
+	t := time.NewTicker(s.opts.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.mu.Lock()
+			s.flush()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// flush sends the buffered lines, s.mu must be held. Errors are ignored, as
+// they are usually transient (e.g. the daemon is restarting), and metrics are
+// sent on a best effort basis.
+func (s *StatsD) flush() {
+	if len(s.buf) == 0 {
+		return
+	}
+	s.conn.Write(s.buf)
+	s.buf = s.buf[:0]
+}
+
+// send buffers a metric line, flushing the buffer if the line doesn't fit in
+// the current packet.
+func (s *StatsD) send(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buf) > 0 && len(s.buf)+1+len(line) > s.opts.MaxPacketSize {
+		s.flush()
+	}
+	if len(s.buf) > 0 {
+		s.buf = append(s.buf, '\n')
+	}
+	s.buf = append(s.buf, line...)
+}
+
+// Close flushes the buffered metrics and closes the connection.
+func (s *StatsD) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	s.mu.Lock()
+	s.flush()
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_", "#", "_", ",", "_")
+
+// series returns the name of the series, and its tags suffix for DogStatsD.
+func (s *StatsD) series(name string, labels, values []string) (string, string) {
+	name = s.opts.Prefix + statsdReplacer.Replace(name)
+	if len(labels) == 0 {
+		return name, ""
+	}
+	if !s.opts.DogStatsD {
+		for _, v := range values {
+			name += "." + strings.Replace(statsdReplacer.Replace(v), ".", "_", -1)
+		}
+		return name, ""
+	}
+	tags := make([]string, len(labels))
+	for i, l := range labels {
+		tags[i] = statsdReplacer.Replace(l) + ":" + statsdReplacer.Replace(values[i])
+	}
+	return name, "|#" + strings.Join(tags, ",")
+}
+
+func formatValue(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+
+type statsdVec struct {
+	s    *StatsD
+	opts Opts
+}
+
+type statsdCounters statsdVec
+type statsdHistograms statsdVec
+
+type statsdGauges struct {
+	s    *StatsD
+	opts Opts
+
+	mu     sync.Mutex
+	gauges map[string]*statsdGauge // by series
+}
+
+// NewCounter creates a counter.
+func (s *StatsD) NewCounter(opts Opts) CounterVec { return statsdCounters{s, opts} }
+
+// NewGauge creates a gauge.
+func (s *StatsD) NewGauge(opts Opts) GaugeVec {
+	return &statsdGauges{s: s, opts: opts}
+}
+
+// NewHistogram creates a histogram.
+func (s *StatsD) NewHistogram(opts Opts) HistogramVec { return statsdHistograms{s, opts} }
+
+type statsdCounter struct {
+	s          *StatsD
+	name, tags string
+}
+
+func (c statsdCounters) With(lvs ...string) Counter {
+	name, tags := c.s.series(c.opts.Name, c.opts.Labels, lvs)
+	return statsdCounter{c.s, name, tags}
+}
+
+func (c statsdCounter) Inc() { c.Add(1) }
+
+func (c statsdCounter) Add(delta float64) {
+	c.s.send(c.name + ":" + formatValue(delta) + "|c" + c.tags)
+}
+
+// Gauges values are tracked locally, since DogStatsD doesn't support relative
+// updates. mu is held while the value is sent, so that concurrent updates are
+// sent in order and the last value sent is the current one.
+type statsdGauge struct {
+	s          *StatsD
+	name, tags string
+
+	mu sync.Mutex
+	v  float64
+}
+
+func (g *statsdGauges) With(lvs ...string) Gauge {
+	name, tags := g.s.series(g.opts.Name, g.opts.Labels, lvs)
+	key := name + tags
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gauges == nil {
+		g.gauges = make(map[string]*statsdGauge)
+	}
+	gg, ok := g.gauges[key]
+	if !ok {
+		gg = &statsdGauge{s: g.s, name: name, tags: tags}
+		g.gauges[key] = gg
+	}
+	return gg
+}
+
+func (g *statsdGauge) Set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.v = v
+	g.send(v)
+}
+
+func (g *statsdGauge) Add(delta float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.v += delta
+	g.send(g.v)
+}
+
+// send sends the value v of the gauge, g.mu must be held.
+func (g *statsdGauge) send(v float64) {
+	if v < 0 && !g.s.opts.DogStatsD {
+		// For StatsD, a signed value is a relative update.
+		g.s.send(g.name + ":0|g" + g.tags)
+	}
+	g.s.send(g.name + ":" + formatValue(v) + "|g" + g.tags)
+}
+
+type statsdHistogram struct {
+	s          *StatsD
+	name, tags string
+	typ        string  // h or ms
+	scale      float64 // applied to observations
+}
+
+func (h statsdHistograms) With(lvs ...string) Histogram {
+	name, tags := h.s.series(h.opts.Name, h.opts.Labels, lvs)
+	sh := statsdHistogram{s: h.s, name: name, tags: tags, typ: "h", scale: 1}
+	if !h.s.opts.DogStatsD {
+		sh.typ = "ms"
+		if strings.HasSuffix(h.opts.Name, "_seconds") {
+			sh.scale = 1000
+		}
+	}
+	return sh
+}
+
+func (h statsdHistogram) Observe(v float64) {
+	h.s.send(h.name + ":" + formatValue(v*h.scale) + "|" + h.typ + h.tags)
+}
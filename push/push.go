@@ -0,0 +1,64 @@
+// Package push sends metrics to Prometheus, for batch jobs that don't live
+// long enough to be scraped.
+//
+// Metrics can be pushed to a Pushgateway, which Prometheus scrapes, or
+// written directly to any endpoint implementing the Prometheus remote write
+// protocol.
+package push
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Target receives the metrics of a registry.
+type Target interface {
+	Push(ctx context.Context) error
+}
+
+// finalPushTimeout is the maximum duration of the last push performed by Run.
+const finalPushTimeout = 5 * time.Second
+
+// Run pushes to t every interval until ctx is done, and then a last time so
+// that the final values of the metrics are sent when the process exits.
+// Errors are reported to errf, if not nil.
+func Run(ctx context.Context, t Target, interval time.Duration, errf func(error)) {
+	report := func(err error) {
+		if err != nil && errf != nil {
+			errf(err)
+		}
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), finalPushTimeout)
+			defer cancel()
+			report(t.Push(ctx))
+			return
+		case <-tick.C:
+			report(t.Push(ctx))
+		}
+	}
+}
+
+// Start runs Run for each target in the background. The returned function
+// stops them and waits for their last push.
+func Start(interval time.Duration, errf func(error), targets ...Target) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t Target) {
+			defer wg.Done()
+			Run(ctx, t, interval, errf)
+		}(t)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
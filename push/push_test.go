@@ -0,0 +1,323 @@
+package push
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func testRegistry() (*prometheus.Registry, prometheus.Counter) {
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs."})
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "job_duration_seconds",
+		Help:    "Job duration.",
+		Buckets: []float64{0.5, 1},
+	}, []string{"kind"})
+	reg.MustRegister(c, h)
+	c.Add(3)
+	h.WithLabelValues("a").Observe(0.7)
+	return reg, c
+}
+
+func TestPusher(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		reqs []*http.Request
+		mfs  []map[string]*dto.MetricFamily
+	)
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		got := make(map[string]*dto.MetricFamily)
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				break
+			}
+			got[mf.GetName()] = &mf
+		}
+		mu.Lock()
+		reqs = append(reqs, r)
+		mfs = append(mfs, got)
+		mu.Unlock()
+	}))
+	defer gw.Close()
+
+	reg, c := testRegistry()
+	p := NewPusher(gw.URL, "load", map[string]string{"instance": "host-1", "path": "/a/b", "empty": ""}, reg, nil)
+	if err := p.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := reqs[0]
+	if r.Method != http.MethodPut {
+		t.Errorf("method = %s, want PUT", r.Method)
+	}
+	if want := "/metrics/job/load/empty@base64/=/instance/host-1/path@base64/L2EvYg=="; r.URL.Path != want {
+		t.Errorf("path = %s, want %s", r.URL.Path, want)
+	}
+	if got := mfs[0]["jobs_total"].GetMetric()[0].GetCounter().GetValue(); got != 3 {
+		t.Errorf("pushed jobs_total = %v, want 3", got)
+	}
+	if got := mfs[0]["job_duration_seconds"].GetMetric()[0].GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("pushed job_duration_seconds count = %v, want 1", got)
+	}
+
+	// Run pushes periodically, and a last time on exit.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Run(ctx, p, 10*time.Millisecond, func(err error) { t.Error(err) })
+		close(done)
+	}()
+	time.Sleep(35 * time.Millisecond)
+	c.Inc()
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reqs) < 3 {
+		t.Errorf("got %d pushes, want at least 3", len(reqs))
+	}
+	if got := mfs[len(mfs)-1]["jobs_total"].GetMetric()[0].GetCounter().GetValue(); got != 4 {
+		t.Errorf("last pushed jobs_total = %v, want 4", got)
+	}
+}
+
+func TestPusherError(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "pushed metrics are invalid", http.StatusBadRequest)
+	}))
+	defer gw.Close()
+
+	reg, _ := testRegistry()
+	err := NewPusher(gw.URL, "load", nil, reg, nil).Push(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Errorf("Push() = %v, want error with the gateway message", err)
+	}
+}
+
+// snappyDecode decodes the snappy block format.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, i := binary.Uvarint(src)
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid length")
+	}
+	src = src[i:]
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, l int
+		switch tag & 3 {
+		case 0: // literal
+			l = int(tag >> 2)
+			src = src[1:]
+			if l >= 60 {
+				nb := l - 59
+				l = 0
+				for j := 0; j < nb; j++ {
+					l |= int(src[j]) << (8 * uint(j))
+				}
+				src = src[nb:]
+			}
+			l++
+			if l > len(src) {
+				return nil, fmt.Errorf("literal of %d bytes out of the input", l)
+			}
+			dst, src = append(dst, src[:l]...), src[l:]
+			continue
+		case 1: // copy with a 1-byte offset
+			l = int(tag>>2&7) + 4
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2: // copy with a 2-byte offset
+			l = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		default:
+			return nil, fmt.Errorf("unsupported element type %d", tag&3)
+		}
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("invalid copy offset %d", offset)
+		}
+		// Copies may overlap their output.
+		for j := 0; j < l; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("decoded %d bytes, want %d", len(dst), n)
+	}
+	return dst, nil
+}
+
+func TestSnappyEncode(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) string {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return string(b)
+	}
+	inputs := []string{"", "a", "abcd", "abcdabcd"}
+	for _, n := range []int{1, 60, 61, 256, 257, 70000, 3 * maxLiteral} {
+		inputs = append(inputs, strings.Repeat("x", n), random(n))
+	}
+	inputs = append(inputs,
+		strings.Repeat("golab 2019 ", 10000),
+		random(3000)+strings.Repeat(random(100), 50)+random(3000),
+		strings.Repeat(random(3000), 50), // offsets above 2048
+	)
+	for _, src := range inputs {
+		got, err := snappyDecode(snappyEncode([]byte(src)))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", len(src), err)
+		}
+		if string(got) != src {
+			t.Errorf("%d bytes: round trip mismatch", len(src))
+		}
+	}
+}
+
+func TestSnappyCompressesWriteRequest(t *testing.T) {
+	var all []series
+	for i := 0; i < 200; i++ {
+		all = append(all, series{
+			labels: []label{
+				{"__name__", "http_request_duration_seconds_bucket"},
+				{"instance", "cache-1.example.com:8080"},
+				{"job", "cache"},
+				{"le", fmt.Sprint(i % 12)},
+				{"route", "/get"},
+			},
+			value: float64(i),
+			ts:    1570000000000,
+		})
+	}
+	req := encodeWriteRequest(all)
+	compressed := snappyEncode(req)
+	if len(compressed) >= len(req)/3 {
+		t.Errorf("compressed WriteRequest is %d bytes, want less than a third of its %d bytes", len(compressed), len(req))
+	}
+	got, err := snappyDecode(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(req) {
+		t.Errorf("round trip mismatch")
+	}
+}
+
+// decodeWriteRequest decodes a WriteRequest, returning the series as
+// name{labels} strings mapped to their value and timestamp.
+func decodeWriteRequest(t *testing.T, data []byte) map[string][2]float64 {
+	t.Helper()
+	all := make(map[string][2]float64)
+	req := proto.NewBuffer(data)
+	for {
+		if _, err := req.DecodeVarint(); err != nil { // field 1
+			break
+		}
+		tsb, err := req.DecodeRawBytes(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := proto.NewBuffer(tsb)
+		var (
+			name   string
+			labels []string
+			sample [2]float64
+		)
+		for {
+			key, err := ts.DecodeVarint()
+			if err != nil {
+				break
+			}
+			b, err := ts.DecodeRawBytes(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := proto.NewBuffer(b)
+			switch key >> 3 {
+			case 1: // Label
+				msg.DecodeVarint()
+				n, _ := msg.DecodeStringBytes()
+				msg.DecodeVarint()
+				v, _ := msg.DecodeStringBytes()
+				if n == "__name__" {
+					name = v
+				} else {
+					labels = append(labels, n+"="+v)
+				}
+			case 2: // Sample
+				msg.DecodeVarint()
+				v, _ := msg.DecodeFixed64()
+				msg.DecodeVarint()
+				ms, _ := msg.DecodeVarint()
+				sample = [2]float64{math.Float64frombits(v), float64(ms)}
+			}
+		}
+		all[name+"{"+strings.Join(labels, ",")+"}"] = sample
+	}
+	return all
+}
+
+func TestRemoteWriter(t *testing.T) {
+	var series map[string][2]float64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected headers", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		data, err := snappyDecode(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series = decodeWriteRequest(t, data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	reg, _ := testRegistry()
+	// The kind label only applies to series which don't have one.
+	rw := NewRemoteWriter(receiver.URL, reg, map[string]string{"job": "load", "kind": "ignored"}, nil)
+	now := time.Unix(1571652000, 0)
+	rw.now = func() time.Time { return now }
+	if err := rw.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := float64(now.UnixNano() / int64(time.Millisecond))
+	want := map[string][2]float64{
+		"jobs_total{job=load,kind=ignored}":                    {3, ms},
+		"job_duration_seconds_bucket{job=load,kind=a,le=0.5}":  {0, ms},
+		"job_duration_seconds_bucket{job=load,kind=a,le=1}":    {1, ms},
+		"job_duration_seconds_bucket{job=load,kind=a,le=+Inf}": {1, ms},
+		"job_duration_seconds_sum{job=load,kind=a}":            {0.7, ms},
+		"job_duration_seconds_count{job=load,kind=a}":          {1, ms},
+	}
+	if len(series) != len(want) {
+		t.Errorf("got %d series, want %d: %v", len(series), len(want), series)
+	}
+	for s, v := range want {
+		if series[s] != v {
+			t.Errorf("%s = %v, want %v", s, series[s], v)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// A Pusher pushes the metrics of a registry to a Pushgateway.
+//
+// Each push replaces all the metrics of the group identified by the job name
+// and the grouping labels.
+type Pusher struct {
+	url    string
+	g      prometheus.Gatherer
+	client *http.Client
+}
+
+// NewPusher creates a Pusher sending the metrics gathered by g to the
+// Pushgateway at gatewayURL, e.g. http://localhost:9091, under the group
+// identified by job and grouping. If client is nil, http.DefaultClient is used.
+func NewPusher(gatewayURL, job string, grouping map[string]string, g prometheus.Gatherer, client *http.Client) *Pusher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	path := "/metrics/" + groupSegment("job", job)
+	names := make([]string, 0, len(grouping))
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path += "/" + groupSegment(name, grouping[name])
+	}
+	return &Pusher{
+		url:    strings.TrimSuffix(gatewayURL, "/") + path,
+		g:      g,
+		client: client,
+	}
+}
+
+// groupSegment returns the URL path segment for a grouping label, base64
+// encoding values which can't appear in a path.
+func groupSegment(name, value string) string {
+	switch {
+	case value == "":
+		return name + "@base64/="
+	case strings.Contains(value, "/"):
+		return name + "@base64/" + base64.URLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// Push gathers the metrics and pushes them.
+func (p *Pusher) Push(ctx context.Context) error {
+	mfs, err := p.g.Gather()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPut, p.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway: %s: %s: %s", p.url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
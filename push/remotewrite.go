@@ -0,0 +1,193 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// A RemoteWriter writes the metrics of a registry to an endpoint implementing
+// the Prometheus remote write protocol, such as Prometheus itself (with
+// --web.enable-remote-write-receiver), Thanos, Cortex or VictoriaMetrics.
+type RemoteWriter struct {
+	url    string
+	g      prometheus.Gatherer
+	labels map[string]string
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewRemoteWriter creates a RemoteWriter sending the metrics gathered by g to
+// url, e.g. http://localhost:9090/api/v1/write. labels, typically job and
+// instance, are added to all series. If client is nil, http.DefaultClient is
+// used.
+func NewRemoteWriter(url string, g prometheus.Gatherer, labels map[string]string, client *http.Client) *RemoteWriter {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemoteWriter{url: url, g: g, labels: labels, client: client, now: time.Now}
+}
+
+// A label is a series label, the series name being the __name__ label.
+type label struct {
+	name, value string
+}
+
+// A series is a time series with a single sample.
+type series struct {
+	labels []label // sorted by name
+	value  float64
+	ts     int64 // milliseconds since the epoch
+}
+
+// Push gathers the metrics and writes them, with the current time.
+func (w *RemoteWriter) Push(ctx context.Context) error {
+	mfs, err := w.g.Gather()
+	if err != nil {
+		return err
+	}
+	body := snappyEncode(encodeWriteRequest(w.series(mfs)))
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("remote write: %s: %s: %s", w.url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// series flattens the metric families into series, the same way Prometheus
+// does when scraping them: histograms and summaries are split into
+// _bucket/quantile, _sum and _count series.
+func (w *RemoteWriter) series(mfs []*dto.MetricFamily) []series {
+	now := w.now().UnixNano() / int64(time.Millisecond)
+	var all []series
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(suffix string, v float64, extra ...label) {
+				ls := []label{{"__name__", mf.GetName() + suffix}}
+				for _, lp := range m.GetLabel() {
+					ls = append(ls, label{lp.GetName(), lp.GetValue()})
+				}
+				ls = append(ls, extra...)
+				// Like external labels, w.labels don't override the metric ones.
+				for name, value := range w.labels {
+					if !hasLabel(ls, name) {
+						ls = append(ls, label{name, value})
+					}
+				}
+				sort.Slice(ls, func(i, j int) bool { return ls[i].name < ls[j].name })
+				all = append(all, series{labels: ls, value: v, ts: ts})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), label{"le", formatFloat(b.GetUpperBound())})
+				}
+				add("_bucket", float64(h.GetSampleCount()), label{"le", "+Inf"})
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return all
+}
+
+func hasLabel(ls []label, name string) bool {
+	for _, l := range ls {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes series as a remote write WriteRequest protobuf
+// message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(all []series) []byte {
+	// Wire types.
+	const (
+		varint  = 0
+		fixed64 = 1
+		length  = 2
+	)
+	tag := func(b *proto.Buffer, field, wire uint64) { b.EncodeVarint(field<<3 | wire) }
+
+	req := proto.NewBuffer(nil)
+	for _, s := range all {
+		ts := proto.NewBuffer(nil)
+		for _, l := range s.labels {
+			lb := proto.NewBuffer(nil)
+			tag(lb, 1, length)
+			lb.EncodeStringBytes(l.name)
+			tag(lb, 2, length)
+			lb.EncodeStringBytes(l.value)
+			tag(ts, 1, length)
+			ts.EncodeRawBytes(lb.Bytes())
+		}
+		sb := proto.NewBuffer(nil)
+		tag(sb, 1, fixed64)
+		sb.EncodeFixed64(math.Float64bits(s.value))
+		tag(sb, 2, varint)
+		sb.EncodeVarint(uint64(s.ts))
+		tag(ts, 2, length)
+		ts.EncodeRawBytes(sb.Bytes())
+
+		tag(req, 1, length)
+		req.EncodeRawBytes(ts.Bytes())
+	}
+	return req.Bytes()
+}
@@ -0,0 +1,116 @@
+package push
+
+import "encoding/binary"
+
+const (
+	// maxLiteral is the maximum length of the literal elements written by
+	// snappyEncode.
+	maxLiteral = 1 << 16
+
+	// snappyBlockSize is the size of the blocks matches are looked for in,
+	// so that their offsets fit in 2-byte offset copy elements.
+	snappyBlockSize = 1 << 16
+
+	// snappyTableBits is the log2 of the size of the hash table of the
+	// positions of the last 4-byte sequences seen.
+	snappyTableBits = 14
+
+	// snappyMinMatch is the shortest match worth a copy element.
+	snappyMinMatch = 4
+)
+
+// snappyEncode compresses src in the snappy block format, as expected by
+// remote write receivers.
+//
+// Repeated sequences are found with a hash table of the positions of the last
+// 4-byte sequences seen, like the reference implementation but without its
+// heuristics skipping incompressible data, the payloads being small. See
+// https://github.com/google/snappy/blob/master/format_description.txt
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/maxLiteral*5+5)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	var table [1 << snappyTableBits]int32 // positions + 1 in the block, 0 if none
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyBlockSize {
+			block = block[:snappyBlockSize]
+		}
+		src = src[len(block):]
+		dst = snappyEncodeBlock(dst, block, &table)
+	}
+	return dst
+}
+
+func snappyEncodeBlock(dst, block []byte, table *[1 << snappyTableBits]int32) []byte {
+	for i := range table {
+		table[i] = 0
+	}
+	load32 := func(i int) uint32 { return binary.LittleEndian.Uint32(block[i:]) }
+	hash := func(u uint32) uint32 { return u * 0x1e35a7bd >> (32 - snappyTableBits) }
+
+	lit := 0 // start of the pending literal
+	for s := 0; s+snappyMinMatch <= len(block); {
+		u := load32(s)
+		h := hash(u)
+		cand := int(table[h]) - 1
+		table[h] = int32(s + 1)
+		if cand < 0 || load32(cand) != u {
+			s++
+			continue
+		}
+		n := snappyMinMatch
+		for s+n < len(block) && block[cand+n] == block[s+n] {
+			n++
+		}
+		dst = emitLiteral(dst, block[lit:s])
+		dst = emitCopy(dst, s-cand, n)
+		s += n
+		lit = s
+	}
+	return emitLiteral(dst, block[lit:])
+}
+
+// emitLiteral appends literal elements of lit to dst.
+func emitLiteral(dst, lit []byte) []byte {
+	for len(lit) > 0 {
+		l := lit
+		if len(l) > maxLiteral {
+			l = l[:maxLiteral]
+		}
+		lit = lit[len(l):]
+
+		// The tag holds the length - 1, in its upper 6 bits if it's below 60,
+		// otherwise in the following little-endian bytes.
+		n := len(l) - 1
+		switch {
+		case n < 60:
+			dst = append(dst, byte(n)<<2)
+		case n < 1<<8:
+			dst = append(dst, 60<<2, byte(n))
+		default:
+			dst = append(dst, 61<<2, byte(n), byte(n>>8))
+		}
+		dst = append(dst, l...)
+	}
+	return dst
+}
+
+// emitCopy appends copy elements of length bytes at offset (below 1<<16)
+// before the current position to dst.
+func emitCopy(dst []byte, offset, length int) []byte {
+	// 2-byte offset copies hold at most 64 bytes. Leave at least 4 bytes for
+	// the last one, which may be a shorter 1-byte offset copy.
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
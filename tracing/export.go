@@ -0,0 +1,178 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// jsonSpan is the JSON representation of a span in the file exporter.
+type jsonSpan struct {
+	TraceID  string            `json:"trace_id"`
+	SpanID   string            `json:"span_id"`
+	ParentID string            `json:"parent_id,omitempty"`
+	Name     string            `json:"name"`
+	Kind     SpanKind          `json:"kind"`
+	Start    string            `json:"start"`
+	Duration float64           `json:"duration_seconds"`
+	Attrs    map[string]string `json:"attributes,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// FileExporter exports spans as JSON lines, one per span.
+type FileExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewFileExporter creates an exporter writing spans to w.
+func NewFileExporter(w io.Writer) *FileExporter {
+	return &FileExporter{w: w}
+}
+
+// Export writes spans to the underlying writer.
+func (e *FileExporter) Export(spans []*SpanData) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		js := jsonSpan{
+			TraceID:  s.TraceID.String(),
+			SpanID:   s.SpanID.String(),
+			Name:     s.Name,
+			Kind:     s.Kind,
+			Start:    s.Start.UTC().Format("2006-01-02T15:04:05.000000000Z07:00"),
+			Duration: s.End.Sub(s.Start).Seconds(),
+			Attrs:    s.Attrs,
+			Error:    s.Error,
+		}
+		if s.Parent.IsValid() {
+			js.ParentID = s.Parent.String()
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+// OTLPExporter exports spans to an OpenTelemetry collector, with the OTLP/HTTP
+// protocol, JSON encoded.
+type OTLPExporter struct {
+	url     string
+	service string
+	client  *http.Client
+}
+
+// NewOTLPExporter creates an exporter sending spans to the OTLP/HTTP traces
+// endpoint at url, e.g. http://localhost:4318/v1/traces, on behalf of
+// service. If client is nil, http.DefaultClient is used.
+func NewOTLPExporter(url, service string, client *http.Client) *OTLPExporter {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OTLPExporter{url: url, service: service, client: client}
+}
+
+// OTLP JSON messages, see opentelemetry/proto/trace/v1/trace.proto.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              SpanKind       `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 1: ok, 2: error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func otlpAttrs(attrs map[string]string) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+// Export sends spans to the collector.
+func (e *OTLPExporter) Export(spans []*SpanData) error {
+	ss := otlpScopeSpans{Scope: otlpScope{Name: "github.com/arl/golab-2019/tracing"}}
+	for _, s := range spans {
+		os := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttrs(s.Attrs),
+		}
+		if s.Parent.IsValid() {
+			os.ParentSpanID = s.Parent.String()
+		}
+		if s.Error != "" {
+			os.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		ss.Spans = append(ss.Spans, os)
+	}
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttrs(map[string]string{"service.name": e.service})},
+		ScopeSpans: []otlpScopeSpans{ss},
+	}}}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: %s: %s", e.url, resp.Status)
+	}
+	return nil
+}
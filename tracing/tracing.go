@@ -0,0 +1,455 @@
+// Package tracing implements a minimal distributed tracer.
+//
+// Spans are propagated across processes with the W3C Trace Context
+// traceparent header (https://www.w3.org/TR/trace-context/), and exported to
+// a pluggable Exporter. Spans that are not sampled are propagated but not
+// exported.
+//
+// A nil *Tracer is valid and disables tracing: it creates nil spans, on which
+// all methods are no-ops.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id is not all zeros.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// A SpanID identifies a span.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id is not all zeros.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// A SpanContext is the part of a span propagated across processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether sc has valid trace and span IDs.
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// TraceparentHeader is the name of the header propagating span contexts.
+const TraceparentHeader = "traceparent"
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value.
+//
+// As per the specification, values with an unknown version are parsed as
+// version 00 as long as their prefix is valid.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("malformed traceparent %q", s)
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent version in %q", s)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid trace ID in %q", s)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid span ID in %q", s)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, fmt.Errorf("invalid trace flags in %q", s)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("all zeros trace or span ID in %q", s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Extract returns the span context propagated in the headers h, if any.
+func Extract(h http.Header) (SpanContext, bool) {
+	sc, err := ParseTraceparent(h.Get(TraceparentHeader))
+	return sc, err == nil
+}
+
+// Inject propagates the span context of the span in ctx, if any, in h.
+func Inject(ctx context.Context, h http.Header) {
+	if s := FromContext(ctx); s != nil {
+		h.Set(TraceparentHeader, s.data.SpanContext.Traceparent())
+	}
+}
+
+// SpanKind describes the relationship of a span with its parent and children.
+type SpanKind int
+
+// Span kinds, with the same values as OpenTelemetry.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// SpanData is the exported form of a finished span.
+type SpanData struct {
+	SpanContext
+	Parent SpanID
+	Name   string
+	Kind   SpanKind
+	Start  time.Time
+	End    time.Time
+	Attrs  map[string]string
+	Error  string // empty if the span succeeded
+}
+
+// A Span represents an operation in a trace.
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// SpanContext returns the span context of s.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetAttr sets an attribute of the span.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attrs == nil {
+		s.data.Attrs = make(map[string]string)
+	}
+	s.data.Attrs[key] = value
+}
+
+// SetError marks the span as failed, if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and exports it if sampled. Calling End more than once
+// has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.Sampled {
+		s.tracer.enqueue(&data)
+	}
+}
+
+type spanKey struct{}
+
+// FromContext returns the span in ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// An Exporter exports finished spans.
+type Exporter interface {
+	Export(spans []*SpanData) error
+}
+
+// Options configures a Tracer.
+type Options struct {
+	// SampleRate is the fraction of new traces that are sampled. The decision
+	// of the parent span, if any, is always honoured.
+	SampleRate float64
+
+	// BatchSize is the maximum number of spans exported at once, defaults to
+	// 512.
+	BatchSize int
+
+	// FlushInterval is the maximum duration spans are kept before being
+	// exported, defaults to 1 second.
+	FlushInterval time.Duration
+
+	// OnError, if not nil, is called when spans can't be exported, with the
+	// number of dropped spans.
+	OnError func(err error, dropped int)
+}
+
+// A Tracer creates spans and exports them, in batches, in the background.
+type Tracer struct {
+	exp   Exporter
+	opts  Options
+	queue chan *SpanData
+	done  chan struct{}
+
+	mu     sync.RWMutex // protects closed and queue closing
+	closed bool
+}
+
+// NewTracer creates a tracer exporting spans to exp.
+func NewTracer(exp Exporter, opts Options) *Tracer {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	t := &Tracer{
+		exp:   exp,
+		opts:  opts,
+		queue: make(chan *SpanData, 4*opts.BatchSize),
+		done:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start starts a span, child of the span in ctx if any, and returns a context
+// containing it.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var parent SpanContext
+	if p := FromContext(ctx); p != nil {
+		parent = p.SpanContext()
+	}
+	return t.start(ctx, name, kind, parent)
+}
+
+// StartRemote starts a span, child of the remote parent span context if it's
+// valid, and returns a context containing it.
+func (t *Tracer) StartRemote(ctx context.Context, name string, kind SpanKind, parent SpanContext) (context.Context, *Span) {
+	return t.start(ctx, name, kind, parent)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind SpanKind, parent SpanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t}
+	s.data.Name = name
+	s.data.Kind = kind
+	s.data.Start = time.Now()
+	s.data.SpanID = newSpanID()
+	if parent.IsValid() {
+		s.data.TraceID = parent.TraceID
+		s.data.Parent = parent.SpanID
+		s.data.Sampled = parent.Sampled
+	} else {
+		s.data.TraceID = newTraceID()
+		s.data.Sampled = t.opts.SampleRate >= 1 || mrand.Float64() < t.opts.SampleRate
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *Tracer) enqueue(s *SpanData) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		if t.opts.OnError != nil {
+			t.opts.OnError(fmt.Errorf("export queue full"), 1)
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	tick := time.NewTicker(t.opts.FlushInterval)
+	defer tick.Stop()
+
+	batch := make([]*SpanData, 0, t.opts.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exp.Export(batch); err != nil && t.opts.OnError != nil {
+			t.opts.OnError(err, len(batch))
+		}
+		batch = make([]*SpanData, 0, t.opts.BatchSize)
+	}
+
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) == t.opts.BatchSize {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// Close exports the pending spans and stops the tracer. Spans ended after
+// Close are not exported.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	<-t.done
+}
+
+// Handler wraps h so that each request is served in a server span named after
+// route, child of the span propagated in the request traceparent header, if
+// any.
+func (t *Tracer) Handler(route string, h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := Extract(r.Header)
+		ctx, span := t.StartRemote(r.Context(), r.Method+" "+route, KindServer, parent)
+		defer span.End()
+		span.SetAttr("http.method", r.Method)
+		span.SetAttr("http.route", route)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttr("http.status_code", fmt.Sprint(rec.status))
+		if rec.status >= 500 {
+			span.SetError(fmt.Errorf("%s", http.StatusText(rec.status)))
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = code, true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Transport wraps the http.RoundTripper rt, or http.DefaultTransport if nil,
+// so that each request is sent in a client span, which context is propagated
+// to the server in the traceparent header.
+func (t *Tracer) Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if t == nil {
+		return rt
+	}
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		ctx, span := t.Start(r.Context(), r.Method+" "+r.URL.Host, KindClient)
+		defer span.End()
+		span.SetAttr("http.method", r.Method)
+		span.SetAttr("http.url", r.URL.String())
+
+		r = r.Clone(ctx)
+		Inject(ctx, r.Header)
+		resp, err := rt.RoundTrip(r)
+		if err != nil {
+			span.SetError(err)
+			return nil, err
+		}
+		span.SetAttr("http.status_code", fmt.Sprint(resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			span.SetError(fmt.Errorf("%s", resp.Status))
+		}
+		return resp, nil
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+var (
+	idMu   sync.Mutex
+	idRand *mrand.Rand
+)
+
+func init() {
+	var seed [8]byte
+	rand.Read(seed[:])
+	idRand = mrand.New(mrand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+}
+
+func newTraceID() (id TraceID) {
+	idMu.Lock()
+	defer idMu.Unlock()
+	for !id.IsValid() {
+		idRand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	idMu.Lock()
+	defer idMu.Unlock()
+	for !id.IsValid() {
+		idRand.Read(id[:])
+	}
+	return id
+}
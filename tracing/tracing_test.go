@@ -0,0 +1,243 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memExporter records exported spans.
+type memExporter struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+func (e *memExporter) Export(spans []*SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("ParseTraceparent(%q) = %+v", valid, sc)
+	}
+	if got := sc.Traceparent(); got != valid {
+		t.Errorf("Traceparent() = %q, want %q", got, valid)
+	}
+
+	// Future versions may have more fields.
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future"); err != nil {
+		t.Errorf("future version: %v", err)
+	}
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	} {
+		if _, err := ParseTraceparent(s); err == nil {
+			t.Errorf("ParseTraceparent(%q): want error", s)
+		}
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	exp := &memExporter{}
+	tr := NewTracer(exp, Options{SampleRate: 1})
+
+	// The server records the traceparent it receives.
+	var received string
+	srv := httptest.NewServer(tr.Handler("/get", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(TraceparentHeader)
+		_, span := tr.Start(r.Context(), "lookup", KindInternal)
+		span.End()
+	})))
+	defer srv.Close()
+
+	client := &http.Client{Transport: tr.Transport(nil)}
+	ctx, root := tr.Start(context.Background(), "root", KindInternal)
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	root.End()
+	tr.Close()
+
+	if req.Header.Get(TraceparentHeader) != "" {
+		t.Errorf("Transport modified the original request")
+	}
+
+	byName := make(map[string]*SpanData)
+	for _, s := range exp.spans {
+		byName[s.Name] = s
+	}
+	if len(byName) != 4 {
+		t.Fatalf("got %d spans, want 4: %v", len(exp.spans), byName)
+	}
+	rootSpan, clientSpan, serverSpan, lookup := byName["root"], byName["GET "+strings.TrimPrefix(srv.URL, "http://")], byName["GET /get"], byName["lookup"]
+	if clientSpan == nil || serverSpan == nil || lookup == nil {
+		t.Fatalf("missing spans: %v", byName)
+	}
+	for _, s := range exp.spans {
+		if s.TraceID != rootSpan.TraceID {
+			t.Errorf("span %q has trace ID %s, want %s", s.Name, s.TraceID, rootSpan.TraceID)
+		}
+	}
+	if clientSpan.Parent != rootSpan.SpanID || serverSpan.Parent != clientSpan.SpanID || lookup.Parent != serverSpan.SpanID {
+		t.Errorf("wrong span hierarchy")
+	}
+	if want := clientSpan.SpanContext.Traceparent(); received != want {
+		t.Errorf("server received traceparent %q, want %q", received, want)
+	}
+	if serverSpan.Kind != KindServer || clientSpan.Kind != KindClient {
+		t.Errorf("wrong span kinds: server %d, client %d", serverSpan.Kind, clientSpan.Kind)
+	}
+	if got := serverSpan.Attrs["http.status_code"]; got != "200" {
+		t.Errorf("server span status code = %q, want 200", got)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	exp := &memExporter{}
+	tr := NewTracer(exp, Options{SampleRate: 0})
+
+	_, span := tr.Start(context.Background(), "unsampled", KindInternal)
+	span.End()
+
+	// The decision of a remote parent is honoured.
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, span = tr.StartRemote(context.Background(), "sampled", KindServer, parent)
+	span.End()
+	span.End() // no-op
+	tr.Close()
+
+	if len(exp.spans) != 1 || exp.spans[0].Name != "sampled" {
+		t.Fatalf("exported %v, want only the sampled span", exp.spans)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTracer(NewFileExporter(&buf), Options{SampleRate: 1})
+	ctx, parent := tr.Start(context.Background(), "parent", KindInternal)
+	_, child := tr.Start(ctx, "child", KindInternal)
+	child.SetAttr("key", "value")
+	child.SetError(errors.New("boom"))
+	child.End()
+	parent.End()
+	tr.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), buf.String())
+	}
+	var js jsonSpan
+	if err := json.Unmarshal([]byte(lines[0]), &js); err != nil {
+		t.Fatal(err)
+	}
+	if js.Name != "child" || js.ParentID != parent.SpanContext().SpanID.String() ||
+		js.TraceID != parent.SpanContext().TraceID.String() ||
+		js.Attrs["key"] != "value" || js.Error != "boom" {
+		t.Errorf("unexpected span %+v", js)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		reqs []otlpRequest
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var req otlpRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	var exportErr error
+	tr := NewTracer(NewOTLPExporter(collector.URL+"/v1/traces", "test", nil), Options{
+		SampleRate: 1,
+		OnError:    func(err error, dropped int) { exportErr = err },
+	})
+	_, span := tr.Start(context.Background(), "op", KindServer)
+	span.SetError(errors.New("failed"))
+	span.End()
+	tr.Close()
+
+	if exportErr != nil {
+		t.Fatal(exportErr)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("collector received %d requests, want 1", len(reqs))
+	}
+	rs := reqs[0].ResourceSpans[0]
+	if kv := rs.Resource.Attributes[0]; kv.Key != "service.name" || kv.Value.StringValue != "test" {
+		t.Errorf("resource attribute = %+v", kv)
+	}
+	s := rs.ScopeSpans[0].Spans[0]
+	sc := span.SpanContext()
+	if s.TraceID != sc.TraceID.String() || s.SpanID != sc.SpanID.String() || s.Name != "op" ||
+		s.Kind != KindServer || s.Status.Code != 2 || s.Status.Message != "failed" {
+		t.Errorf("unexpected span %+v", s)
+	}
+
+	// Export errors are reported.
+	var dropped int
+	tr = NewTracer(NewOTLPExporter(collector.URL+"/wrong", "test", nil), Options{
+		SampleRate: 1,
+		OnError:    func(err error, n int) { dropped += n },
+	})
+	_, span = tr.Start(context.Background(), "op", KindServer)
+	span.End()
+	tr.Close()
+	if dropped != 1 {
+		t.Errorf("dropped %d spans, want 1", dropped)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tr *Tracer
+	ctx, span := tr.Start(context.Background(), "op", KindInternal)
+	span.SetAttr("key", "value")
+	span.SetError(errors.New("boom"))
+	span.End()
+	if FromContext(ctx) != nil || span.SpanContext().IsValid() {
+		t.Errorf("nil tracer created a span")
+	}
+	h := http.NotFoundHandler()
+	if tr.Handler("/", h) == nil || tr.Transport(nil) != http.DefaultTransport {
+		t.Errorf("nil tracer wrapped handler or transport")
+	}
+	tr.Close()
+}
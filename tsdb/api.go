@@ -0,0 +1,163 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handler returns a handler serving the following endpoints of the Prometheus
+// HTTP API, with the same parameters and responses:
+//
+//	/api/v1/query
+//	/api/v1/query_range
+//	/api/v1/label/<name>/values
+func (db *DB) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/query", db.handleQuery)
+	mux.HandleFunc("/api/v1/query_range", db.handleQueryRange)
+	mux.HandleFunc("/api/v1/label/", db.handleLabelValues)
+	return mux
+}
+
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+// samplePair marshals to [<unix time in seconds>, "<value>"].
+type samplePair Sample
+
+func (s samplePair) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("[%s,%q]", strconv.FormatFloat(float64(s.T)/1000, 'f', -1, 64), formatFloat(s.V))), nil
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  samplePair        `json:"value"`
+}
+
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values []samplePair      `json:"values"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func badData(w http.ResponseWriter, err error) {
+	writeJSON(w, http.StatusBadRequest, apiResponse{Status: "error", ErrorType: "bad_data", Error: err.Error()})
+}
+
+// parseTime parses a Unix timestamp in seconds, possibly fractional, or an
+// RFC 3339 date, returning milliseconds.
+func parseTime(s string) (int64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(f * 1000)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// parseStep parses a duration, or a number of seconds, returning
+// milliseconds.
+func parseStep(s string) (int64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(f * 1000)), nil
+	}
+	d, err := parseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid step %q", s)
+	}
+	return int64(d / time.Millisecond), nil
+}
+
+func (db *DB) handleQuery(w http.ResponseWriter, r *http.Request) {
+	t := time.Now().UnixNano() / int64(time.Millisecond)
+	if s := r.FormValue("time"); s != "" {
+		var err error
+		if t, err = parseTime(s); err != nil {
+			badData(w, err)
+			return
+		}
+	}
+	res, err := db.Query(r.FormValue("query"), t)
+	if err != nil {
+		badData(w, err)
+		return
+	}
+
+	data := queryData{ResultType: "vector"}
+	if res.Scalar {
+		data.ResultType = "scalar"
+		data.Result = samplePair(res.Series[0].Samples[0])
+	} else {
+		vec := make([]vectorSample, 0, len(res.Series))
+		for _, s := range res.Series {
+			vec = append(vec, vectorSample{s.Labels.Map(), samplePair(s.Samples[0])})
+		}
+		data.Result = vec
+	}
+	writeJSON(w, http.StatusOK, apiResponse{Status: "success", Data: data})
+}
+
+func (db *DB) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	var (
+		start, end, step int64
+		err              error
+	)
+	if start, err = parseTime(r.FormValue("start")); err != nil {
+		badData(w, err)
+		return
+	}
+	if end, err = parseTime(r.FormValue("end")); err != nil {
+		badData(w, err)
+		return
+	}
+	if step, err = parseStep(r.FormValue("step")); err != nil {
+		badData(w, err)
+		return
+	}
+	res, err := db.QueryRange(r.FormValue("query"), start, end, step)
+	if err != nil {
+		badData(w, err)
+		return
+	}
+
+	mat := make([]matrixSeries, 0, len(res.Series))
+	for _, s := range res.Series {
+		values := make([]samplePair, len(s.Samples))
+		for i, smpl := range s.Samples {
+			values[i] = samplePair(smpl)
+		}
+		mat = append(mat, matrixSeries{s.Labels.Map(), values})
+	}
+	writeJSON(w, http.StatusOK, apiResponse{Status: "success", Data: queryData{ResultType: "matrix", Result: mat}})
+}
+
+func (db *DB) handleLabelValues(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	if !strings.HasSuffix(name, "/values") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/values")
+	writeJSON(w, http.StatusOK, apiResponse{Status: "success", Data: db.LabelValues(name)})
+}
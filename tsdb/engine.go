@@ -0,0 +1,404 @@
+package tsdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// lookback is how far back an instant selector looks for the latest sample
+// of a series, as in Prometheus.
+const lookback = 5 * 60 * 1000
+
+// maxPoints is the maximum number of steps of a range query.
+const maxPoints = 11000
+
+// A Result is the result of a query.
+type Result struct {
+	// Scalar is true if the query evaluates to a number, rather than series,
+	// in which case Series has a single series without labels.
+	Scalar bool
+	Series []Series
+}
+
+// Query evaluates q at time t, in milliseconds.
+func (db *DB) Query(q string, t int64) (*Result, error) {
+	return db.QueryRange(q, t, t, 1)
+}
+
+// QueryRange evaluates q at each step between start and end included, all in
+// milliseconds.
+//
+// Unlike Prometheus, rate doesn't extrapolate the increase of the counters to
+// the range boundaries: it's the per-second increase between the first and
+// last samples in the range.
+func (db *DB) QueryRange(q string, start, end, step int64) (*Result, error) {
+	if end < start {
+		return nil, fmt.Errorf("end must not be before start")
+	}
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if (end-start)/step+1 > maxPoints {
+		return nil, fmt.Errorf("exceeded maximum resolution of %d points per series, increase step", maxPoints)
+	}
+	expr, err := ParseExpr(q)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &evaluator{db: db, start: start, end: end, selected: make(map[*vectorSelector][]Series)}
+	res := &Result{}
+	byLabels := make(map[string]int) // index in res.Series
+	for t := start; t <= end; t += step {
+		v, err := ev.eval(expr, t)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case float64:
+			res.Scalar = true
+			if len(res.Series) == 0 {
+				res.Series = append(res.Series, Series{Labels: Labels{}})
+			}
+			res.Series[0].Samples = append(res.Series[0].Samples, Sample{t, v})
+		case vector:
+			for _, s := range v {
+				key := s.lset.String()
+				i, ok := byLabels[key]
+				if !ok {
+					i = len(res.Series)
+					byLabels[key] = i
+					res.Series = append(res.Series, Series{Labels: s.lset})
+				}
+				res.Series[i].Samples = append(res.Series[i].Samples, Sample{t, s.v})
+			}
+		}
+	}
+	sort.Slice(res.Series, func(i, j int) bool { return res.Series[i].Labels.String() < res.Series[j].Labels.String() })
+	return res, nil
+}
+
+// A vector is a set of series values at a given time.
+type vector []vsample
+
+type vsample struct {
+	lset Labels
+	v    float64
+}
+
+type evaluator struct {
+	db         *DB
+	start, end int64
+
+	// Series of each selector, selected once for all steps.
+	selected map[*vectorSelector][]Series
+}
+
+// eval evaluates e at time t, returning a float64 or a vector.
+func (ev *evaluator) eval(e Expr, t int64) (interface{}, error) {
+	switch e := e.(type) {
+	case *numberLit:
+		return e.v, nil
+
+	case *vectorSelector:
+		var vec vector
+		for _, s := range ev.selectSeries(e) {
+			if samples := window(s.Samples, t-lookback, t); len(samples) > 0 {
+				vec = append(vec, vsample{s.Labels, samples[len(samples)-1].V})
+			}
+		}
+		return vec, nil
+
+	case *rateCall:
+		var vec vector
+		for _, s := range ev.selectSeries(e.sel) {
+			if v, ok := rate(window(s.Samples, t-e.sel.rng, t)); ok {
+				vec = append(vec, vsample{dropName(s.Labels), v})
+			}
+		}
+		return vec, nil
+
+	case *sumAggr:
+		vec, err := ev.evalVector(e.expr, t, "sum")
+		if err != nil {
+			return nil, err
+		}
+		return sumGroups(vec, e.by), nil
+
+	case *quantileCall:
+		vec, err := ev.evalVector(e.expr, t, "histogram_quantile")
+		if err != nil {
+			return nil, err
+		}
+		return histogramQuantile(e.q, vec), nil
+
+	case *binaryExpr:
+		lhs, err := ev.eval(e.lhs, t)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := ev.eval(e.rhs, t)
+		if err != nil {
+			return nil, err
+		}
+		return binop(e.op, lhs, rhs)
+	}
+	return nil, fmt.Errorf("unexpected expression %s", e)
+}
+
+func (ev *evaluator) evalVector(e Expr, t int64, fn string) (vector, error) {
+	v, err := ev.eval(e, t)
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := v.(vector)
+	if !ok {
+		return nil, fmt.Errorf("%s expects an instant vector, got a scalar", fn)
+	}
+	return vec, nil
+}
+
+func (ev *evaluator) selectSeries(sel *vectorSelector) []Series {
+	ss, ok := ev.selected[sel]
+	if !ok {
+		rng := int64(lookback)
+		if sel.rng > rng {
+			rng = sel.rng
+		}
+		ss = ev.db.Select(ev.start-rng, ev.end, sel.matchers...)
+		ev.selected[sel] = ss
+	}
+	return ss
+}
+
+// window returns the samples in (mint, maxt].
+func window(samples []Sample, mint, maxt int64) []Sample {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].T > mint })
+	j := sort.Search(len(samples), func(i int) bool { return samples[i].T > maxt })
+	return samples[i:j]
+}
+
+// rate returns the per-second increase of a counter, taking resets into
+// account. There must be at least 2 samples.
+func rate(samples []Sample) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	var inc float64
+	for i := 1; i < len(samples); i++ {
+		if d := samples[i].V - samples[i-1].V; d >= 0 {
+			inc += d
+		} else {
+			// Reset, the counter restarted from 0.
+			inc += samples[i].V
+		}
+	}
+	dt := float64(samples[len(samples)-1].T-samples[0].T) / 1000
+	return inc / dt, true
+}
+
+func dropName(ls Labels) Labels {
+	res := make(Labels, 0, len(ls))
+	for _, l := range ls {
+		if l.Name != MetricName {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// keep returns the labels of ls which names are in names.
+func keep(ls Labels, names []string) Labels {
+	res := Labels{}
+	for _, l := range ls {
+		for _, n := range names {
+			if l.Name == n {
+				res = append(res, l)
+				break
+			}
+		}
+	}
+	return res
+}
+
+func sumGroups(vec vector, by []string) vector {
+	groups := make(map[string]int) // index in res
+	var res vector
+	for _, s := range vec {
+		lset := keep(s.lset, by)
+		key := lset.String()
+		if i, ok := groups[key]; ok {
+			res[i].v += s.v
+			continue
+		}
+		groups[key] = len(res)
+		res = append(res, vsample{lset, s.v})
+	}
+	return res
+}
+
+// binop applies op to scalars or vectors. Vectors are matched one-to-one, on
+// all labels but the metric name. Comparisons keep the vector samples for
+// which they are true, as they are, while arithmetic operators drop the
+// metric name.
+func binop(op string, lhs, rhs interface{}) (interface{}, error) {
+	cmp := op != "+" && op != "-" && op != "*" && op != "/"
+	lvec, lok := lhs.(vector)
+	rvec, rok := rhs.(vector)
+	if !lok && !rok {
+		if cmp {
+			return nil, fmt.Errorf("comparisons between scalars are not supported")
+		}
+		return arith(op, lhs.(float64), rhs.(float64)), nil
+	}
+
+	var res vector
+	// add adds the result of a op b, s being the sample of the vector.
+	add := func(s vsample, a, b float64) {
+		switch {
+		case !cmp:
+			res = append(res, vsample{dropName(s.lset), arith(op, a, b)})
+		case compare(op, a, b):
+			res = append(res, s)
+		}
+	}
+	switch {
+	case lok && !rok:
+		for _, s := range lvec {
+			add(s, s.v, rhs.(float64))
+		}
+	case !lok && rok:
+		for _, s := range rvec {
+			add(s, lhs.(float64), s.v)
+		}
+	default:
+		right := make(map[string]float64, len(rvec))
+		for _, s := range rvec {
+			right[dropName(s.lset).String()] = s.v
+		}
+		for _, s := range lvec {
+			if v, ok := right[dropName(s.lset).String()]; ok {
+				add(s, s.v, v)
+			}
+		}
+	}
+	return res, nil
+}
+
+func arith(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	}
+	return a / b
+}
+
+func compare(op string, a, b float64) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	}
+	return a >= b
+}
+
+// A bucket is a cumulative histogram bucket.
+type bucket struct {
+	upper, count float64
+}
+
+// histogramQuantile computes the q-quantile of histograms, from their
+// buckets, grouped by all labels but le, as Prometheus does: assuming the
+// observations are uniformly distributed in each bucket.
+func histogramQuantile(q float64, vec vector) vector {
+	type histogram struct {
+		lset    Labels
+		buckets []bucket
+	}
+	var hists []*histogram
+	byLabels := make(map[string]*histogram)
+	for _, s := range vec {
+		le, err := strconv.ParseFloat(s.lset.Get("le"), 64)
+		if err != nil {
+			continue // not a bucket
+		}
+		lset := Labels{}
+		for _, l := range s.lset {
+			if l.Name != "le" && l.Name != MetricName {
+				lset = append(lset, l)
+			}
+		}
+		key := lset.String()
+		h, ok := byLabels[key]
+		if !ok {
+			h = &histogram{lset: lset}
+			byLabels[key] = h
+			hists = append(hists, h)
+		}
+		h.buckets = append(h.buckets, bucket{le, s.v})
+	}
+
+	res := make(vector, 0, len(hists))
+	for _, h := range hists {
+		res = append(res, vsample{h.lset, bucketQuantile(q, h.buckets)})
+	}
+	return res
+}
+
+// bucketQuantile interpolates the q-quantile in buckets, the last one being
+// +Inf. It returns NaN if there's no +Inf bucket, or no observations.
+func bucketQuantile(q float64, bs []bucket) float64 {
+	switch {
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].upper < bs[j].upper })
+	n := len(bs)
+	if n < 2 || !math.IsInf(bs[n-1].upper, 1) {
+		return math.NaN()
+	}
+	// Rates of cumulative counts may be slightly non monotonic.
+	for i := 1; i < n; i++ {
+		bs[i].count = math.Max(bs[i].count, bs[i-1].count)
+	}
+	total := bs[n-1].count
+	if total == 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	b := sort.Search(n-1, func(i int) bool { return bs[i].count >= rank })
+	if b == n-1 {
+		// In the +Inf bucket: return the highest finite bound.
+		return bs[n-2].upper
+	}
+	if b == 0 && bs[0].upper <= 0 {
+		return bs[0].upper
+	}
+	start, count := 0.0, bs[b].count
+	if b > 0 {
+		start = bs[b-1].upper
+		count -= bs[b-1].count
+		rank -= bs[b-1].count
+	}
+	if count == 0 {
+		// Only for q = 0, the first buckets being empty.
+		return start
+	}
+	return start + (bs[b].upper-start)*(rank/count)
+}
@@ -0,0 +1,463 @@
+package tsdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The query language is a subset of PromQL:
+//
+//	expr     = arith { ("==" | "!=" | "<" | "<=" | ">" | ">=") arith }
+//	arith    = term { ("+" | "-") term }
+//	term     = primary { ("*" | "/") primary }
+//	primary  = number | "(" expr ")" | selector | rate | sum | quantile
+//	selector = [ name ] [ "{" matcher { "," matcher } "}" ]
+//	matcher  = label ( "=" | "!=" | "=~" | "!~" ) string
+//	rate     = "rate" "(" selector "[" duration "]" ")"
+//	sum      = "sum" [ by ] "(" expr ")" [ by ]
+//	by       = "by" "(" [ label { "," label } ] ")"
+//	quantile = "histogram_quantile" "(" number "," expr ")"
+
+// An Expr is a parsed query.
+type Expr interface {
+	String() string
+}
+
+type numberLit struct{ v float64 }
+
+type vectorSelector struct {
+	src      string // as written in the query
+	matchers []*Matcher
+	rng      int64 // range in milliseconds, for range selectors
+}
+
+type rateCall struct{ sel *vectorSelector }
+
+type sumAggr struct {
+	by   []string
+	expr Expr
+}
+
+type quantileCall struct {
+	q    float64
+	expr Expr
+}
+
+type binaryExpr struct {
+	op       string // + - * / == != < <= > >=
+	lhs, rhs Expr
+}
+
+func (n *numberLit) String() string      { return formatFloat(n.v) }
+func (n *vectorSelector) String() string { return n.src }
+func (n *rateCall) String() string       { return "rate(" + n.sel.String() + ")" }
+func (n *sumAggr) String() string {
+	return "sum by (" + strings.Join(n.by, ", ") + ") (" + n.expr.String() + ")"
+}
+func (n *quantileCall) String() string {
+	return fmt.Sprintf("histogram_quantile(%s, %s)", formatFloat(n.q), n.expr)
+}
+func (n *binaryExpr) String() string {
+	return n.lhs.String() + " " + string(n.op) + " " + n.rhs.String()
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokDuration
+	tokPunct // ( ) { } [ ] , = != =~ !~ + - * / == < <= > >=
+)
+
+type token struct {
+	kind tokenKind
+	s    string // raw text, unquoted for strings
+	pos  int
+}
+
+func lex(in string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(in); {
+		c := in[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '_' || c == ':' || unicode.IsLetter(rune(c)):
+			for i < len(in) && (in[i] == '_' || in[i] == ':' || unicode.IsLetter(rune(in[i])) || unicode.IsDigit(rune(in[i]))) {
+				i++
+			}
+			toks = append(toks, token{tokIdent, in[start:i], start})
+		case unicode.IsDigit(rune(c)) || c == '.':
+			for i < len(in) && (unicode.IsDigit(rune(in[i])) || in[i] == '.' || in[i] == 'e' ||
+				((in[i] == '+' || in[i] == '-') && in[i-1] == 'e')) {
+				i++
+			}
+			kind := tokNumber
+			if i < len(in) && unicode.IsLetter(rune(in[i])) {
+				// A duration, e.g. 5m or 1h30m.
+				for i < len(in) && (unicode.IsLetter(rune(in[i])) || unicode.IsDigit(rune(in[i]))) {
+					i++
+				}
+				kind = tokDuration
+			}
+			toks = append(toks, token{kind, in[start:i], start})
+		case c == '"' || c == '\'':
+			i++
+			for i < len(in) && in[i] != c {
+				if in[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(in) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			raw := in[start:i]
+			if c == '\'' {
+				raw = `"` + strings.Replace(raw[1:len(raw)-1], `"`, `\"`, -1) + `"`
+			}
+			s, err := strconv.Unquote(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at position %d: %v", start, err)
+			}
+			toks = append(toks, token{tokString, s, start})
+		case (c == '!' || c == '=') && i+1 < len(in) && (in[i+1] == '=' || in[i+1] == '~'),
+			(c == '<' || c == '>') && i+1 < len(in) && in[i+1] == '=':
+			i += 2
+			toks = append(toks, token{tokPunct, in[start:i], start})
+		case strings.IndexByte("(){}[],=+-*/<>", c) >= 0:
+			i++
+			toks = append(toks, token{tokPunct, in[start:i], start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(in)}), nil
+}
+
+type parser struct {
+	in   string
+	toks []token
+	pos  int
+}
+
+// ParseExpr parses a query.
+func ParseExpr(in string) (Expr, error) {
+	toks, err := lex(in)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{in: in, toks: toks}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.s)
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at position %d: %s", t.pos, fmt.Sprintf(format, args...))
+}
+
+// accept consumes the next token if it's the punctuation s.
+func (p *parser) accept(s string) bool {
+	if t := p.peek(); t.kind == tokPunct && t.s == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.accept(s) {
+		t := p.peek()
+		if t.kind == tokEOF {
+			return p.errorf(t, "unexpected end of query, expected %q", s)
+		}
+		return p.errorf(t, "unexpected %q, expected %q", t.s, s)
+	}
+	return nil
+}
+
+func (p *parser) expr() (Expr, error) {
+	lhs, err := p.arith()
+	for err == nil {
+		op := p.peek()
+		if !p.accept("==") && !p.accept("!=") && !p.accept("<") && !p.accept("<=") && !p.accept(">") && !p.accept(">=") {
+			break
+		}
+		var rhs Expr
+		if rhs, err = p.arith(); err == nil {
+			lhs = &binaryExpr{op: op.s, lhs: lhs, rhs: rhs}
+		}
+	}
+	return lhs, err
+}
+
+func (p *parser) arith() (Expr, error) {
+	lhs, err := p.term()
+	for err == nil {
+		op := p.peek()
+		if !p.accept("+") && !p.accept("-") {
+			break
+		}
+		var rhs Expr
+		if rhs, err = p.term(); err == nil {
+			lhs = &binaryExpr{op: op.s, lhs: lhs, rhs: rhs}
+		}
+	}
+	return lhs, err
+}
+
+func (p *parser) term() (Expr, error) {
+	lhs, err := p.primary()
+	for err == nil {
+		op := p.peek()
+		if !p.accept("*") && !p.accept("/") {
+			break
+		}
+		var rhs Expr
+		if rhs, err = p.primary(); err == nil {
+			lhs = &binaryExpr{op: op.s, lhs: lhs, rhs: rhs}
+		}
+	}
+	return lhs, err
+}
+
+func (p *parser) primary() (Expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.s, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %q", t.s)
+		}
+		return &numberLit{v}, nil
+	case t.kind == tokPunct && t.s == "(":
+		p.next()
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case t.kind == tokIdent && (t.s == "sum" || p.toks[p.pos+1].s == "("):
+		return p.call()
+	case t.kind == tokIdent || t.kind == tokPunct && t.s == "{":
+		sel, err := p.selector()
+		if err != nil {
+			return nil, err
+		}
+		if sel.rng != 0 {
+			return nil, p.errorf(t, "range vector %s must be the argument of rate", sel)
+		}
+		return sel, nil
+	case t.kind == tokEOF:
+		return nil, p.errorf(t, "unexpected end of query")
+	}
+	return nil, p.errorf(t, "unexpected %q", t.s)
+}
+
+func (p *parser) call() (Expr, error) {
+	fn := p.next()
+	switch fn.s {
+	case "rate":
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		t := p.peek()
+		sel, err := p.selector()
+		if err != nil {
+			return nil, err
+		}
+		if sel.rng == 0 {
+			return nil, p.errorf(t, "rate expects a range vector, e.g. %s[5m]", sel)
+		}
+		return &rateCall{sel}, p.expect(")")
+
+	case "sum":
+		var (
+			agg sumAggr
+			err error
+		)
+		if p.peek().s == "by" {
+			if agg.by, err = p.by(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		if agg.expr, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if agg.by == nil && p.peek().s == "by" {
+			if agg.by, err = p.by(); err != nil {
+				return nil, err
+			}
+		}
+		return &agg, nil
+
+	case "histogram_quantile":
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		t := p.next()
+		if t.kind != tokNumber {
+			return nil, p.errorf(t, "histogram_quantile expects a number as first argument")
+		}
+		q, err := strconv.ParseFloat(t.s, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %q", t.s)
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &quantileCall{q: q, expr: e}, p.expect(")")
+	}
+	return nil, p.errorf(fn, "unsupported function %q, want rate, sum or histogram_quantile", fn.s)
+}
+
+// by parses a by clause, returning a non nil list.
+func (p *parser) by() ([]string, error) {
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for !p.accept(")") {
+		if len(labels) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		t := p.next()
+		if t.kind != tokIdent {
+			return nil, p.errorf(t, "expected a label name")
+		}
+		labels = append(labels, t.s)
+	}
+	return labels, nil
+}
+
+func (p *parser) selector() (*vectorSelector, error) {
+	start := p.peek()
+	sel := &vectorSelector{}
+	if start.kind == tokIdent {
+		p.next()
+		m, _ := NewMatcher(MatchEqual, MetricName, start.s)
+		sel.matchers = append(sel.matchers, m)
+	}
+	if p.accept("{") {
+		for !p.accept("}") {
+			if len(sel.matchers) > 0 && p.toks[p.pos-1].s != "{" {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				if p.accept("}") {
+					break
+				}
+			}
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, p.errorf(name, "expected a label name")
+			}
+			op := p.next()
+			types := map[string]MatchType{"=": MatchEqual, "!=": MatchNotEqual, "=~": MatchRegexp, "!~": MatchNotRegexp}
+			typ, ok := types[op.s]
+			if op.kind != tokPunct || !ok {
+				return nil, p.errorf(op, "expected a label matching operator")
+			}
+			val := p.next()
+			if val.kind != tokString {
+				return nil, p.errorf(val, "expected a string")
+			}
+			m, err := NewMatcher(typ, name.s, val.s)
+			if err != nil {
+				return nil, p.errorf(val, "invalid regular expression: %v", err)
+			}
+			sel.matchers = append(sel.matchers, m)
+		}
+	}
+	if len(sel.matchers) == 0 {
+		return nil, p.errorf(start, "selector must have at least one matcher")
+	}
+	if p.accept("[") {
+		t := p.next()
+		d, err := parseDuration(t.s)
+		if t.kind != tokDuration || err != nil || d <= 0 {
+			return nil, p.errorf(t, "invalid range %q", t.s)
+		}
+		sel.rng = int64(d / time.Millisecond)
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	sel.src = strings.TrimSpace(p.in[start.pos:p.peek().pos])
+	return sel, nil
+}
+
+// parseDuration parses a Prometheus duration, a sequence of integers followed
+// by a unit: ms, s, m, h, d, w or y.
+func parseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	var d time.Duration
+	for s != "" {
+		i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) })
+		if i <= 0 {
+			return 0, fmt.Errorf("invalid duration")
+		}
+		j := len(s)
+		if k := strings.IndexFunc(s[i:], unicode.IsDigit); k >= 0 {
+			j = i + k
+		}
+		n, err := strconv.Atoi(s[:i])
+		unit, ok := units[s[i:j]]
+		if err != nil || !ok {
+			return 0, fmt.Errorf("invalid duration")
+		}
+		d += time.Duration(n) * unit
+		s = s[j:]
+	}
+	return d, nil
+}
@@ -0,0 +1,250 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDB returns a database with 10 minutes of samples scraped every 10s,
+// until time 600s.
+func testDB() *DB {
+	db := New(Options{})
+	series := []struct {
+		labels map[string]string
+		inc    float64 // per scrape
+	}{
+		{map[string]string{MetricName: "http_requests_total", "route": "/get", "code": "200"}, 10},
+		{map[string]string{MetricName: "http_requests_total", "route": "/get", "code": "500"}, 1},
+		{map[string]string{MetricName: "http_requests_total", "route": "/add", "code": "200"}, 5},
+		{map[string]string{MetricName: "latency_seconds_bucket", "route": "/get", "le": "0.01"}, 0},
+		{map[string]string{MetricName: "latency_seconds_bucket", "route": "/get", "le": "0.1"}, 5},
+		{map[string]string{MetricName: "latency_seconds_bucket", "route": "/get", "le": "1"}, 10},
+		{map[string]string{MetricName: "latency_seconds_bucket", "route": "/get", "le": "+Inf"}, 10},
+	}
+	for _, s := range series {
+		lset := FromMap(s.labels)
+		v := 0.0
+		for t := int64(0); t <= 600000; t += 10000 {
+			if s.labels["route"] == "/add" && t == 300000 {
+				v = 0 // counter reset
+			}
+			db.Append(lset, t, v)
+			v += s.inc
+		}
+	}
+	return db
+}
+
+func TestQuery(t *testing.T) {
+	db := testDB()
+	tests := []struct {
+		query string
+		want  map[string]float64 // by labels
+	}{
+		{
+			query: `http_requests_total{route="/get", code!="200"}`,
+			want:  map[string]float64{`{__name__="http_requests_total", code="500", route="/get"}`: 60},
+		},
+		{
+			query: `rate(http_requests_total[1m])`,
+			want: map[string]float64{
+				`{code="200", route="/add"}`: 0.5,
+				`{code="200", route="/get"}`: 1,
+				`{code="500", route="/get"}`: 0.1,
+			},
+		},
+		{
+			query: `rate(http_requests_total{route="/add"}[10m])`,
+			// Samples from 10s to 600s, the reset to 0 at 300s loses an
+			// increment.
+			want: map[string]float64{`{code="200", route="/add"}`: 290.0 / 590},
+		},
+		{
+			query: `sum by (route) (rate(http_requests_total[1m]))`,
+			want:  map[string]float64{`{route="/add"}`: 0.5, `{route="/get"}`: 1.1},
+		},
+		{
+			query: `sum(rate(http_requests_total{code=~"5.."}[1m])) / sum(rate(http_requests_total[1m]))`,
+			want:  map[string]float64{`{}`: 0.1 / 1.6},
+		},
+		{
+			query: `sum(rate(http_requests_total[1m])) by (code) * 60`,
+			want:  map[string]float64{`{code="200"}`: 90, `{code="500"}`: 6},
+		},
+		{
+			query: `histogram_quantile(0.5, rate(latency_seconds_bucket[1m]))`,
+			want:  map[string]float64{`{route="/get"}`: 0.1},
+		},
+		{
+			query: `histogram_quantile(0.75, sum by (le) (rate(latency_seconds_bucket[1m])))`,
+			want:  map[string]float64{`{}`: 0.55},
+		},
+		{
+			// The first bucket is empty.
+			query: `histogram_quantile(0, rate(latency_seconds_bucket[1m]))`,
+			want:  map[string]float64{`{route="/get"}`: 0},
+		},
+		{
+			query: `rate(http_requests_total[1m]) > 0.5`,
+			want:  map[string]float64{`{code="200", route="/get"}`: 1},
+		},
+		{
+			query: `http_requests_total < 1000 + 1`,
+			want: map[string]float64{
+				`{__name__="http_requests_total", code="200", route="/add"}`: 150,
+				`{__name__="http_requests_total", code="200", route="/get"}`: 600,
+				`{__name__="http_requests_total", code="500", route="/get"}`: 60,
+			},
+		},
+		{
+			query: `http_requests_total{code="200"} >= http_requests_total{code="200", route="/get"}`,
+			want:  map[string]float64{`{__name__="http_requests_total", code="200", route="/get"}`: 600},
+		},
+		{
+			query: `(1 + 2) * 3`,
+			want:  map[string]float64{`{}`: 9},
+		},
+		{
+			query: `missing_metric`,
+			want:  map[string]float64{},
+		},
+	}
+	for _, tt := range tests {
+		res, err := db.Query(tt.query, 600000)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		got := make(map[string]float64)
+		for _, s := range res.Series {
+			if len(s.Samples) != 1 || s.Samples[0].T != 600000 {
+				t.Errorf("%s: %s: unexpected samples %v", tt.query, s.Labels, s.Samples)
+			}
+			got[s.Labels.String()] = s.Samples[0].V
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if math.IsNaN(got[k]) || math.Abs(got[k]-v) > 1e-9 {
+				t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	db := testDB()
+	res, err := db.QueryRange(`sum(rate(http_requests_total{route="/get"}[30s]))`, 0, 600000, 60000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Series) != 1 {
+		t.Fatalf("got %d series, want 1", len(res.Series))
+	}
+	// No rate at time 0, a single sample is in range.
+	samples := res.Series[0].Samples
+	if len(samples) != 10 || samples[0].T != 60000 || samples[0].V != 1.1 {
+		t.Errorf("samples = %v, want 10 samples from 60000", samples)
+	}
+
+	if _, err := db.QueryRange("up", 0, 1e9, 1); err == nil {
+		t.Errorf("query exceeding the maximum resolution should fail")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, q := range []string{
+		``,
+		`{}`,
+		`up[5m]`,
+		`rate(up)`,
+		`rate(up[5x])`,
+		`sum(up`,
+		`sum by (job`,
+		`up{job="a"`,
+		`up{job=a}`,
+		`up{job=~"("}`,
+		`avg(up)`,
+		`histogram_quantile(up, up)`,
+		`up up`,
+		`up >`,
+		`"unterminated`,
+	} {
+		if _, err := ParseExpr(q); err == nil {
+			t.Errorf("ParseExpr(%q) should fail", q)
+		}
+	}
+	for _, q := range []string{`sum(1)`, `1 > 0`} {
+		if _, err := testDB().Query(q, 0); err == nil {
+			t.Errorf("%s should fail", q)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(testDB().Handler())
+	defer srv.Close()
+
+	get := func(path string, params url.Values) (int, apiResponse) {
+		resp, err := http.Get(srv.URL + path + "?" + params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body apiResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+
+	code, body := get("/api/v1/query_range", url.Values{
+		"query": {`sum by (code) (rate(http_requests_total[1m]))`},
+		"start": {"540"},
+		"end":   {"1970-01-01T00:10:00Z"},
+		"step":  {"1m"},
+	})
+	if code != http.StatusOK || body.Status != "success" {
+		t.Fatalf("query_range: %d %+v", code, body)
+	}
+	want := map[string]interface{}{
+		"resultType": "matrix",
+		"result": []interface{}{
+			map[string]interface{}{
+				"metric": map[string]interface{}{"code": "200"},
+				"values": []interface{}{[]interface{}{540.0, "1.5"}, []interface{}{600.0, "1.5"}},
+			},
+			map[string]interface{}{
+				"metric": map[string]interface{}{"code": "500"},
+				"values": []interface{}{[]interface{}{540.0, "0.1"}, []interface{}{600.0, "0.1"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(body.Data, want) {
+		t.Errorf("query_range data = %v, want %v", body.Data, want)
+	}
+
+	code, body = get("/api/v1/query", url.Values{"query": {"1 + 1"}, "time": {"600"}})
+	if want := map[string]interface{}{"resultType": "scalar", "result": []interface{}{600.0, "2"}}; code != http.StatusOK || !reflect.DeepEqual(body.Data, want) {
+		t.Errorf("query: %d %+v, want %v", code, body, want)
+	}
+
+	code, body = get("/api/v1/label/__name__/values", nil)
+	if want := []interface{}{"http_requests_total", "latency_seconds_bucket"}; code != http.StatusOK || !reflect.DeepEqual(body.Data, want) {
+		t.Errorf("label values: %d %+v, want %v", code, body, want)
+	}
+
+	code, body = get("/api/v1/query_range", url.Values{"query": {"up"}, "start": {"yesterday"}, "end": {"0"}, "step": {"1"}})
+	if code != http.StatusBadRequest || body.ErrorType != "bad_data" || !strings.Contains(body.Error, "yesterday") {
+		t.Errorf("invalid start: %d %+v", code, body)
+	}
+}
@@ -0,0 +1,98 @@
+package tsdb
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Scrape gathers the metrics of g and appends them at time t, in the same
+// series as a Prometheus server scraping them would: histograms and
+// summaries are split into their _bucket, _sum and _count series.
+func (db *DB) Scrape(g prometheus.Gatherer, t time.Time) error {
+	mfs, err := g.Gather()
+	ts := t.UnixNano() / int64(time.Millisecond)
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel())+2)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			add := func(name string, v float64, extra ...string) {
+				ls := make(map[string]string, len(labels)+2)
+				for k, v := range labels {
+					ls[k] = v
+				}
+				ls[MetricName] = name
+				for i := 0; i < len(extra); i += 2 {
+					ls[extra[i]] = extra[i+1]
+				}
+				db.Append(FromMap(ls), ts, v)
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue // added below
+					}
+					add(name+"_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+	db.Truncate(ts)
+	// Gather returns the metrics it could gather along with the error.
+	return err
+}
+
+// Run scrapes g every interval until ctx is done. Errors are reported to errf,
+// if not nil.
+func (db *DB) Run(ctx context.Context, g prometheus.Gatherer, interval time.Duration, errf func(error)) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-tick.C:
+			if err := db.Scrape(g, t); err != nil && errf != nil {
+				errf(err)
+			}
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
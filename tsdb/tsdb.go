@@ -0,0 +1,281 @@
+// Package tsdb is a small in-memory time series database, for programs to
+// record their own metrics and query them without running Prometheus.
+//
+// Samples are compressed with the Gorilla XOR encoding in chunks of up to 120
+// samples, and chunks older than the retention are dropped. The database can
+// periodically scrape a Prometheus registry, and serve a subset of the
+// Prometheus HTTP query API, enough for Grafana to use it as a Prometheus
+// datasource.
+package tsdb
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricName is the name of the label holding the metric name.
+const MetricName = "__name__"
+
+// A Label is a name/value pair.
+type Label struct {
+	Name, Value string
+}
+
+// Labels is a set of labels, sorted by name.
+type Labels []Label
+
+// FromMap returns the labels of m.
+func FromMap(m map[string]string) Labels {
+	ls := make(Labels, 0, len(m))
+	for n, v := range m {
+		ls = append(ls, Label{n, v})
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+	return ls
+}
+
+// Get returns the value of the label name, or "" if there's none.
+func (ls Labels) Get(name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// Map returns the labels as a map.
+func (ls Labels) Map() map[string]string {
+	m := make(map[string]string, len(ls))
+	for _, l := range ls {
+		m[l.Name] = l.Value
+	}
+	return m
+}
+
+// String returns the labels in the Prometheus format, e.g. {a="1", b="2"}.
+// It identifies the set of labels.
+func (ls Labels) String() string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range ls {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s=%q", l.Name, l.Value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// A MatchType is the kind of comparison of a label matcher.
+type MatchType int
+
+// Label matchers, as in Prometheus selectors.
+const (
+	MatchEqual     MatchType = iota // =
+	MatchNotEqual                   // !=
+	MatchRegexp                     // =~
+	MatchNotRegexp                  // !~
+)
+
+// A Matcher selects series by the value of a label.
+type Matcher struct {
+	Type        MatchType
+	Name, Value string
+	re          *regexp.Regexp
+}
+
+// NewMatcher creates a matcher. Regular expressions are anchored, they must
+// match the whole value.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches reports whether v, the value of the label, matches. A missing label
+// has an empty value.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// A Sample is a value at a given time, in milliseconds since the Unix epoch.
+type Sample struct {
+	T int64
+	V float64
+}
+
+// A Series is a set of labels and its samples, by increasing time.
+type Series struct {
+	Labels  Labels
+	Samples []Sample
+}
+
+// chunkSamples is the maximum number of samples in a chunk, from the Gorilla
+// paper: the compression ratio doesn't improve much above.
+const chunkSamples = 120
+
+type memSeries struct {
+	lset   Labels
+	chunks []*chunk // by increasing time
+}
+
+// Options configures a DB.
+type Options struct {
+	// Retention is how long samples are kept, defaults to 1 hour.
+	Retention time.Duration
+}
+
+// DB is an in-memory time series database. It's safe for concurrent use.
+type DB struct {
+	retention int64 // in milliseconds
+
+	mu     sync.RWMutex
+	series map[string]*memSeries // by labels
+}
+
+// New creates an empty database.
+func New(opts Options) *DB {
+	if opts.Retention <= 0 {
+		opts.Retention = time.Hour
+	}
+	return &DB{
+		retention: int64(opts.Retention / time.Millisecond),
+		series:    make(map[string]*memSeries),
+	}
+}
+
+// Append adds a sample to the series identified by lset, creating it if
+// needed. Samples not more recent than the last one of the series are
+// ignored.
+func (db *DB) Append(lset Labels, t int64, v float64) {
+	key := lset.String()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s, ok := db.series[key]
+	if !ok {
+		s = &memSeries{lset: lset}
+		db.series[key] = s
+	}
+	var c *chunk
+	if n := len(s.chunks); n > 0 {
+		c = s.chunks[n-1]
+		if t <= c.maxt {
+			return
+		}
+	}
+	if c == nil || c.n >= chunkSamples {
+		c = &chunk{}
+		s.chunks = append(s.chunks, c)
+	}
+	c.append(t, v)
+}
+
+// Truncate drops the chunks which samples are all older than the retention,
+// now being in milliseconds, and the series left without samples.
+func (db *DB) Truncate(now int64) {
+	mint := now - db.retention
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for key, s := range db.series {
+		i := 0
+		for i < len(s.chunks) && s.chunks[i].maxt < mint {
+			i++
+		}
+		if i == len(s.chunks) {
+			delete(db.series, key)
+			continue
+		}
+		s.chunks = s.chunks[i:]
+	}
+}
+
+// Stats returns the number of series and the number of bytes used by the
+// compressed samples.
+func (db *DB) Stats() (series, bytes int) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, s := range db.series {
+		for _, c := range s.chunks {
+			bytes += c.size()
+		}
+	}
+	return len(db.series), bytes
+}
+
+// Select returns the series matching all matchers, with their samples
+// between mint and maxt included, sorted by labels.
+func (db *DB) Select(mint, maxt int64, ms ...*Matcher) []Series {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var res []Series
+outer:
+	for _, s := range db.series {
+		for _, m := range ms {
+			if !m.Matches(s.lset.Get(m.Name)) {
+				continue outer
+			}
+		}
+		var samples []Sample
+		for _, c := range s.chunks {
+			if c.maxt < mint || c.mint > maxt {
+				continue
+			}
+			it := c.iterator()
+			for it.next() {
+				t, v := it.at()
+				if t >= mint && t <= maxt {
+					samples = append(samples, Sample{t, v})
+				}
+			}
+		}
+		if len(samples) > 0 {
+			res = append(res, Series{Labels: s.lset, Samples: samples})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Labels.String() < res[j].Labels.String() })
+	return res
+}
+
+// LabelValues returns the sorted values of the label name.
+func (db *DB) LabelValues(name string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	set := make(map[string]bool)
+	for _, s := range db.series {
+		if v := s.lset.Get(name); v != "" {
+			set[v] = true
+		}
+	}
+	vals := make([]string, 0, len(set))
+	for v := range set {
+		vals = append(vals, v)
+	}
+	sort.Strings(vals)
+	return vals
+}
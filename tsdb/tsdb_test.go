@@ -0,0 +1,80 @@
+package tsdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDB(t *testing.T) {
+	db := New(Options{Retention: time.Hour})
+	a := FromMap(map[string]string{MetricName: "up", "job": "a"})
+	b := FromMap(map[string]string{MetricName: "up", "job": "b"})
+	for i := int64(0); i < 300; i++ {
+		db.Append(a, i*1000, float64(i))
+		db.Append(b, i*1000, 1)
+	}
+	db.Append(a, 10, 42) // out of order, ignored
+
+	m, _ := NewMatcher(MatchEqual, "job", "a")
+	got := db.Select(100000, 102000, m)
+	want := []Series{{Labels: a, Samples: []Sample{{100000, 100}, {101000, 101}, {102000, 102}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Select() = %v, want %v", got, want)
+	}
+
+	re, _ := NewMatcher(MatchRegexp, "job", "a|b")
+	if got := db.Select(0, 0, re); len(got) != 2 {
+		t.Errorf("Select(job=~a|b) returned %d series, want 2", len(got))
+	}
+	if vals := db.LabelValues("job"); !reflect.DeepEqual(vals, []string{"a", "b"}) {
+		t.Errorf("LabelValues(job) = %q", vals)
+	}
+
+	// Only the chunks which samples are all older than the retention are
+	// dropped.
+	db.Truncate(time.Hour.Nanoseconds()/1e6 + 150000)
+	got = db.Select(0, 1<<62, m)
+	if first := got[0].Samples[0].T; first != 120000 {
+		t.Errorf("after truncation, first sample at %d, want 120000", first)
+	}
+	db.Truncate(1 << 62)
+	if series, bytes := db.Stats(); series != 0 || bytes != 0 {
+		t.Errorf("Stats() = %d, %d after truncating everything", series, bytes)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}, []string{"code"})
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "duration_seconds", Help: "Duration.", Buckets: []float64{0.1, 1}})
+	reg.MustRegister(c, h)
+	c.WithLabelValues("200").Add(3)
+	h.Observe(0.5)
+
+	db := New(Options{})
+	now := time.Now()
+	if err := db.Scrape(reg, now); err != nil {
+		t.Fatal(err)
+	}
+	ms := now.UnixNano() / 1e6
+
+	tests := map[string]float64{
+		`{__name__="requests_total", code="200"}`:         3,
+		`{__name__="duration_seconds_bucket", le="0.1"}`:  0,
+		`{__name__="duration_seconds_bucket", le="1"}`:    1,
+		`{__name__="duration_seconds_bucket", le="+Inf"}`: 1,
+		`{__name__="duration_seconds_count"}`:             1,
+		`{__name__="duration_seconds_sum"}`:               0.5,
+	}
+	got := make(map[string]float64)
+	all, _ := NewMatcher(MatchRegexp, MetricName, ".+")
+	for _, s := range db.Select(ms, ms, all) {
+		got[s.Labels.String()] = s.Samples[0].V
+	}
+	if !reflect.DeepEqual(got, tests) {
+		t.Errorf("scraped series:\n%v\nwant:\n%v", got, tests)
+	}
+}
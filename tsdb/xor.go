@@ -0,0 +1,268 @@
+package tsdb
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Samples are compressed in chunks with the encoding described in the Gorilla
+// paper (Pelkonen et al., "Gorilla: A Fast, Scalable, In-Memory Time Series
+// Database", VLDB 2015), with the timestamps bit widths used by Prometheus
+// since timestamps are in milliseconds:
+//
+//   - the first sample is stored as is, 64 bits for the timestamp and 64 bits
+//     for the value,
+//   - each following timestamp is stored as the difference between its delta
+//     to the previous timestamp and the previous delta (delta of delta),
+//     which is 0 for regularly scraped samples and is then stored in 1 bit,
+//   - each following value is XORed with the previous one, and only the bits
+//     that differ are stored, 1 bit if the value didn't change.
+
+// bstream is a stream of bits.
+type bstream struct {
+	b     []byte
+	count uint8 // number of bits available in the last byte
+}
+
+func (s *bstream) writeBit(bit bool) {
+	if s.count == 0 {
+		s.b = append(s.b, 0)
+		s.count = 8
+	}
+	if bit {
+		s.b[len(s.b)-1] |= 1 << (s.count - 1)
+	}
+	s.count--
+}
+
+// writeBits writes the n lowest bits of u, most significant first.
+func (s *bstream) writeBits(u uint64, n int) {
+	for n > 0 {
+		n--
+		s.writeBit(u>>uint(n)&1 == 1)
+	}
+}
+
+var errEOS = errors.New("tsdb: unexpected end of chunk")
+
+// breader reads a bstream.
+type breader struct {
+	b   []byte
+	pos int // in bits
+}
+
+func (r *breader) readBit() (bool, error) {
+	if r.pos >= len(r.b)*8 {
+		return false, errEOS
+	}
+	bit := r.b[r.pos/8]>>(7-uint(r.pos%8))&1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *breader) readBits(n int) (uint64, error) {
+	var u uint64
+	for ; n > 0; n-- {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
+
+// Bit widths of the delta of delta encoding, after a prefix of 1 to 4 bits
+// (0, 10, 110, 1110 and 1111). The first one is 0: a delta of delta of 0 is
+// only stored as the prefix.
+var dodWidths = [...]int{0, 14, 17, 20, 64}
+
+// fits reports whether x can be stored in n bits, as a two's complement
+// integer, x being the upper bound rather than the lower one.
+func fits(x int64, n int) bool {
+	return -(1<<uint(n-1))+1 <= x && x <= 1<<uint(n-1)
+}
+
+// chunk holds compressed samples.
+type chunk struct {
+	bs         bstream
+	n          int   // number of samples
+	mint, maxt int64 // first and last timestamps
+
+	// State of the appender.
+	t, tDelta         int64
+	v                 float64
+	leading, trailing uint8
+}
+
+// append adds a sample to c, t must be greater than c.maxt.
+func (c *chunk) append(t int64, v float64) {
+	if c.n == 0 {
+		c.bs.writeBits(uint64(t), 64)
+		c.bs.writeBits(math.Float64bits(v), 64)
+		c.mint = t
+		c.leading = 0xff
+	} else {
+		c.writeTimestamp(t)
+		c.writeValue(v)
+	}
+	c.t, c.v, c.maxt = t, v, t
+	c.n++
+}
+
+func (c *chunk) writeTimestamp(t int64) {
+	delta := t - c.t
+	dod := delta - c.tDelta
+	c.tDelta = delta
+
+	for i, w := range dodWidths {
+		if i == len(dodWidths)-1 || dod == 0 || (w != 0 && fits(dod, w)) {
+			// Prefix: i ones, followed by a zero unless it's the last width.
+			c.bs.writeBits(1<<uint(i)-1, i)
+			if i < len(dodWidths)-1 {
+				c.bs.writeBit(false)
+			}
+			c.bs.writeBits(uint64(dod), w)
+			return
+		}
+	}
+}
+
+func (c *chunk) writeValue(v float64) {
+	delta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if delta == 0 {
+		c.bs.writeBit(false)
+		return
+	}
+	c.bs.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+	if leading >= 32 {
+		// Stored in 5 bits.
+		leading = 31
+	}
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		// The meaningful bits fit in the previous window.
+		c.bs.writeBit(false)
+		c.bs.writeBits(delta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+	c.leading, c.trailing = leading, trailing
+	sig := 64 - int(leading) - int(trailing)
+	c.bs.writeBit(true)
+	c.bs.writeBits(uint64(leading), 5)
+	c.bs.writeBits(uint64(sig), 6) // 64 overflows to 0, which can't happen otherwise
+	c.bs.writeBits(delta>>trailing, sig)
+}
+
+// size returns the number of bytes used by the samples of c.
+func (c *chunk) size() int { return len(c.bs.b) }
+
+// iterator returns an iterator over the samples of c.
+func (c *chunk) iterator() *chunkIterator {
+	return &chunkIterator{r: breader{b: c.bs.b}, n: c.n}
+}
+
+// chunkIterator decodes the samples of a chunk.
+type chunkIterator struct {
+	r    breader
+	n, i int
+	err  error
+
+	t, tDelta         int64
+	v                 float64
+	leading, trailing uint8
+}
+
+// next advances to the next sample, it returns false once all samples have
+// been read, or if the chunk is corrupted.
+func (it *chunkIterator) next() bool {
+	if it.err != nil || it.i >= it.n {
+		return false
+	}
+	if it.i == 0 {
+		t, err := it.r.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		v, err := it.r.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.t, it.v = int64(t), math.Float64frombits(v)
+	} else if it.err = it.readTimestamp(); it.err == nil {
+		it.err = it.readValue()
+	}
+	if it.err != nil {
+		return false
+	}
+	it.i++
+	return true
+}
+
+// at returns the current sample.
+func (it *chunkIterator) at() (int64, float64) { return it.t, it.v }
+
+func (it *chunkIterator) readTimestamp() error {
+	i := 0
+	for ; i < len(dodWidths)-1; i++ {
+		bit, err := it.r.readBit()
+		if err != nil {
+			return err
+		}
+		if !bit {
+			break
+		}
+	}
+	w := dodWidths[i]
+	u, err := it.r.readBits(w)
+	if err != nil {
+		return err
+	}
+	dod := int64(u)
+	if w != 0 && w != 64 && u > 1<<uint(w-1) {
+		// Negative.
+		dod -= 1 << uint(w)
+	}
+	it.tDelta += dod
+	it.t += it.tDelta
+	return nil
+}
+
+func (it *chunkIterator) readValue() error {
+	changed, err := it.r.readBit()
+	if err != nil || !changed {
+		return err
+	}
+	newWindow, err := it.r.readBit()
+	if err != nil {
+		return err
+	}
+	if newWindow {
+		leading, err := it.r.readBits(5)
+		if err != nil {
+			return err
+		}
+		sig, err := it.r.readBits(6)
+		if err != nil {
+			return err
+		}
+		if sig == 0 {
+			sig = 64
+		}
+		it.leading, it.trailing = uint8(leading), uint8(64-leading-sig)
+	}
+	u, err := it.r.readBits(64 - int(it.leading) - int(it.trailing))
+	if err != nil {
+		return err
+	}
+	it.v = math.Float64frombits(math.Float64bits(it.v) ^ u<<it.trailing)
+	return nil
+}
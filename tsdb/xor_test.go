@@ -0,0 +1,76 @@
+package tsdb
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestChunk(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var (
+		want []Sample
+		c    chunk
+		ts   int64 = 1570000000000
+		v          = 100.0
+	)
+	for i := 0; i < chunkSamples; i++ {
+		switch i % 4 {
+		case 0:
+			ts += 5000 // regular scrapes
+		case 1:
+			ts += 5000 + rng.Int63n(100) - 50 // jitter
+		case 2:
+			ts += rng.Int63n(1 << 30) // gaps
+		case 3:
+			ts++
+		}
+		switch i % 5 {
+		case 0:
+			// Same value.
+		case 1:
+			v++
+		case 2:
+			v = rng.NormFloat64() * 1e6
+		case 3:
+			v = math.Inf(1)
+		case 4:
+			v = -v
+		}
+		want = append(want, Sample{ts, v})
+		c.append(ts, v)
+	}
+
+	it := c.iterator()
+	var got []Sample
+	for it.next() {
+		t, v := it.at()
+		got = append(got, Sample{t, v})
+	}
+	if it.err != nil {
+		t.Fatal(it.err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].T != want[i].T || math.Float64bits(got[i].V) != math.Float64bits(want[i].V) {
+			t.Fatalf("sample %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if c.mint != want[0].T || c.maxt != ts {
+		t.Errorf("chunk time range = [%d, %d], want [%d, %d]", c.mint, c.maxt, want[0].T, ts)
+	}
+}
+
+func TestChunkCompression(t *testing.T) {
+	// A counter scraped every 5s, incremented a bit each time.
+	var c chunk
+	for i := 0; i < chunkSamples; i++ {
+		c.append(int64(i)*5000, float64(i*i%7+i*10))
+	}
+	// 16 bytes per sample uncompressed.
+	if got := float64(c.size()) / chunkSamples; got > 4 {
+		t.Errorf("%.1f bytes per sample, want at most 4", got)
+	}
+}